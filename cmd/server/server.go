@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"github.com/tylerchambers/electrumrelay/pkg/chain"
 	"github.com/tylerchambers/electrumrelay/pkg/electrum"
 	"github.com/tylerchambers/electrumrelay/pkg/relay"
 	"log"
 	"net/http"
+	"strings"
 )
 
 type server struct {
@@ -14,29 +19,149 @@ type server struct {
 }
 
 func main() {
+	proxy := flag.String("proxy", "", "proxy for connections to clearnet peers, as socks5://host:port or http://host:port")
+	torProxy := flag.String("tor-proxy", "", "SOCKS5 address of a Tor daemon used to reach onion peers, e.g. "+electrum.DefaultTorProxy)
+	transport := flag.String("transport", "prefer-tls", "transports used to reach peers: prefer-tls, tls-only, tcp-only, or tor-only")
+	tlsMode := flag.String("tls-mode", "tofu", "how peer certificates are verified: tofu, ca, pinned, or insecure")
+	tlsPins := flag.String("tls-pins", "", "comma separated hex SHA-256 fingerprints of the certificates or public keys accepted with -tls-mode pinned")
+	knownHosts := flag.String("known-hosts", "", "file to persist certificates trusted on first use in")
+	balancer := flag.String("balancer", relay.BalancerWeightedRandom, "how peers are chosen: weighted-random, round-robin, least-outstanding, power-of-two, or consistent-hash")
+	maxAttempts := flag.Int("max-attempts", relay.DefaultRetryConfig.MaxAttempts, "how many peers a failing read is tried on; 1 disables retries")
+	retryBroadcast := flag.Bool("retry-broadcast", false, "retry failed transaction broadcasts on other peers")
+	hedgePercentile := flag.Float64("hedge-percentile", 0, "percentile of recent response times after which reads are also sent to a second peer, e.g. 0.95; 0 disables hedging")
+	quorumPeers := flag.Int("quorum-peers", 0, "how many peers balance, transaction and tip reads are sent to; 0 disables consensus reads")
+	quorumAgree := flag.Int("quorum-agree", relay.DefaultQuorumConfig.Agree, "how many of -quorum-peers must agree on a result")
+	verify := flag.String("verify-transactions", "off", "check transactions against merkle proofs and headers: off, flag, or reject; reject needs -track-headers")
+	trackHeaders := flag.Bool("track-headers", false, "validate the peers' block headers, serve header requests from them, and drop peers on other branches")
+	networkName := flag.String("network", electrum.MainNet.Name, "Bitcoin network to serve: mainnet, testnet, signet, or regtest")
+	bootstrap := flag.String("bootstrap", "", "comma separated servers to discover peers from, as host:port:s or host:port:t, with IPv6 hosts in brackets; the network's defaults if empty")
+	wsOrigins := flag.String("ws-origins", "", "comma separated origins, e.g. https://wallet.example.com, whose web pages may open /ws sessions besides the relay's own; * allows any. Only the relay's own by default")
+	minProtocol := flag.String("min-protocol", electrum.DefaultProtocolMin, "lowest Electrum protocol version accepted from peers")
+	flag.Parse()
+
 	s := server{
 		router: http.NewServeMux(),
 	}
 
 	s.router.HandleFunc("/", s.handleRelay)
-	initialNode := &electrum.Node{
-		Host:         "electrum.blockstream.info",
-		IP:           "",
-		Version:      "",
-		SSLPort:      50002,
-		TCPPort:      0,
-		PruningLimit: 0,
+	s.router.HandleFunc("/status", s.handleStatus)
+	s.router.HandleFunc("/ws", s.handleWebSocket)
+	s.router.HandleFunc("/headers", s.handleHeaders)
+	network, err := electrum.ParseNetwork(*networkName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	servers := network.Bootstrap
+	if *bootstrap != "" {
+		servers = nil
+		for _, s := range strings.Split(*bootstrap, ",") {
+			n, err := network.ParseServer(strings.TrimSpace(s))
+			if err != nil {
+				log.Fatal(err)
+			}
+			servers = append(servers, *n)
+		}
 	}
 
 	// set up the relay and register initial peers
-	ec := electrum.NewClient(log.Default(), log.Default(), log.Default())
-	r := relay.NewRelay([]electrum.Node{}, []string{}, ec)
-	err := r.Bootstrap(initialNode)
+	opts := []electrum.ClientOption{electrum.WithNetwork(*network)}
+	policy, err := electrum.ParseTransportPolicy(*transport)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts = append(opts, electrum.WithTransportPolicy(policy))
+	opts = append(opts, electrum.WithProtocolVersions(*minProtocol, electrum.DefaultProtocolMax))
+	mode, err := electrum.ParseTLSMode(*tlsMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsPolicy := electrum.TLSPolicy{Mode: mode}
+	if *tlsPins != "" {
+		for _, pin := range strings.Split(*tlsPins, ",") {
+			tlsPolicy.Pins = append(tlsPolicy.Pins, strings.TrimSpace(pin))
+		}
+	}
+	if mode == electrum.TLSPinned && len(tlsPolicy.Pins) == 0 {
+		log.Fatal("-tls-mode pinned needs the accepted certificates in -tls-pins")
+	}
+	if mode != electrum.TLSPinned && len(tlsPolicy.Pins) > 0 {
+		log.Fatal("-tls-pins is only used with -tls-mode pinned")
+	}
+	opts = append(opts, electrum.WithTLSPolicy(tlsPolicy))
+	if *knownHosts != "" {
+		store, err := electrum.NewFileFingerprintStore(*knownHosts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, electrum.WithFingerprintStore(store))
+	}
+	if *proxy != "" {
+		d, err := electrum.ProxyDialer(*proxy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, electrum.WithDialer(d))
+	}
+	if *torProxy != "" {
+		opts = append(opts, electrum.WithTorProxy(electrum.NewTorDialer(*torProxy)))
+	}
+	// The relay's health checker learns of connection failures and missed keepalives from the client.
+	var r *relay.Relay
+	opts = append(opts, electrum.WithConnStateHandler(func(change electrum.ConnStateChange) {
+		r.Health().ObserveConnState(change)
+	}))
+	ec := electrum.NewClient(log.Default(), log.Default(), log.Default(), opts...)
+	b, err := relay.ParseBalancer(*balancer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	verifyMode, err := relay.ParseVerifyMode(*verify)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if verifyMode == relay.VerifyReject && !*trackHeaders {
+		// Without a validated header chain there is no header to trust a transaction's merkle proof against.
+		log.Fatal("-verify-transactions reject needs -track-headers")
+	}
+	relayOpts := []relay.Option{
+		relay.WithNetwork(*network),
+		relay.WithTransactionVerification(verifyMode),
+		relay.WithBalancer(b),
+		relay.WithRetryConfig(relay.RetryConfig{MaxAttempts: *maxAttempts, RetryBroadcast: *retryBroadcast}),
+	}
+	if *wsOrigins != "" {
+		var origins []string
+		for _, origin := range strings.Split(*wsOrigins, ",") {
+			origins = append(origins, strings.TrimSpace(origin))
+		}
+		relayOpts = append(relayOpts, relay.WithAllowedOrigins(origins...))
+	}
+	if *hedgePercentile > 0 {
+		relayOpts = append(relayOpts, relay.WithHedging(relay.HedgeConfig{Percentile: *hedgePercentile}))
+	}
+	if *quorumPeers > 0 {
+		relayOpts = append(relayOpts, relay.WithQuorum(relay.QuorumConfig{Peers: *quorumPeers, Agree: *quorumAgree}))
+	}
+	if *trackHeaders {
+		params, err := chain.NetworkParams(network.Name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c, err := chain.New(params)
+		if err != nil {
+			log.Fatal(err)
+		}
+		relayOpts = append(relayOpts, relay.WithHeaderChain(c))
+	}
+	r = relay.NewRelay([]electrum.Node{}, []string{}, ec, relayOpts...)
+	err = r.BootstrapServers(context.Background(), servers)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	s.relay = r
+	r.Health().Start()
+	r.TrackChain()
 
 	for _, v := range r.Peers {
 		fmt.Println(v)
@@ -47,22 +172,21 @@ func main() {
 }
 
 func (s *server) handleRelay(w http.ResponseWriter, r *http.Request) {
-	req, err := s.relay.ValidateRequest(r)
-	if err != nil {
-		log.Println(err)
-		w.Write([]byte("a error, see logs for details"))
-		return
-	}
-	resp, err := s.relay.ForwardRequest(req)
-	if err != nil {
-		w.Write([]byte("b error, see logs for details"))
-		log.Println(err)
-		return
-	}
-	_, err = w.Write(resp)
+	s.relay.ServeHTTP(w, r)
+}
+
+func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(s.relay.Status())
 	if err != nil {
-		w.Write([]byte("c error, see logs for details"))
 		log.Println(err)
-		return
 	}
 }
+
+func (s *server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	s.relay.ServeWebSocket(w, r)
+}
+
+func (s *server) handleHeaders(w http.ResponseWriter, r *http.Request) {
+	s.relay.HeaderFeed().ServeHTTP(w, r)
+}
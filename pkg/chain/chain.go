@@ -0,0 +1,272 @@
+// Package chain keeps the chain of Bitcoin block headers with the most work, validating every header it is given
+// against the consensus rules of its network.
+package chain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+var (
+	// ErrUnknownParent is returned for headers that don't build on any block of the chain, such as those of a branch
+	// that forked below where they start.
+	ErrUnknownParent = errors.New("headers do not connect to the chain")
+	// ErrInsufficientWork is returned for valid branches with no more work than the chain they would replace.
+	ErrInsufficientWork = errors.New("branch has no more work than the best chain")
+	// ErrCheckpoint is returned for headers that conflict with a checkpoint.
+	ErrCheckpoint = errors.New("headers conflict with a checkpoint")
+)
+
+// HeaderError is a header that breaks the consensus rules.
+type HeaderError struct {
+	Height int
+	Hash   string
+	Err    error
+}
+
+// Error implements the error interface.
+func (e *HeaderError) Error() string {
+	return fmt.Sprintf("invalid header %s at height %d: %v", e.Hash, e.Height, e.Err)
+}
+
+// Unwrap returns the rule the header breaks.
+func (e *HeaderError) Unwrap() error {
+	return e.Err
+}
+
+// entry is a header of the chain.
+type entry struct {
+	header *electrum.BlockHeader
+	raw    []byte
+	// work is the total work of the chain up to and including the header.
+	work *big.Int
+}
+
+// Chain is the best chain of block headers known, from the genesis block to the tip with the most work. It is safe
+// for concurrent use.
+type Chain struct {
+	params *Params
+
+	mu   sync.RWMutex
+	best []entry
+}
+
+// New creates a chain holding just the genesis block of the network.
+func New(params *Params) (*Chain, error) {
+	raw, err := hex.DecodeString(params.Genesis)
+	if err != nil {
+		return nil, fmt.Errorf("invalid genesis header: %v", err)
+	}
+	genesis, err := electrum.ParseBlockHeaderBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+	if genesis.Hash != params.GenesisHash {
+		return nil, fmt.Errorf("genesis header hashes to %s, want %s", genesis.Hash, params.GenesisHash)
+	}
+	return &Chain{params: params, best: []entry{{header: genesis, raw: raw, work: genesis.Work()}}}, nil
+}
+
+// Params returns the consensus rules of the chain's network.
+func (c *Chain) Params() *Params {
+	return c.params
+}
+
+// Height returns the height of the tip.
+func (c *Chain) Height() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.best) - 1
+}
+
+// Tip returns the tip and its height.
+func (c *Chain) Tip() (int, *electrum.BlockHeader) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.best) - 1, c.best[len(c.best)-1].header
+}
+
+// Work returns the total work of the chain.
+func (c *Chain) Work() *big.Int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return new(big.Int).Set(c.best[len(c.best)-1].work)
+}
+
+// Header returns the header at a height, reporting false if the chain isn't that high.
+func (c *Chain) Header(height int) (*electrum.BlockHeader, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if height < 0 || height >= len(c.best) {
+		return nil, false
+	}
+	return c.best[height].header, true
+}
+
+// RawHeaders returns up to count serialized headers starting at start, concatenated as blockchain.block.headers
+// returns them. Fewer are returned if the chain ends first.
+func (c *Chain) RawHeaders(start, count int) []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if start < 0 || count <= 0 {
+		return nil
+	}
+	end := start + count
+	if end > len(c.best) {
+		end = len(c.best)
+	}
+	var out []byte
+	for i := start; i < end; i++ {
+		out = append(out, c.best[i].raw...)
+	}
+	return out
+}
+
+// Connect adds serialized headers, concatenated, to the chain, the first being at height start. Headers the chain
+// already has are skipped. Headers that differ from the chain's form a branch, which replaces the chain above the fork
+// if it has more work; ErrInsufficientWork is returned if it doesn't. Either way every header is validated, and none
+// are added unless all are valid.
+func (c *Chain) Connect(start int, headers []byte) error {
+	if len(headers)%electrum.HeaderSize != 0 {
+		return fmt.Errorf("headers are %d bytes, not a multiple of %d", len(headers), electrum.HeaderSize)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if start < 0 || start > len(c.best) {
+		return fmt.Errorf("headers start at %d, above the tip at %d: %w", start, len(c.best)-1, ErrUnknownParent)
+	}
+	for len(headers) > 0 && start < len(c.best) && bytes.Equal(c.best[start].raw, headers[:electrum.HeaderSize]) {
+		start++
+		headers = headers[electrum.HeaderSize:]
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	if start == 0 {
+		return fmt.Errorf("headers have a different genesis block: %w", ErrUnknownParent)
+	}
+	if start < len(c.best) && start <= c.params.lastCheckpoint() {
+		return fmt.Errorf("headers fork at %d, below the checkpoint at %d: %w", start, c.params.lastCheckpoint(), ErrCheckpoint)
+	}
+
+	branch := make([]entry, 0, len(headers)/electrum.HeaderSize)
+	ancestor := func(height int) *electrum.BlockHeader {
+		if height >= start {
+			return branch[height-start].header
+		}
+		return c.best[height].header
+	}
+	for i := 0; i < cap(branch); i++ {
+		height := start + i
+		raw := append([]byte(nil), headers[i*electrum.HeaderSize:(i+1)*electrum.HeaderSize]...)
+		h, err := electrum.ParseBlockHeaderBytes(raw)
+		if err != nil {
+			return err
+		}
+		if parent := ancestor(height - 1); h.PrevBlock != parent.Hash {
+			if i == 0 {
+				return fmt.Errorf("header %s at height %d does not follow block %s: %w", h.Hash, height, parent.Hash, ErrUnknownParent)
+			}
+			return &HeaderError{Height: height, Hash: h.Hash, Err: fmt.Errorf("does not follow block %s", parent.Hash)}
+		}
+		if err := c.validate(h, height, ancestor); err != nil {
+			return &HeaderError{Height: height, Hash: h.Hash, Err: err}
+		}
+		parentWork := c.best[start-1].work
+		if i > 0 {
+			parentWork = branch[i-1].work
+		}
+		branch = append(branch, entry{header: h, raw: raw, work: new(big.Int).Add(parentWork, h.Work())})
+	}
+
+	if start < len(c.best) {
+		tip := c.best[len(c.best)-1]
+		if branch[len(branch)-1].work.Cmp(tip.work) <= 0 {
+			return fmt.Errorf("branch from height %d to %d: %w", start, start+len(branch)-1, ErrInsufficientWork)
+		}
+		log.Printf("chain reorganized: %d blocks from height %d replaced, new tip %s at %d\n",
+			len(c.best)-start, start, branch[len(branch)-1].header.Hash, start+len(branch)-1)
+	}
+	c.best = append(c.best[:start], branch...)
+	return nil
+}
+
+// validate checks a header, whose parent is already known to be the block below it, against the consensus rules.
+// ancestor returns the header at a lower height on the header's branch.
+func (c *Chain) validate(h *electrum.BlockHeader, height int, ancestor func(int) *electrum.BlockHeader) error {
+	if hash, ok := c.params.checkpoint(height); ok && h.Hash != hash {
+		return fmt.Errorf("block is not the checkpoint %s: %w", hash, ErrCheckpoint)
+	}
+	if err := c.params.CheckProofOfWork(h); err != nil {
+		return err
+	}
+	if want := c.nextBits(h, height, ancestor); h.Bits != want {
+		return fmt.Errorf("target bits are %08x, want %08x", h.Bits, want)
+	}
+	if mtp := medianTimePast(height, ancestor); h.Timestamp <= mtp {
+		return fmt.Errorf("timestamp %d is not after the median time %d of the previous blocks", h.Timestamp, mtp)
+	}
+	return nil
+}
+
+// nextBits returns the target bits the header at height must have. The target changes every RetargetInterval blocks,
+// in proportion to how long the last interval took, by no more than a factor of four.
+func (c *Chain) nextBits(h *electrum.BlockHeader, height int, ancestor func(int) *electrum.BlockHeader) uint32 {
+	p := c.params
+	parent := ancestor(height - 1)
+	interval := p.RetargetInterval()
+	if height%interval != 0 {
+		if !p.AllowMinDifficultyBlocks {
+			return parent.Bits
+		}
+		limit := p.PowLimitBits()
+		if int64(h.Timestamp) > int64(parent.Timestamp)+2*p.TargetSpacing {
+			return limit
+		}
+		// Otherwise the target is that of the last block that wasn't a minimum difficulty exception.
+		i := height - 1
+		for i > 0 && i%interval != 0 && ancestor(i).Bits == limit {
+			i--
+		}
+		return ancestor(i).Bits
+	}
+	if p.NoRetargeting {
+		return parent.Bits
+	}
+
+	timespan := int64(parent.Timestamp) - int64(ancestor(height-interval).Timestamp)
+	if timespan < p.TargetTimespan/4 {
+		timespan = p.TargetTimespan / 4
+	}
+	if timespan > p.TargetTimespan*4 {
+		timespan = p.TargetTimespan * 4
+	}
+	target := new(big.Int).Mul(parent.Target(), big.NewInt(timespan))
+	target.Div(target, big.NewInt(p.TargetTimespan))
+	if target.Cmp(p.PowLimit) > 0 {
+		target = p.PowLimit
+	}
+	return electrum.BigToCompact(target)
+}
+
+// medianTimeBlocks is how many blocks the median time past is taken over.
+const medianTimeBlocks = 11
+
+// medianTimePast returns the median timestamp of the blocks below height, which the block at height must be later
+// than.
+func medianTimePast(height int, ancestor func(int) *electrum.BlockHeader) uint32 {
+	var times []uint32
+	for i := height - 1; i >= 0 && len(times) < medianTimeBlocks; i-- {
+		times = append(times, ancestor(i).Timestamp)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
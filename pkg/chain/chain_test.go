@@ -0,0 +1,376 @@
+package chain
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+const regtestBits = 0x207fffff
+
+// mine returns a serialized header on top of prev with a nonce that meets its target. tag sets the merkle root, so that
+// branches can be told apart.
+func mine(t *testing.T, prev []byte, tag byte, timestamp, bits uint32) []byte {
+	t.Helper()
+	b := make([]byte, electrum.HeaderSize)
+	binary.LittleEndian.PutUint32(b[0:4], 0x20000000)
+	copy(b[4:36], electrum.DoubleSHA256(prev))
+	b[36] = tag
+	binary.LittleEndian.PutUint32(b[68:72], timestamp)
+	binary.LittleEndian.PutUint32(b[72:76], bits)
+	for nonce := uint32(0); ; nonce++ {
+		binary.LittleEndian.PutUint32(b[76:80], nonce)
+		h, err := electrum.ParseBlockHeaderBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.CheckProofOfWork() == nil {
+			return b
+		}
+	}
+}
+
+// branch mines n regtest headers on top of prev, ten minutes apart, and returns them concatenated.
+func branch(t *testing.T, prev []byte, tag byte, n int) []byte {
+	t.Helper()
+	var out []byte
+	for i := 0; i < n; i++ {
+		timestamp := binary.LittleEndian.Uint32(prev[68:72]) + 600
+		prev = mine(t, prev, tag, timestamp, regtestBits)
+		out = append(out, prev...)
+	}
+	return out
+}
+
+// header returns the i'th header of concatenated headers.
+func header(headers []byte, i int) []byte {
+	return headers[i*electrum.HeaderSize : (i+1)*electrum.HeaderSize]
+}
+
+func regtestGenesis(t *testing.T) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(RegTestParams.Genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newRegtest(t *testing.T, params *Params) *Chain {
+	t.Helper()
+	c, err := New(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestNew(t *testing.T) {
+	for _, params := range []*Params{&MainNetParams, &TestNetParams, &SigNetParams, &RegTestParams} {
+		t.Run(params.Name, func(t *testing.T) {
+			c, err := New(params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			height, tip := c.Tip()
+			if height != 0 || tip.Hash != params.GenesisHash {
+				t.Errorf("Tip() = %d, %s, want 0, %s", height, tip.Hash, params.GenesisHash)
+			}
+			if err := tip.CheckProofOfWork(); err != nil {
+				t.Error(err)
+			}
+			if tip.Bits != params.PowLimitBits() {
+				t.Errorf("genesis bits = %08x, want the limit %08x", tip.Bits, params.PowLimitBits())
+			}
+		})
+	}
+
+	bad := RegTestParams
+	bad.GenesisHash = MainNetParams.GenesisHash
+	if _, err := New(&bad); err == nil {
+		t.Error("New() with the wrong genesis hash succeeded")
+	}
+}
+
+func TestChain_Connect(t *testing.T) {
+	genesis := regtestGenesis(t)
+	good := branch(t, genesis, 1, 3)
+	last := header(good, 2)
+	next := func(timestamp, bits uint32) []byte {
+		return mine(t, last, 1, timestamp, bits)
+	}
+	lastTime := binary.LittleEndian.Uint32(last[68:72])
+
+	unmined := append([]byte(nil), next(lastTime+600, regtestBits)...)
+	for {
+		h, _ := electrum.ParseBlockHeaderBytes(unmined)
+		if h.CheckProofOfWork() != nil {
+			break
+		}
+		unmined[76]++
+	}
+	unlinked := append(append([]byte(nil), good[:2*electrum.HeaderSize]...), mine(t, genesis, 1, lastTime, regtestBits)...)
+
+	checkpointed := RegTestParams
+	checkpointed.Checkpoints = []Checkpoint{{Height: 2, Hash: "00" + electrum.HashToString(make([]byte, 31))}}
+
+	tests := []struct {
+		name       string
+		params     *Params
+		start      int
+		headers    []byte
+		wantHeight int
+		wantErr    error
+	}{
+		{"extends the tip", &RegTestParams, 1, good, 3, nil},
+		{"skips known headers", &RegTestParams, 0, append(append([]byte(nil), genesis...), good...), 3, nil},
+		{"starts above the tip", &RegTestParams, 2, good[electrum.HeaderSize:], 0, ErrUnknownParent},
+		{"different genesis", &RegTestParams, 0, good, 0, ErrUnknownParent},
+		{"does not follow the previous header", &RegTestParams, 1, unlinked, 0, &HeaderError{}},
+		{"partial header", &RegTestParams, 1, good[:100], 0, errors.New("")},
+		{"conflicts with a checkpoint", &checkpointed, 1, good, 0, ErrCheckpoint},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newRegtest(t, tt.params)
+			err := c.Connect(tt.start, tt.headers)
+			if !matchErr(err, tt.wantErr) {
+				t.Fatalf("Connect() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := c.Height(); got != tt.wantHeight {
+				t.Errorf("Height() = %d, want %d", got, tt.wantHeight)
+			}
+		})
+	}
+
+	invalid := []struct {
+		name   string
+		header []byte
+	}{
+		{"insufficient proof of work", unmined},
+		{"wrong target bits", next(lastTime+600, 0x203fffff)},
+		{"timestamp not after the median time past", next(lastTime-1200, regtestBits)},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newRegtest(t, &RegTestParams)
+			if err := c.Connect(1, good); err != nil {
+				t.Fatal(err)
+			}
+			err := c.Connect(4, tt.header)
+			var he *HeaderError
+			if !errors.As(err, &he) || he.Height != 4 {
+				t.Fatalf("Connect() error = %v, want a *HeaderError at height 4", err)
+			}
+			if got := c.Height(); got != 3 {
+				t.Errorf("Height() = %d, want 3", got)
+			}
+		})
+	}
+}
+
+// matchErr reports whether err is want: nil for nil, the same type for *HeaderError, any error for an unwrappable
+// errors.New(""), and otherwise as by errors.Is.
+func matchErr(err, want error) bool {
+	switch want.(type) {
+	case nil:
+		return err == nil
+	case *HeaderError:
+		var he *HeaderError
+		return errors.As(err, &he)
+	}
+	if want.Error() == "" {
+		return err != nil
+	}
+	return errors.Is(err, want)
+}
+
+func TestChain_Reorg(t *testing.T) {
+	genesis := regtestGenesis(t)
+	main := branch(t, genesis, 1, 3)
+	longer := branch(t, header(main, 0), 2, 3)
+	shorter := branch(t, header(main, 0), 3, 2)
+
+	checkpointed := RegTestParams
+	checkpointed.Checkpoints = []Checkpoint{{Height: 1, Hash: electrum.HashToString(electrum.DoubleSHA256(header(main, 0)))}}
+	deepCheckpoint := RegTestParams
+	deepCheckpoint.Checkpoints = []Checkpoint{{Height: 2, Hash: electrum.HashToString(electrum.DoubleSHA256(header(main, 1)))}}
+
+	tests := []struct {
+		name    string
+		params  *Params
+		fork    []byte
+		wantErr error
+		wantTip []byte
+	}{
+		{"branch with more work replaces the chain", &RegTestParams, longer, nil, header(longer, 2)},
+		{"branch with less work is rejected", &RegTestParams, shorter, ErrInsufficientWork, header(main, 2)},
+		{"branch with equal work is rejected", &RegTestParams, longer[:2*electrum.HeaderSize], ErrInsufficientWork, header(main, 2)},
+		{"fork above a checkpoint", &checkpointed, longer, nil, header(longer, 2)},
+		{"fork below a checkpoint", &deepCheckpoint, longer, ErrCheckpoint, header(main, 2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newRegtest(t, tt.params)
+			if err := c.Connect(1, main); err != nil {
+				t.Fatal(err)
+			}
+			work := c.Work()
+			err := c.Connect(2, tt.fork)
+			if !matchErr(err, tt.wantErr) {
+				t.Fatalf("Connect() error = %v, want %v", err, tt.wantErr)
+			}
+			_, tip := c.Tip()
+			if want := electrum.HashToString(electrum.DoubleSHA256(tt.wantTip)); tip.Hash != want {
+				t.Errorf("tip = %s, want %s", tip.Hash, want)
+			}
+			if tt.wantErr == nil && c.Work().Cmp(work) <= 0 {
+				t.Errorf("Work() = %s, want more than %s", c.Work(), work)
+			}
+			if h, _ := c.Header(1); h.Hash != electrum.HashToString(electrum.DoubleSHA256(header(main, 0))) {
+				t.Errorf("block below the fork changed to %s", h.Hash)
+			}
+		})
+	}
+}
+
+func TestChain_Retarget(t *testing.T) {
+	// Four block difficulty periods, so that retargets can be tested without mining thousands of headers.
+	params := RegTestParams
+	params.TargetTimespan = 40
+	params.TargetSpacing = 10
+	params.NoRetargeting = false
+	params.AllowMinDifficultyBlocks = false
+	minDifficulty := params
+	minDifficulty.AllowMinDifficultyBlocks = true
+
+	genesis := regtestGenesis(t)
+	// Builds three blocks after genesis at the given spacing, the last of the first period.
+	period := func(spacing uint32) []byte {
+		var out []byte
+		prev := genesis
+		for i := 0; i < 3; i++ {
+			prev = mine(t, prev, 1, binary.LittleEndian.Uint32(prev[68:72])+spacing, regtestBits)
+			out = append(out, prev...)
+		}
+		return out
+	}
+	fast, slow := period(1), period(100)
+	fastTime := binary.LittleEndian.Uint32(fast[2*electrum.HeaderSize+68:])
+
+	tests := []struct {
+		name   string
+		params *Params
+		first  []byte
+		bits   []uint32
+		times  []uint32
+		valid  bool
+	}{
+		// Blocks four times too fast are clamped to quartering the target.
+		{"target quartered", &params, fast, []uint32{0x201fffff}, []uint32{fastTime + 1}, true},
+		{"target not retargeted", &params, fast, []uint32{regtestBits}, []uint32{fastTime + 1}, false},
+		// Slow blocks can't raise the target above the limit.
+		{"target capped at the limit", &params, slow, []uint32{regtestBits}, nil, true},
+		{"target kept within a period", &params, fast, []uint32{0x201fffff, 0x201fffff}, []uint32{fastTime + 1, fastTime + 2}, true},
+		{"target changed within a period", &params, fast, []uint32{0x201fffff, regtestBits}, []uint32{fastTime + 1, fastTime + 100}, false},
+		// With minimum difficulty blocks, a block more than twice the spacing late may have the easiest target, and
+		// the next goes back to the period's.
+		{"minimum difficulty block", &minDifficulty, fast, []uint32{0x201fffff, regtestBits, 0x201fffff}, []uint32{fastTime + 1, fastTime + 30, fastTime + 31}, true},
+		{"minimum difficulty block too early", &minDifficulty, fast, []uint32{0x201fffff, regtestBits}, []uint32{fastTime + 1, fastTime + 20}, false},
+		{"target left at the minimum", &minDifficulty, fast, []uint32{0x201fffff, regtestBits, regtestBits}, []uint32{fastTime + 1, fastTime + 30, fastTime + 31}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newRegtest(t, tt.params)
+			if err := c.Connect(1, tt.first); err != nil {
+				t.Fatal(err)
+			}
+			prev := header(tt.first, 2)
+			var err error
+			for i, bits := range tt.bits {
+				timestamp := binary.LittleEndian.Uint32(prev[68:72]) + 600
+				if tt.times != nil {
+					timestamp = tt.times[i]
+				}
+				prev = mine(t, prev, 1, timestamp, bits)
+				if err = c.Connect(4+i, prev); err != nil {
+					break
+				}
+			}
+			if (err == nil) != tt.valid {
+				t.Errorf("Connect() error = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+// chainSource serves headers from a chain.
+type chainSource struct {
+	c *Chain
+}
+
+func (s chainSource) Headers(ctx context.Context, start, count int) ([]byte, error) {
+	return s.c.RawHeaders(start, count), nil
+}
+
+func TestChain_Sync(t *testing.T) {
+	genesis := regtestGenesis(t)
+	upstream := newRegtest(t, &RegTestParams)
+	// More than a chunk, so that it takes several requests.
+	headers := branch(t, genesis, 1, MaxChunk+10)
+	if err := upstream.Connect(1, headers); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newRegtest(t, &RegTestParams)
+	if err := c.Sync(context.Background(), chainSource{upstream}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Height(), MaxChunk+10; got != want {
+		t.Fatalf("Height() = %d, want %d", got, want)
+	}
+
+	// The upstream chain reorganizes five blocks deep; syncing has to step back to find the fork.
+	forkAt := MaxChunk + 5
+	fork := branch(t, header(headers, forkAt-2), 2, 8)
+	if err := upstream.Connect(forkAt, fork); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sync(context.Background(), chainSource{upstream}); err != nil {
+		t.Fatal(err)
+	}
+	_, tip := c.Tip()
+	_, want := upstream.Tip()
+	if tip.Hash != want.Hash {
+		t.Errorf("tip after reorg = %s, want %s", tip.Hash, want.Hash)
+	}
+
+	// A source on another network never connects.
+	other := newRegtest(t, &RegTestParams)
+	if err := other.Connect(1, branch(t, genesis, 3, 3)); err != nil {
+		t.Fatal(err)
+	}
+	signet := newRegtest(t, &SigNetParams)
+	if err := signet.Sync(context.Background(), chainSource{other}); !errors.Is(err, ErrUnknownParent) {
+		t.Errorf("Sync() from another network error = %v, want %v", err, ErrUnknownParent)
+	}
+}
+
+func TestNetworkParams(t *testing.T) {
+	for _, n := range electrum.Networks {
+		params, err := NetworkParams(n.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params.GenesisHash != n.GenesisHash {
+			t.Errorf("%s genesis = %s, want %s", n.Name, params.GenesisHash, n.GenesisHash)
+		}
+	}
+	if _, err := NetworkParams("litecoin"); err == nil {
+		t.Error("NetworkParams(\"litecoin\") succeeded")
+	}
+}
@@ -0,0 +1,149 @@
+package chain
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// Params are the consensus rules of a network that block headers are validated against.
+type Params struct {
+	Name string
+	// Genesis is the hex encoded genesis block header, and GenesisHash its hash.
+	Genesis     string
+	GenesisHash string
+	// PowLimit is the easiest target a block may have.
+	PowLimit *big.Int
+	// TargetTimespan is how long, in seconds, each difficulty period should take, and TargetSpacing each block. Their
+	// ratio is the number of blocks between retargets.
+	TargetTimespan int64
+	TargetSpacing  int64
+	// AllowMinDifficultyBlocks allows a block more than twice TargetSpacing after its parent to have the easiest
+	// target, as on testnet.
+	AllowMinDifficultyBlocks bool
+	// NoRetargeting keeps the target fixed, as on regtest.
+	NoRetargeting bool
+	// Checkpoints are blocks the chain must include. Headers conflicting with them are rejected, and the chain is never
+	// reorganized below the highest.
+	Checkpoints []Checkpoint
+}
+
+// Checkpoint is the hash of the block at a height.
+type Checkpoint struct {
+	Height int
+	Hash   string
+}
+
+// RetargetInterval returns the number of blocks in each difficulty period.
+func (p *Params) RetargetInterval() int {
+	return int(p.TargetTimespan / p.TargetSpacing)
+}
+
+// PowLimitBits returns PowLimit in compact form.
+func (p *Params) PowLimitBits() uint32 {
+	return electrum.BigToCompact(p.PowLimit)
+}
+
+// CheckProofOfWork checks that a header's hash meets the target its bits claim, and that the target is no easier than
+// PowLimit. It doesn't check that the target is the right one for the header's place in the chain.
+func (p *Params) CheckProofOfWork(h *electrum.BlockHeader) error {
+	if err := h.CheckProofOfWork(); err != nil {
+		return err
+	}
+	if h.Target().Cmp(p.PowLimit) > 0 {
+		return fmt.Errorf("block %s has target bits %08x, easier than %s allows", h.Hash, h.Bits, p.Name)
+	}
+	return nil
+}
+
+// checkpoint returns the hash the block at height must have, if it is checkpointed.
+func (p *Params) checkpoint(height int) (string, bool) {
+	for _, c := range p.Checkpoints {
+		if c.Height == height {
+			return c.Hash, true
+		}
+	}
+	return "", false
+}
+
+// lastCheckpoint returns the height of the highest checkpoint, or 0 if there are none.
+func (p *Params) lastCheckpoint() int {
+	last := 0
+	for _, c := range p.Checkpoints {
+		if c.Height > last {
+			last = c.Height
+		}
+	}
+	return last
+}
+
+const (
+	twoWeeks    = 14 * 24 * 60 * 60
+	tenMinutes  = 10 * 60
+	genesisRest = "0000000000000000000000000000000000000000000000000000000000000000" +
+		"3ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a"
+)
+
+// MainNetParams are the consensus rules of the Bitcoin main network.
+var MainNetParams = Params{
+	Name:           "mainnet",
+	Genesis:        "01000000" + genesisRest + "29ab5f49ffff001d1dac2b7c",
+	GenesisHash:    "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f",
+	PowLimit:       hexBig("00000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff"),
+	TargetTimespan: twoWeeks,
+	TargetSpacing:  tenMinutes,
+}
+
+// TestNetParams are the consensus rules of the Bitcoin test network, testnet3.
+var TestNetParams = Params{
+	Name:                     "testnet",
+	Genesis:                  "01000000" + genesisRest + "dae5494dffff001d1aa4ae18",
+	GenesisHash:              "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943",
+	PowLimit:                 hexBig("00000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff"),
+	TargetTimespan:           twoWeeks,
+	TargetSpacing:            tenMinutes,
+	AllowMinDifficultyBlocks: true,
+}
+
+// SigNetParams are the consensus rules of the default signet. Block signatures are in the coinbase transaction, so
+// they can't be checked from headers alone.
+var SigNetParams = Params{
+	Name:           "signet",
+	Genesis:        "01000000" + genesisRest + "008f4d5fae77031e8ad22203",
+	GenesisHash:    "00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6",
+	PowLimit:       hexBig("00000377ae000000000000000000000000000000000000000000000000000000"),
+	TargetTimespan: twoWeeks,
+	TargetSpacing:  tenMinutes,
+}
+
+// RegTestParams are the consensus rules of a regression test network.
+var RegTestParams = Params{
+	Name:                     "regtest",
+	Genesis:                  "01000000" + genesisRest + "dae5494dffff7f2002000000",
+	GenesisHash:              "0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206",
+	PowLimit:                 hexBig("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"),
+	TargetTimespan:           twoWeeks,
+	TargetSpacing:            tenMinutes,
+	AllowMinDifficultyBlocks: true,
+	NoRetargeting:            true,
+}
+
+func hexBig(s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("invalid hex number " + s)
+	}
+	return n
+}
+
+// NetworkParams returns the consensus rules of the network with the given name, which are the names of electrum's
+// Networks.
+func NetworkParams(name string) (*Params, error) {
+	for _, p := range []*Params{&MainNetParams, &TestNetParams, &SigNetParams, &RegTestParams} {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("no consensus rules for network %q", name)
+}
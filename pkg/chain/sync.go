@@ -0,0 +1,70 @@
+package chain
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// MaxChunk is the most headers blockchain.block.headers returns at once.
+const MaxChunk = 2016
+
+// Source fetches serialized headers, concatenated, as blockchain.block.headers does. It may return fewer than count
+// headers, and none, if its chain ends first.
+type Source interface {
+	Headers(ctx context.Context, start, count int) ([]byte, error)
+}
+
+// NodeSource fetches headers from an Electrum server.
+type NodeSource struct {
+	Client *electrum.Client
+	Node   *electrum.Node
+}
+
+// Headers implements Source with blockchain.block.headers.
+func (s NodeSource) Headers(ctx context.Context, start, count int) ([]byte, error) {
+	res, err := s.Client.GetBlockHeaders(ctx, s.Node, start, count)
+	if err != nil {
+		return nil, err
+	}
+	b, err := hex.DecodeString(res.Hex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid headers hex: %v", err)
+	}
+	if len(b) != res.Count*electrum.HeaderSize {
+		return nil, fmt.Errorf("%s returned %d bytes of headers for a count of %d", s.Node.Host, len(b), res.Count)
+	}
+	return b, nil
+}
+
+// Sync fetches the headers above the tip from src, in chunks, until it has no more. If src's headers don't connect to
+// the tip, because src is on a different branch, Sync steps back, twice as far each time, until they do; the branch
+// then replaces the chain if it has more work.
+func (c *Chain) Sync(ctx context.Context, src Source) error {
+	back := 0
+	for {
+		start := c.Height() + 1 - back
+		if start < 1 {
+			start = 1
+		}
+		headers, err := src.Headers(ctx, start, MaxChunk)
+		if err != nil {
+			return err
+		}
+		err = c.Connect(start, headers)
+		if errors.Is(err, ErrUnknownParent) && start > 1 {
+			back = back*2 + 1
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(headers) < MaxChunk*electrum.HeaderSize {
+			return nil
+		}
+		back = 0
+	}
+}
@@ -1,153 +1,405 @@
 package electrum
 
 import (
-	"bufio"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 )
 
 // Client handles connecting, sending requests, and the logging thereof to Electrum servers.
+// Connections are drawn from a pool and shared by concurrent requests.
 type Client struct {
 	InfoLogger    *log.Logger
 	WarningLogger *log.Logger
 	ErrorLogger   *log.Logger
+	PoolConfig    *PoolConfig
+	// ClearnetDialer opens connections to nodes that aren't onions, for TCP and TLS alike. Connections are direct if
+	// it is nil.
+	ClearnetDialer Dialer
+	// OnionDialer connects to .onion nodes, typically through a Tor daemon. Onion nodes can't be reached without it.
+	OnionDialer Dialer
+	// Transport selects which transports nodes are connected over. The zero value prefers TLS and falls back to TCP.
+	Transport TransportPolicy
+	// TLSPolicy is how node certificates are verified, unless overridden for the node in NodeTLSPolicies. The zero
+	// value trusts certificates on first use.
+	TLSPolicy TLSPolicy
+	// NodeTLSPolicies overrides TLSPolicy for nodes by host name.
+	NodeTLSPolicies map[string]TLSPolicy
+	// FingerprintStore records certificates trusted on first use. They are kept in memory if it is nil.
+	FingerprintStore FingerprintStore
+	// ClientName, ProtocolMin and ProtocolMax are sent in the server.version handshake each connection starts with.
+	// Servers that negotiate a version below ProtocolMin are refused. The Default values are used for any left empty.
+	ClientName  string
+	ProtocolMin string
+	ProtocolMax string
+	// KeepAlive controls the pings sent on idle connections. DefaultKeepAliveConfig is used if it is nil.
+	KeepAlive *KeepAliveConfig
+	// ConnStateHandler, if set, is called whenever a connection to a node is established, misses a keepalive ping,
+	// closes or fails to be established. It is called synchronously and must not block.
+	ConnStateHandler func(ConnStateChange)
+	// Network is the network the client's servers serve. MainNet is assumed if it is nil.
+	Network *Network
+
+	tofuMutex sync.Mutex
+
+	poolOnce sync.Once
+	pool     *Pool
+
+	subscriberMutex sync.Mutex
+	subscribers     map[string]*subscriber
+
+	versionMutex sync.Mutex
+	versions     map[string]*ServerVersion
 }
 
-// NewClient creates a new electrum client.
-func NewClient(infoLogger *log.Logger, warningLogger *log.Logger, errorLogger *log.Logger) *Client {
-	return &Client{InfoLogger: infoLogger, WarningLogger: warningLogger, ErrorLogger: errorLogger}
+// ClientOption configures optional behaviour of a Client.
+type ClientOption func(*Client)
+
+// WithPoolConfig sets the limits of the client's connection pool. DefaultPoolConfig is used otherwise.
+func WithPoolConfig(config PoolConfig) ClientOption {
+	return func(c *Client) {
+		c.PoolConfig = &config
+	}
 }
 
-// Connect tries to connect to a node in the following order: Tor, TLS, TCP.
-func (c *Client) Connect(n *Node, timeout time.Duration) (net.Conn, error) {
-	if n.IsOnion() {
-		c.ErrorLogger.Printf("failed to connect to %s: tor support not yet implemented\n", n.Host)
-		return nil, errors.New("to support not yet implemented")
+// WithDialer opens connections to clearnet nodes with d, e.g. to send them through a proxy.
+func WithDialer(d Dialer) ClientOption {
+	return func(c *Client) {
+		c.ClearnetDialer = d
 	}
-	if n.SupportsTLS() {
-		c.InfoLogger.Printf("%s supports TLS, attempting TLS connection\n", n.Host)
-		conn, err := c.GetTLSConn(n, timeout)
-		if err != nil {
-			c.ErrorLogger.Printf("error establishing TLS connection to: %s\n", n.Host)
-			connErr := conn.Close()
-			if connErr != nil {
-				c.ErrorLogger.Printf("could not close connection to: %s after failed TLS connection attempt: %v\n", n.Host, connErr)
-			}
-			return nil, err
+}
+
+// WithOnionDialer opens connections to .onion nodes with d.
+func WithOnionDialer(d Dialer) ClientOption {
+	return func(c *Client) {
+		c.OnionDialer = d
+	}
+}
+
+// WithTLSPolicy sets how node certificates are verified.
+func WithTLSPolicy(p TLSPolicy) ClientOption {
+	return func(c *Client) {
+		c.TLSPolicy = p
+	}
+}
+
+// WithNodeTLSPolicy sets how the certificate of the node with the given host name is verified, overriding the
+// client's TLSPolicy.
+func WithNodeTLSPolicy(host string, p TLSPolicy) ClientOption {
+	return func(c *Client) {
+		if c.NodeTLSPolicies == nil {
+			c.NodeTLSPolicies = make(map[string]TLSPolicy)
 		}
-		return conn, nil
+		c.NodeTLSPolicies[host] = p
+	}
+}
+
+// WithFingerprintStore persists certificates trusted on first use in s.
+func WithFingerprintStore(s FingerprintStore) ClientOption {
+	return func(c *Client) {
+		c.FingerprintStore = s
+	}
+}
+
+// WithTransportPolicy sets which transports nodes are connected over.
+func WithTransportPolicy(p TransportPolicy) ClientOption {
+	return func(c *Client) {
+		c.Transport = p
+	}
+}
+
+// WithProtocolVersions sets the range of protocol versions negotiated with servers. Servers that can't speak at least
+// protocolMin are refused.
+func WithProtocolVersions(protocolMin, protocolMax string) ClientOption {
+	return func(c *Client) {
+		c.ProtocolMin = protocolMin
+		c.ProtocolMax = protocolMax
+	}
+}
+
+// WithClientName sets the client name sent to servers in the server.version handshake.
+func WithClientName(name string) ClientOption {
+	return func(c *Client) {
+		c.ClientName = name
 	}
-	conn, err := c.GetConn(n, timeout)
-	c.InfoLogger.Printf("%s supports TCP, attempting TCP connection\n", n.Host)
+}
+
+// WithKeepAlive sets how idle connections are kept alive and checked.
+func WithKeepAlive(config KeepAliveConfig) ClientOption {
+	return func(c *Client) {
+		c.KeepAlive = &config
+	}
+}
+
+// WithConnStateHandler calls h whenever the state of a connection to a node changes.
+func WithConnStateHandler(h func(ConnStateChange)) ClientOption {
+	return func(c *Client) {
+		c.ConnStateHandler = h
+	}
+}
+
+// WithTorProxy routes connections to .onion nodes through the SOCKS5 proxy d, typically a local Tor daemon.
+func WithTorProxy(d *SOCKS5Dialer) ClientOption {
+	return WithOnionDialer(d)
+}
+
+// ErrTorNotConfigured is returned when connecting to an onion node without an OnionDialer.
+var ErrTorNotConfigured = errors.New("tor support not configured")
+
+// NewClient creates a new electrum client.
+func NewClient(infoLogger *log.Logger, warningLogger *log.Logger, errorLogger *log.Logger, opts ...ClientOption) *Client {
+	c := &Client{InfoLogger: infoLogger, WarningLogger: warningLogger, ErrorLogger: errorLogger}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Pool returns the client's connection pool, creating it on first use.
+func (c *Client) Pool() *Pool {
+	c.poolOnce.Do(func() {
+		config := DefaultPoolConfig
+		if c.PoolConfig != nil {
+			config = *c.PoolConfig
+		}
+		c.pool = NewPool(config, c.OpenSession)
+	})
+	return c.pool
+}
+
+// PoolStats returns a snapshot of the client's connection pool.
+func (c *Client) PoolStats() PoolStats {
+	return c.Pool().Stats()
+}
+
+// SupportsOnions reports whether the client can connect to .onion nodes.
+func (c *Client) SupportsOnions() bool {
+	return c.OnionDialer != nil
+}
+
+// Connect returns an open session to a node from the client's pool, dialing a new connection if the pool has none to
+// spare.
+func (c *Client) Connect(n *Node, timeout time.Duration) (*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.ConnectContext(ctx, n)
+}
+
+// ConnectContext is like Connect, but gives up when ctx is done.
+func (c *Client) ConnectContext(ctx context.Context, n *Node) (*Session, error) {
+	s, err := c.Pool().Acquire(ctx, n)
 	if err != nil {
-		c.ErrorLogger.Printf("error establishing TLS connection to: %s\n: %v", n.Host, err)
-		connErr := conn.Close()
-		if connErr != nil {
-			c.ErrorLogger.Printf("could not close connection to: %s after failed TCP connection attempt: %v\n", n.Host, connErr)
+		return nil, fmt.Errorf("could not connect to %s: %w", n.Host, err)
+	}
+	return s, nil
+}
+
+// Dial opens a new connection to a node over the transports allowed by the client's Transport policy, trying TLS
+// before TCP. If every attempt fails the error is a *ConnectError listing them. The connection is not pooled.
+func (c *Client) Dial(n *Node, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.DialContext(ctx, n)
+}
+
+// DialContext is like Dial, but gives up when ctx is done.
+func (c *Client) DialContext(ctx context.Context, n *Node) (net.Conn, error) {
+	if (n.IsOnion() || c.Transport == TransportTorOnly) && !c.SupportsOnions() {
+		c.ErrorLogger.Printf("failed to connect to %s: %v\n", n.Host, ErrTorNotConfigured)
+		return nil, ErrTorNotConfigured
+	}
+	connErr := &ConnectError{Host: n.Host, Policy: c.Transport}
+	for _, transport := range c.transports(n) {
+		var conn net.Conn
+		var err error
+		c.InfoLogger.Printf("attempting %s connection to %s\n", transport, n.Host)
+		if transport == TransportTLS {
+			conn, err = c.GetTLSConnContext(ctx, n)
+		} else {
+			conn, err = c.GetConnContext(ctx, n)
+		}
+		if err == nil {
+			return conn, nil
+		}
+		connErr.Attempts = append(connErr.Attempts, TransportAttempt{Transport: transport, Err: err})
+		if ctx.Err() != nil || certificateRejected(err) {
+			break
 		}
-		return nil, err
 	}
-	return conn, nil
+	c.ErrorLogger.Printf("%v\n", connErr)
+	return nil, connErr
 }
 
 // GetTLSConn establishes a TLS connection to a given node.
 func (c *Client) GetTLSConn(n *Node, timeout time.Duration) (*tls.Conn, error) {
-	if n.IsOnion() {
-		c.ErrorLogger.Printf("failed to connect to %s: tor support not yet implemented\n", n.Host)
-		return nil, errors.New("tor support not yet implemented")
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.GetTLSConnContext(ctx, n)
+}
+
+// GetTLSConnContext is like GetTLSConn, but gives up when ctx is done.
+func (c *Client) GetTLSConnContext(ctx context.Context, n *Node) (*tls.Conn, error) {
 	if !n.SupportsTLS() {
 		c.ErrorLogger.Printf("%s does not support TLS, not attempting to connect\n", n.Host)
 		return nil, errors.New("node does not support SSL/TLS")
 	}
-	conf := &tls.Config{
-		InsecureSkipVerify: true,
-	}
-	dialer := &net.Dialer{
-		Timeout: timeout,
-	}
-	connStr := fmt.Sprintf("%s:%d", n.Host, n.SSLPort)
-	conn, err := tls.DialWithDialer(dialer, "tcp", connStr, conf)
+	connStr := net.JoinHostPort(n.Host, strconv.Itoa(n.SSLPort))
+	raw, err := c.dial(ctx, n, connStr)
 	if err != nil {
 		c.ErrorLogger.Printf("error establishing TLS connection to: %s\n: %v", connStr, err)
 		return nil, fmt.Errorf("could not establish TLS connection to %s: %v", connStr, err)
 	}
+	config, err := c.tlsConfig(n, connStr)
+	if err != nil {
+		_ = raw.Close()
+		return nil, err
+	}
+	conn := tls.Client(raw, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		_ = raw.Close()
+		c.ErrorLogger.Printf("error establishing TLS connection to: %s\n: %v", connStr, err)
+		return nil, fmt.Errorf("could not establish TLS connection to %s: %w", connStr, err)
+	}
 	c.InfoLogger.Printf("successfully established TLS connection to %s\n", connStr)
 	return conn, nil
 }
 
 // GetConn establishes a TCP connection to a given node.
 func (c *Client) GetConn(n *Node, timeout time.Duration) (net.Conn, error) {
-	if n.IsOnion() {
-		c.ErrorLogger.Printf("failed to connect to %s: tor support not yet implemented\n", n.Host)
-		return nil, errors.New("tor support not yet implemented")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.GetConnContext(ctx, n)
+}
+
+// GetConnContext is like GetConn, but gives up when ctx is done.
+func (c *Client) GetConnContext(ctx context.Context, n *Node) (net.Conn, error) {
+	if n.TCPPort <= 0 {
+		c.ErrorLogger.Printf("%s does not support TCP, not attempting to connect\n", n.Host)
+		return nil, errors.New("node does not support TCP")
 	}
-	connStr := fmt.Sprintf("%s:%d", n.Host, n.TCPPort)
+	connStr := net.JoinHostPort(n.Host, strconv.Itoa(n.TCPPort))
 	c.InfoLogger.Printf("establishing TCP connection to %s\n", connStr)
-	conn, err := net.DialTimeout("tcp", connStr, timeout)
+	conn, err := c.dial(ctx, n, connStr)
 	if err != nil {
-		c.ErrorLogger.Printf("could not establish TLS connection to %s: %v\n", connStr, err)
-		return nil, fmt.Errorf("could not establish TLS connection to %s: %v", connStr, err)
+		c.ErrorLogger.Printf("could not establish TCP connection to %s: %v\n", connStr, err)
+		return nil, fmt.Errorf("could not establish TCP connection to %s: %v", connStr, err)
 	}
 	c.InfoLogger.Printf("successfully established TCP connection to %s\n", connStr)
 	return conn, nil
 }
 
+// dial opens a raw connection to addr on n with the dialer for n's network class, or through Tor for every node under
+// TransportTorOnly.
+func (c *Client) dial(ctx context.Context, n *Node, addr string) (net.Conn, error) {
+	if n.IsOnion() || c.Transport == TransportTorOnly {
+		if !c.SupportsOnions() {
+			return nil, ErrTorNotConfigured
+		}
+		return c.OnionDialer.DialContext(ctx, "tcp", addr)
+	}
+	if c.ClearnetDialer != nil {
+		return c.ClearnetDialer.DialContext(ctx, "tcp", addr)
+	}
+	return directDialer.DialContext(ctx, "tcp", addr)
+}
+
+// OpenSession connects to a node and starts a session over the connection, beginning with the server.version
+// handshake. The session is kept alive with pings while it is idle. It is not pooled, and is owned by the caller, who
+// must close it.
+func (c *Client) OpenSession(ctx context.Context, n *Node) (*Session, error) {
+	conn, err := c.DialContext(ctx, n)
+	if err != nil {
+		c.stateChanged(n, ConnFailed, err)
+		return nil, err
+	}
+	s := NewSession(n, conn)
+	if err := c.handshake(ctx, s); err != nil {
+		c.ErrorLogger.Printf("%v\n", err)
+		_ = s.Close()
+		c.stateChanged(n, ConnFailed, err)
+		return nil, err
+	}
+	go c.monitor(s)
+	return s, nil
+}
+
+// Close closes every pooled connection and subscription.
+func (c *Client) Close() error {
+	c.closeSubscribers()
+	return c.Pool().Close()
+}
+
 // SendRequest sends a JSON RPC Request to a node, and returns a response as bytes.
 func (c *Client) SendRequest(req *JSONRPCRequest, n *Node, timeout time.Duration) ([]byte, error) {
-	c.InfoLogger.Printf("attempting to connect to %s\n", n.Host)
-	conn, err := c.Connect(n, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.SendRequestContext(ctx, req, n)
+}
+
+// SendRequestContext is like SendRequest, but gives up when ctx is done.
+func (c *Client) SendRequestContext(ctx context.Context, req *JSONRPCRequest, n *Node) ([]byte, error) {
+	b, err := json.Marshal(req)
 	if err != nil {
-		return nil, fmt.Errorf("could not connect to %s: %v", n.Host, err)
+		return nil, err
 	}
 	c.InfoLogger.Printf("sending request ID: %d to: %s\n", req.ID, n.Host)
-	resp, err := req.Send(conn)
+	resp, err := c.send(ctx, b, n)
 	if err != nil {
 		c.ErrorLogger.Printf("error sending request ID: %d to: %s: %v\n", req.ID, n.Host, err)
-		connErr := conn.Close()
-		if connErr != nil {
-			c.ErrorLogger.Printf("could not close connection to: %s after failed request ID: %d: %v\n", n.Host, req.ID, connErr)
-		}
 		return nil, err
 	}
-	_ = conn.Close()
 	return resp, nil
 }
 
+// SendRequestBytes sends a raw JSON RPC Request to a node, and returns a response as bytes.
 func (c *Client) SendRequestBytes(req []byte, n *Node, timeout time.Duration) ([]byte, error) {
-	c.InfoLogger.Printf("attempting to connect to %s\n", n.Host)
-	conn, err := c.Connect(n, timeout)
-	if err != nil {
-		return nil, err
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.SendRequestBytesContext(ctx, req, n)
+}
+
+// SendRequestBytesContext is like SendRequestBytes, but gives up when ctx is done.
+func (c *Client) SendRequestBytesContext(ctx context.Context, req []byte, n *Node) ([]byte, error) {
 	c.InfoLogger.Printf("sending request: %s to: %s\n", string(req), n.Host)
-	fmt.Println(conn)
-	_, err = fmt.Fprintf(conn, "%s", string(req)+"\n")
-	if err != nil {
-		return nil, err
-	}
-	resp, _ := bufio.NewReader(conn).ReadBytes(byte('\n'))
-	fmt.Println(string(resp))
-	if err != nil {
-		return nil, err
+	return c.send(ctx, req, n)
+}
+
+// send sends a request over the node's session. If the session turns out to be dead before the request could be
+// written, it is redialed and the request tried once more.
+func (c *Client) send(ctx context.Context, req []byte, n *Node) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		s, err := c.ConnectContext(ctx, n)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.Send(ctx, req)
+		var notSent *notSentError
+		if err != nil && attempt == 0 && errors.As(err, &notSent) && ctx.Err() == nil {
+			c.WarningLogger.Printf("connection to %s went away, reconnecting: %v\n", n.Host, err)
+			continue
+		}
+		return resp, err
 	}
-	_ = conn.Close()
-	return resp, nil
 }
 
 // GetPeerInfo gets peer information from a node by sending it a server.peers.subscribe JSON RPC Request
 // It then parses the response and returns a []Node of Electrum peers.
 func (c *Client) GetPeerInfo(n *Node, reqID int, timeout time.Duration) ([]Node, error) {
-	if n.IsOnion() {
-		c.ErrorLogger.Printf("failed to connect to %s: tor support not yet implemented\n", n.Host)
-		return nil, errors.New("tor support not yet implemented")
-	}
-	resp, err := c.SendRequest(NewPeerRequest(reqID), n, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.GetPeerInfoContext(ctx, n, reqID)
+}
+
+// GetPeerInfoContext is like GetPeerInfo, but gives up when ctx is done.
+func (c *Client) GetPeerInfoContext(ctx context.Context, n *Node, reqID int) ([]Node, error) {
+	resp, err := c.SendRequestContext(ctx, NewPeerRequest(reqID), n)
 	if err != nil {
 		c.ErrorLogger.Printf("failed to send peer request ID %d to %s: %v\n", reqID, n.Host, err)
 		return nil, err
@@ -158,7 +410,7 @@ func (c *Client) GetPeerInfo(n *Node, reqID int, timeout time.Duration) ([]Node,
 		c.ErrorLogger.Printf("error unmarshalling server peer subscription from %s req ID %d: %v\n", n.Host, reqID, err)
 		return nil, err
 	}
-	peers, err := ParseServerPeersSubscriptionResp(spr)
+	peers, err := parseServerPeersSubscriptionResp(spr, c.network())
 	if err != nil {
 		c.ErrorLogger.Printf("error parsing server peer subscription request response from %s for req ID %d: %v\n", n.Host, reqID, err)
 		return nil, err
@@ -0,0 +1,147 @@
+package electrum
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Dialer opens network connections. *net.Dialer, *SOCKS5Dialer and *HTTPConnectDialer all implement it, and any
+// function can be used as one with DialerFunc.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// DialerFunc adapts a function to the Dialer interface.
+type DialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DialContext calls f.
+func (f DialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// directDialer is used when no other dialer has been configured.
+var directDialer Dialer = &net.Dialer{}
+
+// HTTPConnectDialer connects to addresses through an HTTP proxy using the CONNECT method.
+type HTTPConnectDialer struct {
+	// ProxyAddr is the host:port of the proxy.
+	ProxyAddr string
+	// Username and Password, if set, are sent to the proxy with basic authentication.
+	Username string
+	Password string
+	// Forward opens the connection to the proxy itself. It is a direct connection if nil.
+	Forward Dialer
+}
+
+// DialContext connects to addr through the proxy. Only the "tcp" networks are supported.
+func (d *HTTPConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("http connect: unsupported network %s", network)
+	}
+	forward := d.Forward
+	if forward == nil {
+		forward = directDialer
+	}
+	conn, err := forward.DialContext(ctx, "tcp", d.ProxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("http connect: could not connect to proxy %s: %v", d.ProxyAddr, err)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultRequestTimeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.Username != "" || d.Password != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(d.Username + ":" + d.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http connect: connecting to %s: %v", addr, err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("http connect: connecting to %s: %w", addr, ctx.Err())
+		}
+		return nil, fmt.Errorf("http connect: connecting to %s: %v", addr, err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http connect: proxy refused connection to %s: %s", addr, resp.Status)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if r.Buffered() > 0 {
+		// The server spoke first and some of its bytes were read along with the proxy's response.
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose first bytes have already been read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// ProxyDialer returns a Dialer for a proxy URL: socks5://[user:pass@]host:port, socks5h:// (a synonym, as host names
+// are always resolved by the proxy), or http://[user:pass@]host:port for an HTTP CONNECT proxy. An empty string
+// returns a direct dialer.
+func ProxyDialer(rawURL string) (Dialer, error) {
+	if rawURL == "" {
+		return directDialer, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %s: missing host", rawURL)
+	}
+	username := u.User.Username()
+	password, _ := u.User.Password()
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return &SOCKS5Dialer{ProxyAddr: u.Host, Username: username, Password: password}, nil
+	case "http":
+		return &HTTPConnectDialer{ProxyAddr: u.Host, Username: username, Password: password}, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+}
@@ -0,0 +1,172 @@
+package electrum
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testHTTPProxy is an in-process HTTP CONNECT proxy that tunnels every request to target.
+type testHTTPProxy struct {
+	ln     net.Listener
+	target string
+	status int
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newTestHTTPProxy(t *testing.T, target string) *testHTTPProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testHTTPProxy{ln: ln, target: target, status: http.StatusOK}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serveConn(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = ln.Close() })
+	return p
+}
+
+func (p *testHTTPProxy) serveConn(conn net.Conn) {
+	defer conn.Close()
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.requests = append(p.requests, req)
+	p.mu.Unlock()
+	if p.status != http.StatusOK {
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", p.status, http.StatusText(p.status))
+		return
+	}
+	upstream, err := net.Dial("tcp", p.target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go func() { _, _ = io.Copy(upstream, conn) }()
+	_, _ = io.Copy(conn, upstream)
+}
+
+func TestHTTPConnectDialer_DialContext(t *testing.T) {
+	srv := newTestServer(t, func(req *testRequest) (interface{}, error) {
+		return "pong", nil
+	})
+	proxy := newTestHTTPProxy(t, srv.ln.Addr().String())
+	l := newTestClient().InfoLogger
+	c := NewClient(l, l, l, WithDialer(&HTTPConnectDialer{ProxyAddr: proxy.ln.Addr().String(), Username: "u", Password: "p"}))
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	// The node's address is only ever resolved by the proxy, which tunnels to srv whatever is asked for.
+	n := &Node{Host: "electrum.example.com", TCPPort: 50001}
+	if err := c.Ping(ctx, n); err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if len(proxy.requests) != 1 {
+		t.Fatalf("proxy saw %d requests, want 1", len(proxy.requests))
+	}
+	req := proxy.requests[0]
+	if req.Method != http.MethodConnect || req.Host != "electrum.example.com:50001" {
+		t.Errorf("proxy request = %s %s, want CONNECT electrum.example.com:50001", req.Method, req.Host)
+	}
+	if got := req.Header.Get("Proxy-Authorization"); got != "Basic dTpw" {
+		t.Errorf("Proxy-Authorization = %q, want basic credentials", got)
+	}
+}
+
+func TestHTTPConnectDialer_Refused(t *testing.T) {
+	proxy := newTestHTTPProxy(t, "")
+	proxy.status = http.StatusForbidden
+	d := &HTTPConnectDialer{ProxyAddr: proxy.ln.Addr().String()}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := d.DialContext(ctx, "tcp", "electrum.example.com:50001"); err == nil {
+		t.Errorf("DialContext() succeeded, want proxy refusal")
+	}
+}
+
+func TestClient_CustomDialers(t *testing.T) {
+	srv := newTestServer(t, func(req *testRequest) (interface{}, error) {
+		return "pong", nil
+	})
+	var mu sync.Mutex
+	var clearnet, onion []string
+	record := func(addrs *[]string) DialerFunc {
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			*addrs = append(*addrs, addr)
+			mu.Unlock()
+			var d net.Dialer
+			return d.DialContext(ctx, network, srv.ln.Addr().String())
+		}
+	}
+	l := newTestClient().InfoLogger
+	c := NewClient(l, l, l, WithDialer(record(&clearnet)), WithOnionDialer(record(&onion)))
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.Ping(ctx, &Node{Host: "electrum.example.com", TCPPort: 50001}); err != nil {
+		t.Fatalf("Ping() clearnet error = %v", err)
+	}
+	if err := c.Ping(ctx, &Node{Host: testOnion, TCPPort: 50001}); err != nil {
+		t.Fatalf("Ping() onion error = %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"electrum.example.com:50001"}; !reflect.DeepEqual(clearnet, want) {
+		t.Errorf("clearnet dials = %v, want %v", clearnet, want)
+	}
+	if want := []string{testOnion + ":50001"}; !reflect.DeepEqual(onion, want) {
+		t.Errorf("onion dials = %v, want %v", onion, want)
+	}
+}
+
+func TestProxyDialer(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		want    Dialer
+		wantErr bool
+	}{
+		{"direct", "", directDialer, false},
+		{"socks5", "socks5://127.0.0.1:9050", &SOCKS5Dialer{ProxyAddr: "127.0.0.1:9050"}, false},
+		{"socks5h with credentials", "socks5h://u:p@proxy:1080", &SOCKS5Dialer{ProxyAddr: "proxy:1080", Username: "u", Password: "p"}, false},
+		{"http connect", "http://user:pw@egress:3128", &HTTPConnectDialer{ProxyAddr: "egress:3128", Username: "user", Password: "pw"}, false},
+		{"unsupported scheme", "ftp://proxy:21", nil, true},
+		{"missing host", "socks5://", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ProxyDialer(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProxyDialer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ProxyDialer() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package electrum
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Defaults for the server.version handshake.
+const (
+	DefaultClientName  = "electrumrelay"
+	DefaultProtocolMin = "1.4"
+	DefaultProtocolMax = "1.4.2"
+)
+
+// ProtocolVersionError is returned when a server negotiates a protocol version below the client's minimum.
+type ProtocolVersionError struct {
+	Host       string
+	Negotiated string
+	Min        string
+}
+
+// Error implements the error interface.
+func (e *ProtocolVersionError) Error() string {
+	return fmt.Sprintf("%s negotiated protocol version %s, want at least %s", e.Host, e.Negotiated, e.Min)
+}
+
+// CompareProtocolVersions compares two dotted protocol versions such as "1.4" and "1.4.2", returning -1, 0 or 1 as a
+// is older than, the same as, or newer than b. Missing components count as zero, so "1.4" and "1.4.0" are the same.
+func CompareProtocolVersions(a, b string) (int, error) {
+	pa, err := parseProtocolVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	pb, err := parseProtocolVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for len(pa) < len(pb) {
+		pa = append(pa, 0)
+	}
+	for len(pb) < len(pa) {
+		pb = append(pb, 0)
+	}
+	for i := range pa {
+		switch {
+		case pa[i] < pb[i]:
+			return -1, nil
+		case pa[i] > pb[i]:
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func parseProtocolVersion(v string) ([]int, error) {
+	parts := strings.Split(v, ".")
+	out := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid protocol version %q", v)
+		}
+		out[i] = n
+	}
+	return out, nil
+}
+
+// versionParams builds the params of a server.version request.
+func versionParams(clientName, protocolMin, protocolMax string) []interface{} {
+	var protocol interface{} = []string{protocolMin, protocolMax}
+	if protocolMin == protocolMax {
+		protocol = protocolMin
+	}
+	return []interface{}{clientName, protocol}
+}
+
+// protocolRange returns the client name and protocol versions the client negotiates with.
+func (c *Client) protocolRange() (string, string, string) {
+	name, min, max := c.ClientName, c.ProtocolMin, c.ProtocolMax
+	if name == "" {
+		name = DefaultClientName
+	}
+	if min == "" {
+		min = DefaultProtocolMin
+	}
+	if max == "" {
+		max = DefaultProtocolMax
+	}
+	return name, min, max
+}
+
+// handshake sends server.version as the first message of a session, as servers expect, and refuses servers that
+// negotiate a protocol version below the client's minimum. The negotiated version and server software are recorded on
+// the session, and by the client for NegotiatedVersion.
+func (c *Client) handshake(ctx context.Context, s *Session) error {
+	name, min, max := c.protocolRange()
+	version := new(ServerVersion)
+	if err := callSession(ctx, s, "server.version", versionParams(name, min, max), version); err != nil {
+		return fmt.Errorf("server.version handshake with %s failed: %w", s.Node.Host, err)
+	}
+	if cmp, err := CompareProtocolVersions(version.Protocol, min); err != nil || cmp < 0 {
+		return &ProtocolVersionError{Host: s.Node.Host, Negotiated: version.Protocol, Min: min}
+	}
+	s.version = version
+	c.versionMutex.Lock()
+	if c.versions == nil {
+		c.versions = make(map[string]*ServerVersion)
+	}
+	c.versions[s.Node.key()] = version
+	c.versionMutex.Unlock()
+	c.InfoLogger.Printf("negotiated protocol %s with %s running %s\n", version.Protocol, s.Node.Host, version.Software)
+	return nil
+}
+
+// NegotiatedVersion returns the server software and protocol version last negotiated with n, reporting false if the
+// client hasn't connected to it. Nodes are shared by the client's callers, so the client doesn't write to them; apply
+// the version with Node.RegisterVersion where the node is owned.
+func (c *Client) NegotiatedVersion(n *Node) (*ServerVersion, bool) {
+	c.versionMutex.Lock()
+	defer c.versionMutex.Unlock()
+	v, ok := c.versions[n.key()]
+	return v, ok
+}
@@ -0,0 +1,150 @@
+package electrum
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClient_Handshake(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         []ClientOption
+		reply        interface{}
+		replyErr     error
+		wantParams   []interface{}
+		wantErr      bool
+		wantProtocol bool
+	}{
+		{
+			name:       "negotiates default range",
+			reply:      []string{"ElectrumX 1.16.0", "1.4.2"},
+			wantParams: []interface{}{DefaultClientName, []interface{}{DefaultProtocolMin, DefaultProtocolMax}},
+		},
+		{
+			name:       "configured name and single version",
+			opts:       []ClientOption{WithClientName("wallet"), WithProtocolVersions("1.4", "1.4")},
+			reply:      []string{"Fulcrum 1.9.0", "1.4"},
+			wantParams: []interface{}{"wallet", "1.4"},
+		},
+		{
+			name:         "version below minimum refused",
+			opts:         []ClientOption{WithProtocolVersions("1.4.2", "1.5")},
+			reply:        []string{"ElectrumX 1.10.0", "1.4"},
+			wantParams:   []interface{}{DefaultClientName, []interface{}{"1.4.2", "1.5"}},
+			wantErr:      true,
+			wantProtocol: true,
+		},
+		{
+			name:       "server refuses every version",
+			replyErr:   errors.New("unsupported protocol version: 2.0"),
+			wantParams: []interface{}{DefaultClientName, []interface{}{DefaultProtocolMin, DefaultProtocolMax}},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var methods []string
+			var params []interface{}
+			srv := newRawTestServer(t, func(req *testRequest) (interface{}, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				methods = append(methods, req.Method)
+				if req.Method == "server.version" {
+					params = req.Params
+					return tt.reply, tt.replyErr
+				}
+				return nil, nil
+			})
+			l := newTestClient().InfoLogger
+			c := NewClient(l, l, l, tt.opts...)
+			defer c.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			n := srv.node()
+			err := c.Ping(ctx, n)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Ping() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var versionErr *ProtocolVersionError
+			if errors.As(err, &versionErr) != tt.wantProtocol {
+				t.Errorf("Ping() error = %v, want protocol version error %v", err, tt.wantProtocol)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(methods) == 0 || methods[0] != "server.version" {
+				t.Fatalf("requests = %v, want server.version first", methods)
+			}
+			if !reflect.DeepEqual(params, tt.wantParams) {
+				t.Errorf("server.version params = %v, want %v", params, tt.wantParams)
+			}
+			if tt.wantErr {
+				if len(methods) != 1 {
+					t.Errorf("requests = %v, want nothing sent after a failed handshake", methods)
+				}
+				if v, ok := c.NegotiatedVersion(n); ok {
+					t.Errorf("NegotiatedVersion() = %+v after a failed handshake", v)
+				}
+				return
+			}
+			mu.Unlock()
+			reply := tt.reply.([]string)
+			want := &ServerVersion{Software: reply[0], Protocol: reply[1]}
+			s, err := c.ConnectContext(ctx, n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Version(); !reflect.DeepEqual(got, want) {
+				t.Errorf("Session.Version() = %+v, want %+v", got, want)
+			}
+			v, ok := c.NegotiatedVersion(n)
+			if !ok || !reflect.DeepEqual(v, want) {
+				t.Fatalf("NegotiatedVersion() = %+v, %v, want %+v", v, ok, want)
+			}
+			n.RegisterVersion(v)
+			if n.ServerSoftware != want.Software || n.Version != want.Protocol {
+				t.Errorf("node reports %q %q, want %q %q", n.ServerSoftware, n.Version, want.Software, want.Protocol)
+			}
+			// Asking again is answered by the session, without negotiating twice on the connection.
+			if got, err := c.ServerVersion(ctx, n); err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("ServerVersion() = %+v, %v, want %+v", got, err, want)
+			}
+			mu.Lock()
+			if len(methods) != 2 || methods[1] != "server.ping" {
+				t.Errorf("requests = %v, want server.version sent only in the handshake", methods)
+			}
+		})
+	}
+}
+
+func TestCompareProtocolVersions(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		want    int
+		wantErr bool
+	}{
+		{"1.4", "1.4", 0, false},
+		{"1.4", "1.4.0", 0, false},
+		{"1.4", "1.4.2", -1, false},
+		{"1.10", "1.9", 1, false},
+		{"2.0", "1.4.2", 1, false},
+		{"1.x", "1.4", 0, true},
+		{"", "1.4", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			got, err := CompareProtocolVersions(tt.a, tt.b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CompareProtocolVersions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("CompareProtocolVersions() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
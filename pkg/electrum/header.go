@@ -0,0 +1,150 @@
+package electrum
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+)
+
+// HeaderSize is the size of a serialized block header in bytes.
+const HeaderSize = 80
+
+// BlockHeader is a parsed Bitcoin block header. Hashes are hex encoded in the byte reversed order block explorers
+// display them in.
+type BlockHeader struct {
+	Hash       string `json:"hash"`
+	Version    int32  `json:"version"`
+	PrevBlock  string `json:"prev_block"`
+	MerkleRoot string `json:"merkle_root"`
+	Timestamp  uint32 `json:"timestamp"`
+	Bits       uint32 `json:"bits"`
+	Nonce      uint32 `json:"nonce"`
+}
+
+// ParseBlockHeader parses a hex encoded block header, as returned by blockchain.block.header.
+func ParseBlockHeader(s string) (*BlockHeader, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block header hex: %v", err)
+	}
+	return ParseBlockHeaderBytes(b)
+}
+
+// ParseBlockHeaderBytes parses a serialized block header.
+func ParseBlockHeaderBytes(b []byte) (*BlockHeader, error) {
+	if len(b) != HeaderSize {
+		return nil, fmt.Errorf("block header is %d bytes, want %d", len(b), HeaderSize)
+	}
+	return &BlockHeader{
+		Hash:       HashToString(DoubleSHA256(b)),
+		Version:    int32(binary.LittleEndian.Uint32(b[0:4])),
+		PrevBlock:  HashToString(b[4:36]),
+		MerkleRoot: HashToString(b[36:68]),
+		Timestamp:  binary.LittleEndian.Uint32(b[68:72]),
+		Bits:       binary.LittleEndian.Uint32(b[72:76]),
+		Nonce:      binary.LittleEndian.Uint32(b[76:80]),
+	}, nil
+}
+
+// DoubleSHA256 returns SHA256(SHA256(b)), the hash used for block and transaction IDs.
+func DoubleSHA256(b []byte) []byte {
+	first := sha256.Sum256(b)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+// HashToString hex encodes a hash in display order, which is the reverse of its internal byte order.
+func HashToString(h []byte) string {
+	out := make([]byte, len(h))
+	for i := range h {
+		out[len(h)-1-i] = h[i]
+	}
+	return hex.EncodeToString(out)
+}
+
+// HashFromString decodes a hex encoded hash in display order into its internal byte order.
+func HashFromString(s string) ([]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("hash is %d bytes, want 32", len(b))
+	}
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b, nil
+}
+
+// CompactToBig decodes a target in the compact form used by the bits field of block headers. Negative targets are
+// returned as negative numbers.
+func CompactToBig(bits uint32) *big.Int {
+	mantissa := int64(bits & 0x007fffff)
+	exponent := uint(bits >> 24)
+	target := big.NewInt(mantissa)
+	if exponent <= 3 {
+		target.Rsh(target, 8*(3-exponent))
+	} else {
+		target.Lsh(target, 8*(exponent-3))
+	}
+	if bits&0x00800000 != 0 {
+		target.Neg(target)
+	}
+	return target
+}
+
+// Target returns the proof of work target the header's hash must not exceed.
+func (h *BlockHeader) Target() *big.Int {
+	return CompactToBig(h.Bits)
+}
+
+// CheckProofOfWork checks that the header's hash meets the target its bits claim. It doesn't check that the target is
+// the right one for the header's place in the chain.
+func (h *BlockHeader) CheckProofOfWork() error {
+	target := h.Target()
+	if target.Sign() <= 0 || target.BitLen() > 256 {
+		return fmt.Errorf("block %s has invalid target bits %08x", h.Hash, h.Bits)
+	}
+	hash, ok := new(big.Int).SetString(h.Hash, 16)
+	if !ok {
+		return fmt.Errorf("block hash %q is not hex", h.Hash)
+	}
+	if hash.Cmp(target) > 0 {
+		return fmt.Errorf("block %s does not meet its target %064x", h.Hash, target)
+	}
+	return nil
+}
+
+// BigToCompact encodes a non-negative target in the compact form used by the bits field of block headers, losing any
+// precision beyond its three most significant bytes.
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() <= 0 {
+		return 0
+	}
+	exponent := uint((n.BitLen() + 7) / 8)
+	var mantissa uint32
+	if exponent <= 3 {
+		mantissa = uint32(n.Uint64()) << (8 * (3 - exponent))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(n, 8*(exponent-3)).Uint64())
+	}
+	// The mantissa's top bit is its sign, so a mantissa using it is shifted into the next byte.
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+	return uint32(exponent)<<24 | mantissa
+}
+
+// Work returns the expected number of hashes needed to meet the header's target, the measure chains are compared by.
+func (h *BlockHeader) Work() *big.Int {
+	target := h.Target()
+	if target.Sign() <= 0 {
+		return new(big.Int)
+	}
+	// 2^256 / (target + 1)
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), target.Add(target, big.NewInt(1)))
+}
@@ -0,0 +1,140 @@
+package electrum
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+const genesisHeaderHex = "0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a29ab5f49ffff001d1dac2b7c"
+
+func TestParseBlockHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		hex     string
+		want    *BlockHeader
+		wantErr bool
+	}{
+		{
+			name: "genesis block",
+			hex:  genesisHeaderHex,
+			want: &BlockHeader{
+				Hash:       "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f",
+				Version:    1,
+				PrevBlock:  "0000000000000000000000000000000000000000000000000000000000000000",
+				MerkleRoot: "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b",
+				Timestamp:  1231006505,
+				Bits:       0x1d00ffff,
+				Nonce:      2083236893,
+			},
+		},
+		{
+			name:    "truncated header",
+			hex:     genesisHeaderHex[:100],
+			wantErr: true,
+		},
+		{
+			name:    "not hex",
+			hex:     "zz",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseBlockHeader(tt.hex)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseBlockHeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseBlockHeader() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashFromString(t *testing.T) {
+	s := "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f"
+	b, err := HashFromString(s)
+	if err != nil {
+		t.Fatalf("HashFromString() error = %v", err)
+	}
+	if got := HashToString(b); got != s {
+		t.Errorf("HashToString(HashFromString()) = %s, want %s", got, s)
+	}
+}
+
+func TestBlockHeader_CheckProofOfWork(t *testing.T) {
+	genesis, err := ParseBlockHeader(genesisHeaderHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := *genesis
+	tampered.Hash = "0000000100000000000000000000000000000000000000000000000000000000"
+	negative := *genesis
+	negative.Bits = 0x1d80ffff
+
+	tests := []struct {
+		name    string
+		header  *BlockHeader
+		wantErr bool
+	}{
+		{"genesis", genesis, false},
+		{"hash above target", &tampered, true},
+		{"negative target", &negative, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.header.CheckProofOfWork(); (err != nil) != tt.wantErr {
+				t.Errorf("CheckProofOfWork() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCompactToBig(t *testing.T) {
+	tests := []struct {
+		bits uint32
+		want string
+	}{
+		{0x1d00ffff, "ffff0000000000000000000000000000000000000000000000000000"},
+		{0x207fffff, "7fffff0000000000000000000000000000000000000000000000000000000000"},
+		{0x03123456, "123456"},
+		{0x02123456, "1234"},
+	}
+	for _, tt := range tests {
+		if got := CompactToBig(tt.bits).Text(16); got != tt.want {
+			t.Errorf("CompactToBig(%08x) = %s, want %s", tt.bits, got, tt.want)
+		}
+	}
+}
+
+func TestBigToCompact(t *testing.T) {
+	tests := []struct {
+		target string
+		want   uint32
+	}{
+		{"ffff0000000000000000000000000000000000000000000000000000", 0x1d00ffff},
+		{"7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 0x207fffff},
+		{"123456", 0x03123456},
+		{"1234", 0x02123400},
+		{"80", 0x02008000},
+		{"0", 0},
+	}
+	for _, tt := range tests {
+		n, _ := new(big.Int).SetString(tt.target, 16)
+		if got := BigToCompact(n); got != tt.want {
+			t.Errorf("BigToCompact(%s) = %08x, want %08x", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestBlockHeader_Work(t *testing.T) {
+	genesis, err := ParseBlockHeader(genesisHeaderHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The work of a difficulty 1 block is 2^32 + 2^16 + 1 hashes.
+	if got, want := genesis.Work().Int64(), int64(1<<32+1<<16+1); got != want {
+		t.Errorf("Work() = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,136 @@
+package electrum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// KeepAliveConfig controls the server.ping keepalives sent on idle connections, which stop servers from dropping them
+// after their session timeout and detect connections that have silently died.
+type KeepAliveConfig struct {
+	// Interval is how long a connection may sit idle before it is pinged. Keepalives are disabled if it isn't positive.
+	Interval time.Duration
+	// Timeout is how long to wait for each pong.
+	Timeout time.Duration
+	// MaxMissed is how many pings in a row may go unanswered before the connection is torn down.
+	MaxMissed int
+}
+
+// DefaultKeepAliveConfig pings well within the 10 minute session timeout ElectrumX defaults to.
+var DefaultKeepAliveConfig = KeepAliveConfig{
+	Interval:  time.Minute,
+	Timeout:   10 * time.Second,
+	MaxMissed: 2,
+}
+
+// ConnState is the state of a connection to a node.
+type ConnState int
+
+const (
+	// ConnConnected is reported once a connection has been dialed and has completed its handshake.
+	ConnConnected ConnState = iota
+	// ConnUnresponsive is reported when a connection misses a keepalive ping. It is torn down once it has missed
+	// KeepAliveConfig.MaxMissed in a row.
+	ConnUnresponsive
+	// ConnDisconnected is reported when a connection closes, for whatever reason.
+	ConnDisconnected
+	// ConnFailed is reported when a connection can't be established.
+	ConnFailed
+)
+
+// String implements fmt.Stringer.
+func (s ConnState) String() string {
+	switch s {
+	case ConnConnected:
+		return "connected"
+	case ConnUnresponsive:
+		return "unresponsive"
+	case ConnDisconnected:
+		return "disconnected"
+	case ConnFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+// ConnStateChange describes a change in the state of a connection to a node.
+type ConnStateChange struct {
+	Node  *Node
+	State ConnState
+	// Err is why the connection failed, missed a ping or closed. It is nil for ConnConnected, and for connections the
+	// client closed itself.
+	Err error
+}
+
+// keepAliveConfig returns the client's keepalive configuration, with defaults filled in for unset fields.
+func (c *Client) keepAliveConfig() KeepAliveConfig {
+	if c.KeepAlive == nil {
+		return DefaultKeepAliveConfig
+	}
+	config := *c.KeepAlive
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultKeepAliveConfig.Timeout
+	}
+	if config.MaxMissed <= 0 {
+		config.MaxMissed = 1
+	}
+	return config
+}
+
+// stateChanged reports a connection state change to the client's handler, if it has one.
+func (c *Client) stateChanged(n *Node, state ConnState, err error) {
+	if c.ConnStateHandler != nil {
+		c.ConnStateHandler(ConnStateChange{Node: n, State: state, Err: err})
+	}
+}
+
+// monitor watches a newly opened session until it closes, pinging it whenever it has been quiet for the keepalive
+// interval and tearing it down once too many pings in a row go unanswered. Pooled sessions are redialed on demand
+// once torn down, and subscriptions redial and resubscribe. The pings don't count as use of the session, so the pool
+// still reaps sessions that have had no requests for its IdleTimeout.
+func (c *Client) monitor(s *Session) {
+	c.stateChanged(s.Node, ConnConnected, nil)
+	config := c.keepAliveConfig()
+	var tick <-chan time.Time
+	if config.Interval > 0 {
+		// Check at a fraction of the interval so an idle connection is pinged soon after it becomes due.
+		ticker := time.NewTicker(config.Interval / 4)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	missed := 0
+	for {
+		select {
+		case <-s.Done():
+			err := s.Err()
+			if errors.Is(err, errClosedByClient) {
+				err = nil
+			}
+			c.stateChanged(s.Node, ConnDisconnected, err)
+			return
+		case <-tick:
+			if s.quietFor() < config.Interval {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+			err := s.keepAlive(ctx)
+			cancel()
+			if err == nil {
+				missed = 0
+				continue
+			}
+			if s.Err() != nil {
+				// The session closed while pinging; the next iteration reports it.
+				continue
+			}
+			missed++
+			c.WarningLogger.Printf("%s missed keepalive ping %d of %d: %v\n", s.Node.Host, missed, config.MaxMissed, err)
+			c.stateChanged(s.Node, ConnUnresponsive, err)
+			if missed >= config.MaxMissed {
+				s.fail(fmt.Errorf("missed %d keepalive pings", missed))
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package electrum
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClient_KeepAlive(t *testing.T) {
+	var mu sync.Mutex
+	pings := 0
+	srv := newTestServer(t, func(req *testRequest) (interface{}, error) {
+		if req.Method == "server.ping" {
+			mu.Lock()
+			pings++
+			mu.Unlock()
+		}
+		return nil, nil
+	})
+	l := newTestClient().InfoLogger
+	c := NewClient(l, l, l, WithKeepAlive(KeepAliveConfig{Interval: 20 * time.Millisecond, Timeout: time.Second}))
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	s, err := c.OpenSession(ctx, srv.node())
+	if err != nil {
+		t.Fatalf("OpenSession() error = %v", err)
+	}
+	defer s.Close()
+	time.Sleep(200 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if pings < 2 {
+		t.Errorf("idle session pinged %d times, want at least 2", pings)
+	}
+	if s.Err() != nil {
+		t.Errorf("session closed: %v", s.Err())
+	}
+	if idle := s.IdleFor(); idle < 150*time.Millisecond {
+		t.Errorf("IdleFor() = %v after only keepalive pings, want at least 150ms", idle)
+	}
+}
+
+func TestClient_KeepAliveDoesNotPreventReaping(t *testing.T) {
+	srv := newTestServer(t, func(req *testRequest) (interface{}, error) {
+		return nil, nil
+	})
+	l := newTestClient().InfoLogger
+	c := NewClient(l, l, l,
+		WithKeepAlive(KeepAliveConfig{Interval: 10 * time.Millisecond, Timeout: time.Second}),
+		WithPoolConfig(PoolConfig{IdleTimeout: 50 * time.Millisecond}))
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	s, err := c.ConnectContext(ctx, srv.node())
+	if err != nil {
+		t.Fatalf("ConnectContext() error = %v", err)
+	}
+	select {
+	case <-s.Done():
+	case <-ctx.Done():
+		t.Fatalf("pooled session pinged by keepalives was never reaped")
+	}
+}
+
+func TestClient_KeepAliveMissedPongs(t *testing.T) {
+	release := make(chan struct{})
+	srv := newTestServer(t, func(req *testRequest) (interface{}, error) {
+		if req.Method == "server.ping" {
+			<-release
+		}
+		return nil, nil
+	})
+	t.Cleanup(func() { close(release) })
+
+	var mu sync.Mutex
+	var states []ConnState
+	changed := make(chan struct{}, 16)
+	l := newTestClient().InfoLogger
+	c := NewClient(l, l, l,
+		WithKeepAlive(KeepAliveConfig{Interval: 20 * time.Millisecond, Timeout: 20 * time.Millisecond, MaxMissed: 2}),
+		WithConnStateHandler(func(change ConnStateChange) {
+			mu.Lock()
+			states = append(states, change.State)
+			mu.Unlock()
+			changed <- struct{}{}
+		}),
+	)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	s, err := c.OpenSession(ctx, srv.node())
+	if err != nil {
+		t.Fatalf("OpenSession() error = %v", err)
+	}
+	select {
+	case <-s.Done():
+	case <-ctx.Done():
+		t.Fatal("session with unanswered pings was not torn down")
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for state changes")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []ConnState{ConnConnected, ConnUnresponsive, ConnUnresponsive, ConnDisconnected}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("states = %v, want %v", states, want)
+	}
+}
+
+func TestClient_ConnStateFailed(t *testing.T) {
+	var got []ConnStateChange
+	l := newTestClient().InfoLogger
+	c := NewClient(l, l, l, WithConnStateHandler(func(change ConnStateChange) {
+		got = append(got, change)
+	}))
+	defer c.Close()
+	n := &Node{Host: "localhost", TCPPort: closedPort(t)}
+	if _, err := c.OpenSession(context.Background(), n); err == nil {
+		t.Fatal("OpenSession() to a closed port succeeded")
+	}
+	if len(got) != 1 || got[0].State != ConnFailed || got[0].Node != n || got[0].Err == nil {
+		t.Errorf("state changes = %+v, want one failure for the node", got)
+	}
+}
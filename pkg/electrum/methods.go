@@ -0,0 +1,354 @@
+package electrum
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Call sends method with params to a node and unmarshals the result into result, which may be nil if the result is
+// not needed. Errors returned by the server are returned as *RPCError.
+func (c *Client) Call(ctx context.Context, n *Node, method string, params []interface{}, result interface{}) error {
+	req, err := newCall(method, params)
+	if err != nil {
+		return err
+	}
+	raw, err := c.send(ctx, req, n)
+	if err != nil {
+		c.ErrorLogger.Printf("error calling %s on %s: %v\n", method, n.Host, err)
+		return err
+	}
+	return decodeResult(raw, n, method, result)
+}
+
+// callSession is like Call, but sends the request over the given session rather than one drawn from the pool.
+func callSession(ctx context.Context, s *Session, method string, params []interface{}, result interface{}) error {
+	req, err := newCall(method, params)
+	if err != nil {
+		return err
+	}
+	raw, err := s.Send(ctx, req)
+	if err != nil {
+		return err
+	}
+	return decodeResult(raw, s.Node, method, result)
+}
+
+// Call sends a request for method over the session and decodes its result into result, like Client.Call.
+func (s *Session) Call(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	return callSession(ctx, s, method, params, result)
+}
+
+// newCall marshals a request for method. The session assigns its own ID, so any non-zero ID will do here.
+func newCall(method string, params []interface{}) ([]byte, error) {
+	if params == nil {
+		params = []interface{}{}
+	}
+	return json.Marshal(NewJSONRPCRequest("2.0", 1, method, params))
+}
+
+// decodeResult unmarshals the result of a response into result, or returns the error object it carries.
+func decodeResult(raw []byte, n *Node, method string, result interface{}) error {
+	resp := new(JSONRPCResponse)
+	if err := json.Unmarshal(raw, resp); err != nil {
+		return fmt.Errorf("invalid response to %s from %s: %v", method, n.Host, err)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		return fmt.Errorf("invalid result for %s from %s: %v", method, n.Host, err)
+	}
+	return nil
+}
+
+// HeaderProof is the result of blockchain.block.header when a checkpoint height is given.
+type HeaderProof struct {
+	Branch []string `json:"branch"`
+	Header string   `json:"header"`
+	Root   string   `json:"root"`
+}
+
+// BlockHeaders is the result of blockchain.block.headers.
+type BlockHeaders struct {
+	Count  int      `json:"count"`
+	Hex    string   `json:"hex"`
+	Max    int      `json:"max"`
+	Branch []string `json:"branch,omitempty"`
+	Root   string   `json:"root,omitempty"`
+}
+
+// Balance is the result of blockchain.scripthash.get_balance, in satoshis.
+type Balance struct {
+	Confirmed   int64 `json:"confirmed"`
+	Unconfirmed int64 `json:"unconfirmed"`
+}
+
+// HistoryEntry is an element of the results of blockchain.scripthash.get_history and get_mempool.
+// Height is 0 for mempool transactions, or -1 if they have unconfirmed inputs. Fee is only set for mempool transactions.
+type HistoryEntry struct {
+	Height int    `json:"height"`
+	TxHash string `json:"tx_hash"`
+	Fee    int64  `json:"fee,omitempty"`
+}
+
+// Unspent is an element of the result of blockchain.scripthash.listunspent.
+type Unspent struct {
+	Height int    `json:"height"`
+	TxHash string `json:"tx_hash"`
+	TxPos  int    `json:"tx_pos"`
+	Value  int64  `json:"value"`
+}
+
+// VerboseTransaction is the result of blockchain.transaction.get in verbose mode, as passed through from bitcoind.
+// Only the commonly used fields are decoded.
+type VerboseTransaction struct {
+	TxID          string `json:"txid"`
+	Hash          string `json:"hash"`
+	Hex           string `json:"hex"`
+	Size          int    `json:"size"`
+	VSize         int    `json:"vsize"`
+	Weight        int    `json:"weight"`
+	Version       int    `json:"version"`
+	LockTime      uint32 `json:"locktime"`
+	BlockHash     string `json:"blockhash"`
+	Confirmations int    `json:"confirmations"`
+	Time          int64  `json:"time"`
+	BlockTime     int64  `json:"blocktime"`
+}
+
+// MerkleProof is the result of blockchain.transaction.get_merkle.
+type MerkleProof struct {
+	BlockHeight int      `json:"block_height"`
+	Merkle      []string `json:"merkle"`
+	Pos         int      `json:"pos"`
+}
+
+// TxIDProof is the result of blockchain.transaction.id_from_pos when a merkle proof is requested.
+type TxIDProof struct {
+	TxHash string   `json:"tx_hash"`
+	Merkle []string `json:"merkle"`
+}
+
+// FeeHistogramEntry is an element of the result of mempool.get_fee_histogram: the vsize of mempool transactions
+// paying at least FeeRate sat/vbyte, and less than the previous entry's rate.
+type FeeHistogramEntry struct {
+	FeeRate float64
+	VSize   int64
+}
+
+// UnmarshalJSON decodes an entry from its [fee_rate, vsize] pair.
+func (e *FeeHistogramEntry) UnmarshalJSON(b []byte) error {
+	var pair []json.Number
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 {
+		return fmt.Errorf("fee histogram entry has %d elements, want 2", len(pair))
+	}
+	rate, err := pair[0].Float64()
+	if err != nil {
+		return err
+	}
+	vsize, err := pair[1].Float64()
+	if err != nil {
+		return err
+	}
+	e.FeeRate, e.VSize = rate, int64(vsize)
+	return nil
+}
+
+// HostPorts lists the ports a server advertises for one of its hostnames.
+type HostPorts struct {
+	TCPPort int `json:"tcp_port,omitempty"`
+	SSLPort int `json:"ssl_port,omitempty"`
+}
+
+// ServerFeatures is the result of server.features.
+type ServerFeatures struct {
+	GenesisHash   string               `json:"genesis_hash"`
+	Hosts         map[string]HostPorts `json:"hosts"`
+	ProtocolMax   string               `json:"protocol_max"`
+	ProtocolMin   string               `json:"protocol_min"`
+	Pruning       *int                 `json:"pruning"`
+	ServerVersion string               `json:"server_version"`
+	HashFunction  string               `json:"hash_function"`
+}
+
+// ServerVersion is the result of server.version.
+type ServerVersion struct {
+	Software string
+	Protocol string
+}
+
+// MarshalJSON encodes the version as the [software, protocol] pair server.version returns.
+func (v *ServerVersion) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]string{v.Software, v.Protocol})
+}
+
+// UnmarshalJSON decodes the [software, protocol] pair returned by server.version.
+func (v *ServerVersion) UnmarshalJSON(b []byte) error {
+	var pair []string
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 {
+		return fmt.Errorf("server version has %d elements, want 2", len(pair))
+	}
+	v.Software, v.Protocol = pair[0], pair[1]
+	return nil
+}
+
+// GetBlockHeader returns the hex encoded header of the block at height using blockchain.block.header.
+func (c *Client) GetBlockHeader(ctx context.Context, n *Node, height int) (string, error) {
+	var header string
+	err := c.Call(ctx, n, "blockchain.block.header", []interface{}{height}, &header)
+	return header, err
+}
+
+// GetBlockHeaderWithProof returns the header of the block at height along with a merkle proof of it against the
+// checkpoint at cpHeight using blockchain.block.header.
+func (c *Client) GetBlockHeaderWithProof(ctx context.Context, n *Node, height int, cpHeight int) (*HeaderProof, error) {
+	proof := new(HeaderProof)
+	err := c.Call(ctx, n, "blockchain.block.header", []interface{}{height, cpHeight}, proof)
+	return proof, err
+}
+
+// GetBlockHeaders returns up to count concatenated headers starting at startHeight using blockchain.block.headers.
+func (c *Client) GetBlockHeaders(ctx context.Context, n *Node, startHeight int, count int) (*BlockHeaders, error) {
+	headers := new(BlockHeaders)
+	err := c.Call(ctx, n, "blockchain.block.headers", []interface{}{startHeight, count}, headers)
+	return headers, err
+}
+
+// EstimateFee returns the fee rate in BTC/kB needed to confirm within blocks using blockchain.estimatefee.
+// The server returns -1 if it does not have enough information to make an estimate.
+func (c *Client) EstimateFee(ctx context.Context, n *Node, blocks int) (float64, error) {
+	var fee float64
+	err := c.Call(ctx, n, "blockchain.estimatefee", []interface{}{blocks}, &fee)
+	return fee, err
+}
+
+// RelayFee returns the minimum fee rate in BTC/kB the server will relay using blockchain.relayfee.
+func (c *Client) RelayFee(ctx context.Context, n *Node) (float64, error) {
+	var fee float64
+	err := c.Call(ctx, n, "blockchain.relayfee", nil, &fee)
+	return fee, err
+}
+
+// GetBalance returns the balance of a script hash using blockchain.scripthash.get_balance.
+func (c *Client) GetBalance(ctx context.Context, n *Node, scripthash string) (*Balance, error) {
+	balance := new(Balance)
+	err := c.Call(ctx, n, "blockchain.scripthash.get_balance", []interface{}{scripthash}, balance)
+	return balance, err
+}
+
+// GetHistory returns the confirmed and mempool history of a script hash using blockchain.scripthash.get_history.
+func (c *Client) GetHistory(ctx context.Context, n *Node, scripthash string) ([]HistoryEntry, error) {
+	var history []HistoryEntry
+	err := c.Call(ctx, n, "blockchain.scripthash.get_history", []interface{}{scripthash}, &history)
+	return history, err
+}
+
+// GetMempool returns the mempool transactions touching a script hash using blockchain.scripthash.get_mempool.
+func (c *Client) GetMempool(ctx context.Context, n *Node, scripthash string) ([]HistoryEntry, error) {
+	var mempool []HistoryEntry
+	err := c.Call(ctx, n, "blockchain.scripthash.get_mempool", []interface{}{scripthash}, &mempool)
+	return mempool, err
+}
+
+// ListUnspent returns the unspent outputs of a script hash using blockchain.scripthash.listunspent.
+func (c *Client) ListUnspent(ctx context.Context, n *Node, scripthash string) ([]Unspent, error) {
+	var unspent []Unspent
+	err := c.Call(ctx, n, "blockchain.scripthash.listunspent", []interface{}{scripthash}, &unspent)
+	return unspent, err
+}
+
+// GetTransaction returns the hex encoded raw transaction using blockchain.transaction.get.
+func (c *Client) GetTransaction(ctx context.Context, n *Node, txHash string) (string, error) {
+	var tx string
+	err := c.Call(ctx, n, "blockchain.transaction.get", []interface{}{txHash, false}, &tx)
+	return tx, err
+}
+
+// GetTransactionVerbose returns the decoded transaction using blockchain.transaction.get in verbose mode.
+func (c *Client) GetTransactionVerbose(ctx context.Context, n *Node, txHash string) (*VerboseTransaction, error) {
+	tx := new(VerboseTransaction)
+	err := c.Call(ctx, n, "blockchain.transaction.get", []interface{}{txHash, true}, tx)
+	return tx, err
+}
+
+// GetMerkle returns the merkle branch of a confirmed transaction using blockchain.transaction.get_merkle.
+func (c *Client) GetMerkle(ctx context.Context, n *Node, txHash string, height int) (*MerkleProof, error) {
+	proof := new(MerkleProof)
+	err := c.Call(ctx, n, "blockchain.transaction.get_merkle", []interface{}{txHash, height}, proof)
+	return proof, err
+}
+
+// TransactionIDFromPos returns the hash of the transaction at pos in the block at height using
+// blockchain.transaction.id_from_pos.
+func (c *Client) TransactionIDFromPos(ctx context.Context, n *Node, height int, pos int) (string, error) {
+	var txHash string
+	err := c.Call(ctx, n, "blockchain.transaction.id_from_pos", []interface{}{height, pos, false}, &txHash)
+	return txHash, err
+}
+
+// TransactionIDFromPosWithProof is like TransactionIDFromPos, but also returns the transaction's merkle branch.
+func (c *Client) TransactionIDFromPosWithProof(ctx context.Context, n *Node, height int, pos int) (*TxIDProof, error) {
+	proof := new(TxIDProof)
+	err := c.Call(ctx, n, "blockchain.transaction.id_from_pos", []interface{}{height, pos, true}, proof)
+	return proof, err
+}
+
+// BroadcastTransaction broadcasts a hex encoded raw transaction using blockchain.transaction.broadcast and returns its
+// hash.
+func (c *Client) BroadcastTransaction(ctx context.Context, n *Node, rawTx string) (string, error) {
+	var txHash string
+	err := c.Call(ctx, n, "blockchain.transaction.broadcast", []interface{}{rawTx}, &txHash)
+	return txHash, err
+}
+
+// GetFeeHistogram returns the server's mempool fee histogram using mempool.get_fee_histogram.
+func (c *Client) GetFeeHistogram(ctx context.Context, n *Node) ([]FeeHistogramEntry, error) {
+	var histogram []FeeHistogramEntry
+	err := c.Call(ctx, n, "mempool.get_fee_histogram", nil, &histogram)
+	return histogram, err
+}
+
+// ServerBanner returns the server's banner using server.banner.
+func (c *Client) ServerBanner(ctx context.Context, n *Node) (string, error) {
+	var banner string
+	err := c.Call(ctx, n, "server.banner", nil, &banner)
+	return banner, err
+}
+
+// ServerDonationAddress returns the server operator's donation address using server.donation_address.
+func (c *Client) ServerDonationAddress(ctx context.Context, n *Node) (string, error) {
+	var address string
+	err := c.Call(ctx, n, "server.donation_address", nil, &address)
+	return address, err
+}
+
+// ServerFeatures returns the features the server advertises using server.features.
+func (c *Client) ServerFeatures(ctx context.Context, n *Node) (*ServerFeatures, error) {
+	features := new(ServerFeatures)
+	err := c.Call(ctx, n, "server.features", nil, features)
+	return features, err
+}
+
+// ServerVersion returns the server software and protocol version negotiated with the server. Every connection
+// negotiates a version with server.version when it is opened, and servers refuse to negotiate twice, so the answer
+// comes from the session rather than the server; see Session.Send.
+func (c *Client) ServerVersion(ctx context.Context, n *Node) (*ServerVersion, error) {
+	version := new(ServerVersion)
+	err := c.Call(ctx, n, "server.version", nil, version)
+	return version, err
+}
+
+// Ping checks the server is responsive using server.ping.
+func (c *Client) Ping(ctx context.Context, n *Node) error {
+	return c.Call(ctx, n, "server.ping", nil, nil)
+}
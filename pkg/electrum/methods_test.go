@@ -0,0 +1,290 @@
+package electrum
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// cannedResults are responses captured from ElectrumX, keyed by method.
+var cannedResults = map[string]string{
+	"blockchain.block.header":               `"0000002089d1e2ec2cdc0b7a7e2f4bf2e4f7e3a3bbde3b6bf2f10300000000000000000003b0a2a1c5ec1b7a9c0d9a3de9e4f6d35f5bbba3b6e0e21a8e1bc0c2f8f0e2e5b6a5a861b3a80b17c7d2b2f4"`,
+	"blockchain.block.headers":              `{"count":2,"hex":"0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a29ab5f49ffff001d1dac2b7c010000006fe28c0ab6f1b372c1a6a246ae63f74f931e8365e15a089c68d6190000000000982051fd1e4ba744bbbe680e1fee14677ba1a3c3540bf7b1cdb606e857233e0e61bc6649ffff001d01e36299","max":2016}`,
+	"blockchain.estimatefee":                `0.00012`,
+	"blockchain.relayfee":                   `0.00001`,
+	"blockchain.scripthash.get_balance":     `{"confirmed":103873966,"unconfirmed":23684400}`,
+	"blockchain.scripthash.get_history":     `[{"height":200004,"tx_hash":"acc3758bd2a26f869fcc67d48ff30b96464d476bca82c1cd6656e7d506816412"},{"height":0,"tx_hash":"9fbed79a1e970343fcd39f4a2d830a6bde6de0754ed2da70f489d0303ed558ec","fee":20000}]`,
+	"blockchain.scripthash.get_mempool":     `[{"tx_hash":"45381031132c57b2ff1cbe8d8d3920cf9ed25efd9a0beb764bdb2f24c7d1c7e3","height":0,"fee":24310}]`,
+	"blockchain.scripthash.listunspent":     `[{"tx_pos":0,"value":45318048,"tx_hash":"9f2c45a12db0144909b5db269415f7319179105982ac70ed80d76ea79d923ebf","height":437146}]`,
+	"blockchain.transaction.get_merkle":     `{"merkle":["713d6c7e6ce7bbea708d61162231eaa8ecb31c4c5dd84f81c20409a90069cb24"],"block_height":450538,"pos":710}`,
+	"blockchain.transaction.id_from_pos":    `"fc12dfcb4723715a456c6984e298e00c479e7ec9a70e6aa6cfa94c5e9b2df21e"`,
+	"blockchain.transaction.broadcast":      `"a76242fce5753b4212f903ff33ac6fe66f2780f34bdb4b33b175a7815a11a98e"`,
+	"mempool.get_fee_histogram":             `[[12,128812],[4,92524],[2,6478638]]`,
+	"server.banner":                         `"Welcome to Electrum!"`,
+	"server.donation_address":               `"bc1qzwkfqjm5yd4z4hyzq7ttwhpl5ctf0xtpv6jjpf"`,
+	"server.features":                       `{"genesis_hash":"000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f","hosts":{"electrum.blockstream.info":{"tcp_port":50001,"ssl_port":50002}},"protocol_max":"1.4","protocol_min":"1.4","pruning":null,"server_version":"ElectrumX 1.16.0","hash_function":"sha256"}`,
+	"server.version":                        `["ElectrumX 1.16.0","1.4"]`,
+	"server.ping":                           `null`,
+	"blockchain.transaction.get#false":      `"01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff0704ffff001d0104ffffffff0100f2052a0100000043410496b538e853519c726a2c91e61ec11600ae1390813a627c66fb8be7947be63c52da7589379515d4e0a604f8141781e62294721166bf621e73a82cbf2342c858eeac00000000"`,
+	"blockchain.transaction.get#true":       `{"txid":"0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098","hash":"0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098","hex":"01000000","size":134,"vsize":134,"weight":536,"version":1,"locktime":0,"blockhash":"00000000839a8e6886ab5951d76f411475428afc90947ee320161bbf18eb6048","confirmations":700000,"time":1231469665,"blocktime":1231469665}`,
+	"blockchain.block.header#proof":         `{"branch":["000000004ebadb55ee9096c9a2f8880e09da59c0d68b1c228da88e48844a1485"],"header":"010000006fe28c0a","root":"e347b1c43fd9b5415bf0d92708db8284b78daf4d0e24f9c3405f45feb85e25db"}`,
+	"blockchain.transaction.id_from_pos#pf": `{"tx_hash":"fc12dfcb4723715a456c6984e298e00c479e7ec9a70e6aa6cfa94c5e9b2df21e","merkle":["30b9e3d0e5b14f54fe2c6e6a55fbca1b3c3a0f5e0e49e1ffd2b1e6c1d9a62c0b"]}`,
+}
+
+// cannedHandler answers requests from cannedResults, telling apart the variants of methods whose result shape depends
+// on their params.
+func cannedHandler(req *testRequest) (interface{}, error) {
+	key := req.Method
+	switch {
+	case req.Method == "blockchain.transaction.get":
+		if verbose, _ := req.Params[1].(bool); verbose {
+			key += "#true"
+		} else {
+			key += "#false"
+		}
+	case req.Method == "blockchain.block.header" && len(req.Params) == 2:
+		key += "#proof"
+	case req.Method == "blockchain.transaction.id_from_pos" && req.Params[2] == true:
+		key += "#pf"
+	}
+	result, ok := cannedResults[key]
+	if !ok {
+		return nil, errors.New("unknown method")
+	}
+	return json.RawMessage(result), nil
+}
+
+func TestClient_Methods(t *testing.T) {
+	srv := newTestServer(t, cannedHandler)
+	c := newTestClient()
+	defer c.Close()
+	n := srv.node()
+
+	tests := []struct {
+		name string
+		call func(ctx context.Context) (interface{}, error)
+		want interface{}
+	}{
+		{
+			name: "GetBlockHeader",
+			call: func(ctx context.Context) (interface{}, error) { return c.GetBlockHeader(ctx, n, 700000) },
+			want: "0000002089d1e2ec2cdc0b7a7e2f4bf2e4f7e3a3bbde3b6bf2f10300000000000000000003b0a2a1c5ec1b7a9c0d9a3de9e4f6d35f5bbba3b6e0e21a8e1bc0c2f8f0e2e5b6a5a861b3a80b17c7d2b2f4",
+		},
+		{
+			name: "GetBlockHeaderWithProof",
+			call: func(ctx context.Context) (interface{}, error) { return c.GetBlockHeaderWithProof(ctx, n, 1, 2) },
+			want: &HeaderProof{
+				Branch: []string{"000000004ebadb55ee9096c9a2f8880e09da59c0d68b1c228da88e48844a1485"},
+				Header: "010000006fe28c0a",
+				Root:   "e347b1c43fd9b5415bf0d92708db8284b78daf4d0e24f9c3405f45feb85e25db",
+			},
+		},
+		{
+			name: "GetBlockHeaders",
+			call: func(ctx context.Context) (interface{}, error) { return c.GetBlockHeaders(ctx, n, 0, 2) },
+			want: &BlockHeaders{
+				Count: 2,
+				Hex:   "0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a29ab5f49ffff001d1dac2b7c010000006fe28c0ab6f1b372c1a6a246ae63f74f931e8365e15a089c68d6190000000000982051fd1e4ba744bbbe680e1fee14677ba1a3c3540bf7b1cdb606e857233e0e61bc6649ffff001d01e36299",
+				Max:   2016,
+			},
+		},
+		{
+			name: "EstimateFee",
+			call: func(ctx context.Context) (interface{}, error) { return c.EstimateFee(ctx, n, 6) },
+			want: 0.00012,
+		},
+		{
+			name: "RelayFee",
+			call: func(ctx context.Context) (interface{}, error) { return c.RelayFee(ctx, n) },
+			want: 0.00001,
+		},
+		{
+			name: "GetBalance",
+			call: func(ctx context.Context) (interface{}, error) {
+				return c.GetBalance(ctx, n, "8b01df4e368ea28f8dc0423bcf7a4923e3a12d307c875e47a0cfbf90b5c39161")
+			},
+			want: &Balance{Confirmed: 103873966, Unconfirmed: 23684400},
+		},
+		{
+			name: "GetHistory",
+			call: func(ctx context.Context) (interface{}, error) {
+				return c.GetHistory(ctx, n, "8b01df4e368ea28f8dc0423bcf7a4923e3a12d307c875e47a0cfbf90b5c39161")
+			},
+			want: []HistoryEntry{
+				{Height: 200004, TxHash: "acc3758bd2a26f869fcc67d48ff30b96464d476bca82c1cd6656e7d506816412"},
+				{Height: 0, TxHash: "9fbed79a1e970343fcd39f4a2d830a6bde6de0754ed2da70f489d0303ed558ec", Fee: 20000},
+			},
+		},
+		{
+			name: "GetMempool",
+			call: func(ctx context.Context) (interface{}, error) {
+				return c.GetMempool(ctx, n, "8b01df4e368ea28f8dc0423bcf7a4923e3a12d307c875e47a0cfbf90b5c39161")
+			},
+			want: []HistoryEntry{
+				{Height: 0, TxHash: "45381031132c57b2ff1cbe8d8d3920cf9ed25efd9a0beb764bdb2f24c7d1c7e3", Fee: 24310},
+			},
+		},
+		{
+			name: "ListUnspent",
+			call: func(ctx context.Context) (interface{}, error) {
+				return c.ListUnspent(ctx, n, "8b01df4e368ea28f8dc0423bcf7a4923e3a12d307c875e47a0cfbf90b5c39161")
+			},
+			want: []Unspent{
+				{Height: 437146, TxHash: "9f2c45a12db0144909b5db269415f7319179105982ac70ed80d76ea79d923ebf", TxPos: 0, Value: 45318048},
+			},
+		},
+		{
+			name: "GetTransaction",
+			call: func(ctx context.Context) (interface{}, error) {
+				return c.GetTransaction(ctx, n, "0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098")
+			},
+			want: "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff0704ffff001d0104ffffffff0100f2052a0100000043410496b538e853519c726a2c91e61ec11600ae1390813a627c66fb8be7947be63c52da7589379515d4e0a604f8141781e62294721166bf621e73a82cbf2342c858eeac00000000",
+		},
+		{
+			name: "GetTransactionVerbose",
+			call: func(ctx context.Context) (interface{}, error) {
+				return c.GetTransactionVerbose(ctx, n, "0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098")
+			},
+			want: &VerboseTransaction{
+				TxID:          "0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098",
+				Hash:          "0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098",
+				Hex:           "01000000",
+				Size:          134,
+				VSize:         134,
+				Weight:        536,
+				Version:       1,
+				BlockHash:     "00000000839a8e6886ab5951d76f411475428afc90947ee320161bbf18eb6048",
+				Confirmations: 700000,
+				Time:          1231469665,
+				BlockTime:     1231469665,
+			},
+		},
+		{
+			name: "GetMerkle",
+			call: func(ctx context.Context) (interface{}, error) {
+				return c.GetMerkle(ctx, n, "0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098", 450538)
+			},
+			want: &MerkleProof{
+				BlockHeight: 450538,
+				Merkle:      []string{"713d6c7e6ce7bbea708d61162231eaa8ecb31c4c5dd84f81c20409a90069cb24"},
+				Pos:         710,
+			},
+		},
+		{
+			name: "TransactionIDFromPos",
+			call: func(ctx context.Context) (interface{}, error) { return c.TransactionIDFromPos(ctx, n, 170, 1) },
+			want: "fc12dfcb4723715a456c6984e298e00c479e7ec9a70e6aa6cfa94c5e9b2df21e",
+		},
+		{
+			name: "TransactionIDFromPosWithProof",
+			call: func(ctx context.Context) (interface{}, error) { return c.TransactionIDFromPosWithProof(ctx, n, 170, 1) },
+			want: &TxIDProof{
+				TxHash: "fc12dfcb4723715a456c6984e298e00c479e7ec9a70e6aa6cfa94c5e9b2df21e",
+				Merkle: []string{"30b9e3d0e5b14f54fe2c6e6a55fbca1b3c3a0f5e0e49e1ffd2b1e6c1d9a62c0b"},
+			},
+		},
+		{
+			name: "BroadcastTransaction",
+			call: func(ctx context.Context) (interface{}, error) { return c.BroadcastTransaction(ctx, n, "0100000001") },
+			want: "a76242fce5753b4212f903ff33ac6fe66f2780f34bdb4b33b175a7815a11a98e",
+		},
+		{
+			name: "GetFeeHistogram",
+			call: func(ctx context.Context) (interface{}, error) { return c.GetFeeHistogram(ctx, n) },
+			want: []FeeHistogramEntry{{FeeRate: 12, VSize: 128812}, {FeeRate: 4, VSize: 92524}, {FeeRate: 2, VSize: 6478638}},
+		},
+		{
+			name: "ServerBanner",
+			call: func(ctx context.Context) (interface{}, error) { return c.ServerBanner(ctx, n) },
+			want: "Welcome to Electrum!",
+		},
+		{
+			name: "ServerDonationAddress",
+			call: func(ctx context.Context) (interface{}, error) { return c.ServerDonationAddress(ctx, n) },
+			want: "bc1qzwkfqjm5yd4z4hyzq7ttwhpl5ctf0xtpv6jjpf",
+		},
+		{
+			name: "ServerFeatures",
+			call: func(ctx context.Context) (interface{}, error) { return c.ServerFeatures(ctx, n) },
+			want: &ServerFeatures{
+				GenesisHash:   "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f",
+				Hosts:         map[string]HostPorts{"electrum.blockstream.info": {TCPPort: 50001, SSLPort: 50002}},
+				ProtocolMax:   "1.4",
+				ProtocolMin:   "1.4",
+				Pruning:       nil,
+				ServerVersion: "ElectrumX 1.16.0",
+				HashFunction:  "sha256",
+			},
+		},
+		{
+			name: "ServerVersion",
+			call: func(ctx context.Context) (interface{}, error) {
+				return c.ServerVersion(ctx, n)
+			},
+			want: &ServerVersion{Software: "ElectrumX 1.16.0", Protocol: "1.4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			got, err := tt.call(ctx)
+			if err != nil {
+				t.Fatalf("%s() error = %v", tt.name, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s() = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_CallError(t *testing.T) {
+	srv := newTestServer(t, cannedHandler)
+	c := newTestClient()
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	err := c.Call(ctx, srv.node(), "blockchain.nonexistent", nil, nil)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("Call() error = %v, want *RPCError", err)
+	}
+	if rpcErr.Code != 1 || rpcErr.Message != "unknown method" {
+		t.Errorf("Call() error = %+v, want code 1 message %q", rpcErr, "unknown method")
+	}
+}
+
+func TestRPCError_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want RPCError
+	}{
+		{
+			name: "error object",
+			raw:  `{"code":-32601,"message":"unknown method"}`,
+			want: RPCError{Code: -32601, Message: "unknown method"},
+		},
+		{
+			name: "bare error string",
+			raw:  `"daemon error"`,
+			want: RPCError{Message: "daemon error"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got RPCError
+			if err := json.Unmarshal([]byte(tt.raw), &got); err != nil {
+				t.Fatalf("UnmarshalJSON() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("UnmarshalJSON() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package electrum
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Network is a Bitcoin network Electrum servers serve.
+type Network struct {
+	Name string
+	// GenesisHash is the hash of the network's genesis block, which servers report in server.features.
+	GenesisHash string
+	// TCPPort and SSLPort are the default ports, used for peers that advertise a transport without a port. They are
+	// those of Electrum's DEFAULT_PORTS for the network, in electrum/constants.py, which servers follow.
+	TCPPort int
+	SSLPort int
+	// Bootstrap are well known servers to discover the network's peers from.
+	Bootstrap []Node
+}
+
+// MainNet is the Bitcoin main network.
+var MainNet = Network{
+	Name:        "mainnet",
+	GenesisHash: "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f",
+	TCPPort:     50001,
+	SSLPort:     50002,
+	Bootstrap: []Node{
+		{Host: "electrum.blockstream.info", SSLPort: 50002},
+		{Host: "electrum.emzy.de", SSLPort: 50002},
+	},
+}
+
+// TestNet is the Bitcoin test network, testnet3.
+var TestNet = Network{
+	Name:        "testnet",
+	GenesisHash: "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943",
+	TCPPort:     51001,
+	SSLPort:     51002,
+	Bootstrap: []Node{
+		{Host: "electrum.blockstream.info", SSLPort: 60002},
+		{Host: "testnet.aranguren.org", SSLPort: 51002},
+	},
+}
+
+// SigNet is the default signet. Unlike testnet, its servers use mainnet's ports.
+var SigNet = Network{
+	Name:        "signet",
+	GenesisHash: "00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6",
+	TCPPort:     50001,
+	SSLPort:     50002,
+	Bootstrap: []Node{
+		{Host: "signet-electrumx.wakiyamap.dev", SSLPort: 50002},
+	},
+}
+
+// RegTest is a regression test network. Each regtest network is private, so its only bootstrap server is a local one.
+var RegTest = Network{
+	Name:        "regtest",
+	GenesisHash: "0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206",
+	TCPPort:     51001,
+	SSLPort:     51002,
+	Bootstrap: []Node{
+		{Host: "localhost", TCPPort: 51001},
+	},
+}
+
+// Networks are the networks known by name.
+var Networks = []*Network{&MainNet, &TestNet, &SigNet, &RegTest}
+
+// ParseNetwork returns the network with the given name.
+func ParseNetwork(name string) (*Network, error) {
+	for _, n := range Networks {
+		if n.Name == name {
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown network %q", name)
+}
+
+// NetworkByGenesis returns the known network with the given genesis block hash, or nil if there is none.
+func NetworkByGenesis(hash string) *Network {
+	for _, n := range Networks {
+		if strings.EqualFold(n.GenesisHash, hash) {
+			return n
+		}
+	}
+	return nil
+}
+
+// ParseServer parses a server address in Electrum's host:port:protocol form, where the protocol is s for TLS or t for
+// TCP. The protocol defaults to s, and the port to the network's default for the protocol. IPv6 hosts are written in
+// brackets, as in [2001:db8::1]:50002:s.
+func (n *Network) ParseServer(s string) (*Node, error) {
+	addr, protocol := s, "s"
+	if i := strings.LastIndex(s, ":"); i >= 0 && !isPort(s[i+1:]) && !strings.Contains(s[i+1:], "]") {
+		addr, protocol = s[:i], s[i+1:]
+	}
+	port := n.SSLPort
+	if protocol == "t" {
+		port = n.TCPPort
+	} else if protocol != "s" {
+		return nil, fmt.Errorf("invalid protocol %q in server %q, want s or t", protocol, s)
+	}
+	host, portStr := addr, ""
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		host = addr[1 : len(addr)-1]
+	} else if strings.Contains(addr, ":") {
+		var err error
+		if host, portStr, err = net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid server %q, want host:port:protocol: %v", s, err)
+		}
+	}
+	if host == "" {
+		return nil, fmt.Errorf("invalid server %q, want host:port:protocol", s)
+	}
+	if portStr != "" {
+		p, err := strconv.Atoi(portStr)
+		if err != nil || p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("invalid port in server %q", s)
+		}
+		port = p
+	}
+	node := &Node{Host: host}
+	if protocol == "t" {
+		node.TCPPort = port
+	} else {
+		node.SSLPort = port
+	}
+	if !node.IsValid() {
+		return nil, fmt.Errorf("invalid server %q", s)
+	}
+	return node, nil
+}
+
+// isPort reports whether s could be the port of a server address: empty, for the default, or digits.
+func isPort(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// WithNetwork sets the network the client's servers serve. Peer lists are parsed with its default ports.
+func WithNetwork(n Network) ClientOption {
+	return func(c *Client) {
+		c.Network = &n
+	}
+}
+
+// network returns the client's network, MainNet if none is set.
+func (c *Client) network() *Network {
+	if c.Network == nil {
+		return &MainNet
+	}
+	return c.Network
+}
@@ -0,0 +1,91 @@
+package electrum
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseNetwork(t *testing.T) {
+	for _, want := range Networks {
+		got, err := ParseNetwork(want.Name)
+		if err != nil || got != want {
+			t.Errorf("ParseNetwork(%q) = %v, %v, want %v", want.Name, got, err, want)
+		}
+		if n := NetworkByGenesis(want.GenesisHash); n != want {
+			t.Errorf("NetworkByGenesis(%s) = %v, want %v", want.GenesisHash, n, want)
+		}
+		for _, node := range want.Bootstrap {
+			if !node.IsValid() {
+				t.Errorf("%s bootstrap server %s is invalid", want.Name, node.Host)
+			}
+		}
+	}
+	if _, err := ParseNetwork("litecoin"); err == nil {
+		t.Error("ParseNetwork(\"litecoin\") succeeded")
+	}
+	if n := NetworkByGenesis("00"); n != nil {
+		t.Errorf("NetworkByGenesis(\"00\") = %v, want nil", n)
+	}
+}
+
+func TestNetwork_ParseServer(t *testing.T) {
+	tests := []struct {
+		name    string
+		network *Network
+		s       string
+		want    *Node
+		wantErr bool
+	}{
+		{"host, port and protocol", &MainNet, "electrum.example.com:50002:s", &Node{Host: "electrum.example.com", SSLPort: 50002}, false},
+		{"tcp", &MainNet, "electrum.example.com:50001:t", &Node{Host: "electrum.example.com", TCPPort: 50001}, false},
+		{"default protocol", &MainNet, "electrum.example.com:443", &Node{Host: "electrum.example.com", SSLPort: 443}, false},
+		{"default port", &TestNet, "electrum.example.com", &Node{Host: "electrum.example.com", SSLPort: 51002}, false},
+		{"default tcp port", &RegTest, "localhost::t", &Node{Host: "localhost", TCPPort: 51001}, false},
+		{"signet default port", &SigNet, "electrum.example.com", &Node{Host: "electrum.example.com", SSLPort: 50002}, false},
+		{"ipv6", &MainNet, "[2001:db8::1]:50002", &Node{Host: "2001:db8::1", SSLPort: 50002}, false},
+		{"ipv6 with protocol", &RegTest, "[::1]:50001:t", &Node{Host: "::1", TCPPort: 50001}, false},
+		{"ipv6 default port", &MainNet, "[2001:db8::1]", &Node{Host: "2001:db8::1", SSLPort: 50002}, false},
+		{"ipv6 default tcp port", &MainNet, "[2001:db8::1]::t", &Node{Host: "2001:db8::1", TCPPort: 50001}, false},
+		{"ipv4", &MainNet, "203.0.113.7:50001:t", &Node{Host: "203.0.113.7", TCPPort: 50001}, false},
+		{"unbracketed ipv6", &MainNet, "2001:db8::1:50002", nil, true},
+		{"unknown protocol", &MainNet, "electrum.example.com:50002:x", nil, true},
+		{"invalid port", &MainNet, "electrum.example.com:http", nil, true},
+		{"port out of range", &MainNet, "electrum.example.com:70000", nil, true},
+		{"no host", &MainNet, ":50002", nil, true},
+		{"too many parts", &MainNet, "a:1:s:x", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.network.ParseServer(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseServer(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseServer(%q) = %+v, want %+v", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetwork_ParseServerDial(t *testing.T) {
+	cert, _ := newTestCert(t)
+	srv := newTestTLSServer(t, cert)
+	n, err := MainNet.ParseServer(fmt.Sprintf("127.0.0.1:%d:s", srv.ln.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !n.IsValid() || !n.SupportsTLS() {
+		t.Fatalf("%+v: IsValid() = %v, SupportsTLS() = %v, want both true", n, n.IsValid(), n.SupportsTLS())
+	}
+	c := newTestClient()
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.Ping(ctx, n); err != nil {
+		t.Errorf("Ping() error = %v", err)
+	}
+}
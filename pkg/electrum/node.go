@@ -8,12 +8,18 @@ import (
 
 // Node represents a node on the electrum network.
 type Node struct {
-	Host         string
-	IP           string
+	Host string
+	IP   string
+	// Version is the protocol version the node advertises in the peer list, replaced by the version negotiated with
+	// it once the client has connected; see RegisterVersion.
 	Version      string
 	SSLPort      int
 	TCPPort      int
 	PruningLimit int
+	// ServerSoftware is the server software the node reported in the server.version handshake.
+	ServerSoftware string
+	// Network is the name of the network the node has been verified to serve, empty until it has been.
+	Network string
 }
 
 // NewNode constructs an instance of Node.
@@ -21,9 +27,9 @@ func NewNode(host string, IP string, version string, SSLPort int, TCPPort int, P
 	return &Node{Host: host, IP: IP, Version: version, SSLPort: SSLPort, TCPPort: TCPPort, PruningLimit: PruningLimit}
 }
 
-// IsValid returns true if a peer has the minimum we need to connect.
+// IsValid returns true if a peer has the minimum we need to connect. Host may be a hostname or an IP address.
 func (n *Node) IsValid() bool {
-	return (ValidIP(n.IP) || ValidHostname(n.Host)) && (n.SSLPort > 0 || n.TCPPort > 0)
+	return (ValidIP(n.IP) || ValidHostname(n.Host) || isIPHost(n.Host)) && (n.SSLPort > 0 || n.TCPPort > 0)
 }
 
 // IsOnion returns true if this node is accessible over Tor.
@@ -31,9 +37,23 @@ func (n *Node) IsOnion() bool {
 	return IsOnionAddr(n.Host)
 }
 
-// SupportsTLS returns true if this host supports TLS.
+// SupportsTLS returns true if this host supports TLS. Hosts given as IP addresses do too, their certificates being
+// checked against the address.
 func (n *Node) SupportsTLS() bool {
-	return !ValidIP(n.Host) && ValidHostname(n.Host) && n.SSLPort > 0
+	return (ValidHostname(n.Host) || isIPHost(n.Host)) && n.SSLPort > 0
+}
+
+// isIPHost reports whether host is an IP address, which ValidHostname rejects in IPv6 form.
+func isIPHost(host string) bool {
+	return net.ParseIP(host) != nil
+}
+
+// key identifies the node for connection reuse.
+func (n *Node) key() string {
+	if n.Host != "" {
+		return n.Host
+	}
+	return n.IP
 }
 
 // Features represents features of an electrum server.
@@ -52,6 +72,12 @@ func (n *Node) RegisterFeatures(f *Features) {
 	n.PruningLimit = f.PruningLimit
 }
 
+// RegisterVersion applies the server software and protocol version negotiated with the node to it.
+func (n *Node) RegisterVersion(v *ServerVersion) {
+	n.Version = v.Protocol
+	n.ServerSoftware = v.Software
+}
+
 // IsOnionAddr checks if a hostname is a .onion address.
 func IsOnionAddr(addr string) bool {
 	return strings.HasSuffix(addr, ".onion")
@@ -23,13 +23,18 @@ type ServerPeersSubscriptionResp struct {
 }
 
 // ParseServerPeersSubscriptionResp returns a proper slice of validated peers from a ServerPeersSubscriptionResp.
+// Transports advertised without a port are given MainNet's default ports.
 func ParseServerPeersSubscriptionResp(resp *ServerPeersSubscriptionResp) ([]Node, error) {
+	return parseServerPeersSubscriptionResp(resp, &MainNet)
+}
+
+func parseServerPeersSubscriptionResp(resp *ServerPeersSubscriptionResp, network *Network) ([]Node, error) {
 	if resp.Result == nil {
 		return nil, errors.New("invalid message: response to parse contained a nil result field")
 	}
 	var peers []Node
 	for _, peer := range resp.Result {
-		p := ParsePeer(peer)
+		p := parsePeer(peer, network)
 		if p != nil {
 			peers = append(peers, *p)
 		}
@@ -41,8 +46,12 @@ func ParseServerPeersSubscriptionResp(resp *ServerPeersSubscriptionResp) ([]Node
 }
 
 // ParsePeer parses a peer from the array of peers in the response from a server.peers.subscribe request.
-// Returns nil if the peer is invalid.
+// Returns nil if the peer is invalid. Transports advertised without a port are given MainNet's default ports.
 func ParsePeer(peer []interface{}) *Node {
+	return parsePeer(peer, &MainNet)
+}
+
+func parsePeer(peer []interface{}, network *Network) *Node {
 	newPeer := new(Node)
 	if ValidPeerResponse(peer) {
 		// First element of resp. should always be an IP or an onion addr.
@@ -54,7 +63,7 @@ func ParsePeer(peer []interface{}) *Node {
 			newPeer.Host = peer[1].(string)
 		}
 		// Third element is another array of info.
-		features := ParseServerFeatures(peer[2].([]interface{}))
+		features := parseServerFeatures(peer[2].([]interface{}), network)
 		newPeer.RegisterFeatures(features)
 	}
 	if newPeer.IsValid() {
@@ -79,8 +88,13 @@ func ValidPeerResponse(peer []interface{}) bool {
 	return true
 }
 
-// ParseServerFeatures parses the third element of the response array, containing server features.
+// ParseServerFeatures parses the third element of the response array, containing server features. Transports
+// advertised without a port are given MainNet's default ports.
 func ParseServerFeatures(r []interface{}) *Features {
+	return parseServerFeatures(r, &MainNet)
+}
+
+func parseServerFeatures(r []interface{}, network *Network) *Features {
 	f := new(Features)
 
 	for _, v := range r {
@@ -95,12 +109,20 @@ func ParseServerFeatures(r []interface{}) *Features {
 			}
 			f.PruningLimit = limit
 		case 't':
+			if v.(string) == "t" {
+				f.TCPPort = network.TCPPort
+				break
+			}
 			port, err := strconv.Atoi(v.(string)[1:])
 			if err != nil || port <= 0 {
 				break
 			}
 			f.TCPPort = port
 		case 's':
+			if v.(string) == "s" {
+				f.SSLPort = network.SSLPort
+				break
+			}
 			port, err := strconv.Atoi(v.(string)[1:])
 			if err != nil || port <= 0 {
 				continue
@@ -83,6 +83,17 @@ func TestParseServerFeatures(t *testing.T) {
 				PruningLimit: 10000,
 			},
 		},
+		{
+			name: "transports without ports take the defaults",
+			args: args{
+				r: []interface{}{"v1.4", "s", "t"},
+			},
+			want: &Features{
+				Version: "v1.4",
+				SSLPort: MainNet.SSLPort,
+				TCPPort: MainNet.TCPPort,
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,387 @@
+package electrum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrPoolExhausted is returned when a new connection is needed but the pool is already at its limit.
+var ErrPoolExhausted = errors.New("connection pool exhausted")
+
+// PoolConfig configures the limits of a Pool. Zero values disable the corresponding limit.
+type PoolConfig struct {
+	// MaxConnsPerNode caps how many connections are kept open to any one node.
+	MaxConnsPerNode int
+	// MaxConns caps how many connections are kept open across all nodes.
+	MaxConns int
+	// MaxInFlightPerConn is how many requests may share a connection before another one is opened.
+	MaxInFlightPerConn int
+	// IdleTimeout closes connections that have had no requests in flight for this long.
+	IdleTimeout time.Duration
+	// MaxLifetime retires connections once they have been open this long.
+	MaxLifetime time.Duration
+	// ProbeAfter pings connections that have been quiet this long, keepalive pings included, with server.ping before
+	// reusing them.
+	ProbeAfter time.Duration
+	// ProbeTimeout bounds how long a probe waits for its pong.
+	ProbeTimeout time.Duration
+}
+
+// DefaultPoolConfig is used by clients that are not given a PoolConfig.
+// ElectrumX drops sessions that have been idle for ten minutes, so idle connections are closed well before then.
+var DefaultPoolConfig = PoolConfig{
+	MaxConnsPerNode:    4,
+	MaxConns:           256,
+	MaxInFlightPerConn: 32,
+	IdleTimeout:        5 * time.Minute,
+	MaxLifetime:        time.Hour,
+	ProbeAfter:         30 * time.Second,
+	ProbeTimeout:       5 * time.Second,
+}
+
+// DialFunc establishes a new session to a node.
+type DialFunc func(ctx context.Context, n *Node) (*Session, error)
+
+// Pool keeps multiplexed sessions open to nodes and hands them out to callers.
+type Pool struct {
+	Config PoolConfig
+
+	dial      DialFunc
+	mu        sync.Mutex
+	sessions  map[string][]*Session
+	dialing   map[string]int
+	dialDone  chan struct{}
+	probing   map[*Session]chan struct{}
+	counters  map[string]*HostStats
+	closed    bool
+	stop      chan struct{}
+	startOnce sync.Once
+}
+
+// HostStats holds pool statistics for a single node.
+type HostStats struct {
+	Open         int `json:"open"`
+	Idle         int `json:"idle"`
+	InUse        int `json:"in_use"`
+	Dials        int `json:"dials"`
+	DialFailures int `json:"dial_failures"`
+}
+
+// PoolStats is a snapshot of the pool's connections and dial history.
+type PoolStats struct {
+	HostStats
+	Hosts map[string]HostStats `json:"hosts"`
+}
+
+// NewPool creates a new pool that opens connections with dial.
+func NewPool(config PoolConfig, dial DialFunc) *Pool {
+	p := &Pool{
+		Config:   config,
+		dial:     dial,
+		sessions: make(map[string][]*Session),
+		dialing:  make(map[string]int),
+		probing:  make(map[*Session]chan struct{}),
+		counters: make(map[string]*HostStats),
+		stop:     make(chan struct{}),
+		dialDone: make(chan struct{}),
+	}
+	return p
+}
+
+// Acquire returns a session to the node. The least busy open session is reused unless it is already carrying
+// MaxInFlightPerConn requests and the limits allow another connection to be dialed.
+func (p *Pool) Acquire(ctx context.Context, n *Node) (*Session, error) {
+	p.startOnce.Do(func() { go p.reap() })
+	key := n.key()
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errors.New("connection pool closed")
+		}
+		p.prune(key)
+		best := p.leastBusy(key)
+		nodeFull, poolFull := p.full(key)
+		canDial := !nodeFull && !poolFull
+		if best != nil && (!canDial || p.Config.MaxInFlightPerConn <= 0 || best.InFlight() < p.Config.MaxInFlightPerConn) {
+			if p.Config.ProbeAfter <= 0 || best.quietFor() <= p.Config.ProbeAfter {
+				p.mu.Unlock()
+				return best, nil
+			}
+			if probed, ok := p.probing[best]; ok {
+				// Another caller is probing the session; its outcome decides whether the session is still usable.
+				p.mu.Unlock()
+				select {
+				case <-probed:
+					continue
+				case <-ctx.Done():
+					return nil, fmt.Errorf("gave up waiting for a connection to %s: %w", n.Host, ctx.Err())
+				}
+			}
+			probed := make(chan struct{})
+			p.probing[best] = probed
+			p.mu.Unlock()
+			err := p.probe(ctx, best)
+			if err != nil && ctx.Err() == nil {
+				_ = best.Close()
+			}
+			p.mu.Lock()
+			delete(p.probing, best)
+			close(probed)
+			p.mu.Unlock()
+			if err == nil {
+				return best, nil
+			}
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("gave up probing a connection to %s: %w", n.Host, ctx.Err())
+			}
+			continue
+		}
+		if !canDial {
+			// Closing other nodes' connections only helps if MaxConns is the limit in the way.
+			if !nodeFull && p.evictIdle(key) {
+				p.mu.Unlock()
+				continue
+			}
+			if (nodeFull && p.dialing[key] > 0) || (!nodeFull && p.inProgress() > 0) {
+				// Wait for a connection being dialed to come up, or fail and free its slot.
+				dialDone := p.dialDone
+				p.mu.Unlock()
+				select {
+				case <-dialDone:
+					continue
+				case <-ctx.Done():
+					return nil, fmt.Errorf("gave up waiting for a connection to %s: %w", n.Host, ctx.Err())
+				}
+			}
+			p.mu.Unlock()
+			return nil, fmt.Errorf("%w: no connection available to %s", ErrPoolExhausted, n.Host)
+		}
+		p.dialing[key]++
+		p.counter(key).Dials++
+		p.mu.Unlock()
+
+		s, err := p.dial(ctx, n)
+
+		p.mu.Lock()
+		p.dialing[key]--
+		close(p.dialDone)
+		p.dialDone = make(chan struct{})
+		if err != nil {
+			p.counter(key).DialFailures++
+			p.mu.Unlock()
+			return nil, err
+		}
+		if p.closed {
+			p.mu.Unlock()
+			_ = s.Close()
+			return nil, errors.New("connection pool closed")
+		}
+		p.sessions[key] = append(p.sessions[key], s)
+		p.mu.Unlock()
+		return s, nil
+	}
+}
+
+// probe checks that an idle session still answers before it is handed out again. The ping is sent as a keepalive, so
+// that it doesn't count as use of the session and keep it from being reaped when idle.
+func (p *Pool) probe(ctx context.Context, s *Session) error {
+	timeout := p.Config.ProbeTimeout
+	if timeout <= 0 {
+		timeout = DefaultPoolConfig.ProbeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return s.keepAlive(ctx)
+}
+
+// prune drops sessions to the node that have died, and closes idle ones that have outlived MaxLifetime.
+// Callers must hold p.mu.
+func (p *Pool) prune(key string) {
+	live := p.sessions[key][:0]
+	for _, s := range p.sessions[key] {
+		if s.Err() != nil {
+			continue
+		}
+		if p.expired(s) && s.InFlight() == 0 {
+			_ = s.Close()
+			continue
+		}
+		live = append(live, s)
+	}
+	if len(live) == 0 {
+		delete(p.sessions, key)
+		return
+	}
+	p.sessions[key] = live
+}
+
+// expired returns true if the session has been open longer than MaxLifetime.
+func (p *Pool) expired(s *Session) bool {
+	return p.Config.MaxLifetime > 0 && s.Age() > p.Config.MaxLifetime
+}
+
+// leastBusy returns the open session to the node with the fewest requests in flight, skipping sessions that have
+// outlived MaxLifetime and are only being kept until their last requests finish. Callers must hold p.mu.
+func (p *Pool) leastBusy(key string) *Session {
+	var best *Session
+	bestInFlight := 0
+	for _, s := range p.sessions[key] {
+		if p.expired(s) {
+			continue
+		}
+		inFlight := s.InFlight()
+		if best == nil || inFlight < bestInFlight {
+			best, bestInFlight = s, inFlight
+		}
+	}
+	return best
+}
+
+// full reports whether opening another connection to the node would exceed MaxConnsPerNode, and whether it would
+// exceed MaxConns. Callers must hold p.mu.
+func (p *Pool) full(key string) (nodeFull, poolFull bool) {
+	nodeFull = p.Config.MaxConnsPerNode > 0 && len(p.sessions[key])+p.dialing[key] >= p.Config.MaxConnsPerNode
+	poolFull = p.Config.MaxConns > 0 && p.total() >= p.Config.MaxConns
+	return nodeFull, poolFull
+}
+
+// total returns the number of open and dialing connections across all nodes. Callers must hold p.mu.
+func (p *Pool) total() int {
+	total := 0
+	for _, sessions := range p.sessions {
+		total += len(sessions)
+	}
+	return total + p.inProgress()
+}
+
+// inProgress returns the number of connections being dialed across all nodes. Callers must hold p.mu.
+func (p *Pool) inProgress() int {
+	total := 0
+	for _, dialing := range p.dialing {
+		total += dialing
+	}
+	return total
+}
+
+// evictIdle closes the longest idle session belonging to another node, making room under MaxConns.
+// Returns false if there was nothing to evict. Callers must hold p.mu.
+func (p *Pool) evictIdle(except string) bool {
+	var victim *Session
+	var victimKey string
+	var longest time.Duration
+	for key, sessions := range p.sessions {
+		if key == except {
+			continue
+		}
+		for _, s := range sessions {
+			if idle := s.IdleFor(); idle > longest {
+				victim, victimKey, longest = s, key, idle
+			}
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	_ = victim.Close()
+	p.prune(victimKey)
+	return true
+}
+
+// counter returns the dial counters for a node. Callers must hold p.mu.
+func (p *Pool) counter(key string) *HostStats {
+	c, ok := p.counters[key]
+	if !ok {
+		c = new(HostStats)
+		p.counters[key] = c
+	}
+	return c
+}
+
+// reap periodically closes sessions that have been idle longer than IdleTimeout or have outlived MaxLifetime.
+func (p *Pool) reap() {
+	interval := time.Minute
+	for _, d := range []time.Duration{p.Config.IdleTimeout / 2, p.Config.MaxLifetime / 2} {
+		if d > 0 && d < interval {
+			interval = d
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.reapOnce()
+		}
+	}
+}
+
+// reapOnce closes idle and expired sessions.
+func (p *Pool) reapOnce() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, sessions := range p.sessions {
+		for _, s := range sessions {
+			if p.Config.IdleTimeout > 0 && s.IdleFor() > p.Config.IdleTimeout {
+				_ = s.Close()
+			}
+		}
+		p.prune(key)
+	}
+}
+
+// Stats returns a snapshot of the pool's connections and per host dial counts.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := PoolStats{Hosts: make(map[string]HostStats)}
+	for key, c := range p.counters {
+		out.Hosts[key] = HostStats{Dials: c.Dials, DialFailures: c.DialFailures}
+	}
+	for key, sessions := range p.sessions {
+		h := out.Hosts[key]
+		for _, s := range sessions {
+			if s.Err() != nil {
+				continue
+			}
+			h.Open++
+			if s.InFlight() > 0 {
+				h.InUse++
+			} else {
+				h.Idle++
+			}
+		}
+		out.Hosts[key] = h
+	}
+	for _, h := range out.Hosts {
+		out.Open += h.Open
+		out.Idle += h.Idle
+		out.InUse += h.InUse
+		out.Dials += h.Dials
+		out.DialFailures += h.DialFailures
+	}
+	return out
+}
+
+// Close closes every session in the pool and stops reaping.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.stop)
+	for key, sessions := range p.sessions {
+		for _, s := range sessions {
+			_ = s.Close()
+		}
+		delete(p.sessions, key)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package electrum
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPool_MaxConnsPerNode(t *testing.T) {
+	srv := newTestServer(t, func(req *testRequest) (interface{}, error) {
+		time.Sleep(20 * time.Millisecond)
+		return nil, nil
+	})
+	c := newTestClient()
+	c.PoolConfig = &PoolConfig{MaxConnsPerNode: 2, MaxInFlightPerConn: 1}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := []byte(`{"jsonrpc":"2.0","method":"server.ping","params":[],"id":1}`)
+			if _, err := c.SendRequestBytes(req, srv.node(), time.Second); err != nil {
+				t.Errorf("SendRequestBytes() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := c.PoolStats()
+	if stats.Dials != 2 || stats.Open != 2 {
+		t.Errorf("PoolStats() dials = %d open = %d, want 2 and 2", stats.Dials, stats.Open)
+	}
+	if stats.Idle != 2 || stats.InUse != 0 {
+		t.Errorf("PoolStats() idle = %d in use = %d, want 2 and 0", stats.Idle, stats.InUse)
+	}
+}
+
+func TestPool_IdleTimeout(t *testing.T) {
+	srv := newTestServer(t, func(req *testRequest) (interface{}, error) {
+		return nil, nil
+	})
+	c := newTestClient()
+	c.PoolConfig = &PoolConfig{IdleTimeout: time.Millisecond}
+	defer c.Close()
+
+	s, err := c.ConnectContext(context.Background(), srv.node())
+	if err != nil {
+		t.Fatalf("ConnectContext() error = %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	c.Pool().reapOnce()
+	if s.Err() == nil {
+		t.Errorf("idle session was not closed")
+	}
+	if open := c.PoolStats().Open; open != 0 {
+		t.Errorf("PoolStats() open = %d, want 0", open)
+	}
+}
+
+func TestPool_DialFailures(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &Node{Host: "127.0.0.1", TCPPort: ln.Addr().(*net.TCPAddr).Port}
+	_ = ln.Close()
+
+	c := newTestClient()
+	defer c.Close()
+	if _, err := c.ConnectContext(context.Background(), n); err == nil {
+		t.Fatalf("ConnectContext() to closed port succeeded")
+	}
+	got := c.PoolStats().Hosts["127.0.0.1"]
+	if got.Dials != 1 || got.DialFailures != 1 {
+		t.Errorf("PoolStats() host dials = %d failures = %d, want 1 and 1", got.Dials, got.DialFailures)
+	}
+}
+
+// pipeSession returns a session to n over an in-memory connection whose other end is never read.
+func pipeSession(t *testing.T, n *Node) *Session {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { _ = server.Close() })
+	return NewSession(n, client)
+}
+
+// waitDialing waits until the pool is dialing the node.
+func waitDialing(p *Pool, n *Node) {
+	for {
+		p.mu.Lock()
+		dialing := p.dialing[n.key()]
+		p.mu.Unlock()
+		if dialing > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPool_EvictsOnlyForMaxConns(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    PoolConfig
+		wantEvict bool
+	}{
+		{"total limit", PoolConfig{MaxConns: 1}, true},
+		{"per node limit", PoolConfig{MaxConns: 2, MaxConnsPerNode: 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			defer close(release)
+			a, b := &Node{Host: "a", TCPPort: 1}, &Node{Host: "b", TCPPort: 1}
+			p := NewPool(tt.config, func(ctx context.Context, n *Node) (*Session, error) {
+				if n == b && !tt.wantEvict {
+					<-release
+				}
+				return pipeSession(t, n), nil
+			})
+			defer p.Close()
+			idle, err := p.Acquire(context.Background(), a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantEvict {
+				if _, err := p.Acquire(context.Background(), b); err != nil {
+					t.Fatalf("Acquire() error = %v, want a's idle connection evicted", err)
+				}
+				if idle.Err() == nil {
+					t.Errorf("idle connection to another node was not evicted")
+				}
+				return
+			}
+
+			// b's only connection is still being dialed, so b is at its own limit while the pool has room.
+			go func() { _, _ = p.Acquire(context.Background(), b) }()
+			waitDialing(p, b)
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			if _, err := p.Acquire(ctx, b); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Acquire() error = %v, want %v waiting for the dial", err, context.DeadlineExceeded)
+			}
+			if idle.Err() != nil {
+				t.Errorf("idle connection to another node was evicted for b's per node limit")
+			}
+		})
+	}
+}
+
+func TestPool_Probe(t *testing.T) {
+	var mu sync.Mutex
+	pings := 0
+	srv := newTestServer(t, func(req *testRequest) (interface{}, error) {
+		if req.Method == "server.ping" {
+			mu.Lock()
+			pings++
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+		}
+		return nil, nil
+	})
+	c := newTestClient()
+	c.PoolConfig = &PoolConfig{ProbeAfter: 10 * time.Millisecond, ProbeTimeout: time.Second}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	s, err := c.ConnectContext(ctx, srv.node())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	idle := s.IdleFor()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := c.ConnectContext(ctx, srv.node())
+			if err != nil {
+				t.Errorf("ConnectContext() error = %v", err)
+				return
+			}
+			if got != s {
+				t.Errorf("ConnectContext() returned another session after a successful probe")
+			}
+		}()
+	}
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if pings != 1 {
+		t.Errorf("server saw %d probes, want 1 for concurrent callers", pings)
+	}
+	if s.IdleFor() < idle {
+		t.Errorf("IdleFor() = %v after the probe, was %v; probes must not count as use", s.IdleFor(), idle)
+	}
+}
@@ -2,6 +2,7 @@ package electrum
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -16,17 +17,70 @@ type JSONRPCRequest struct {
 	Params  []interface{} `json:"params"`
 }
 
+// JSONRPCResponse represents a JSON RPC Response.
+type JSONRPCResponse struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// RPCError represents the error object of a JSON RPC Response.
+type RPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Error implements the error interface.
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("electrum error %d: %s", e.Code, e.Message)
+}
+
+// UnmarshalJSON accepts both error objects and the bare error strings some older servers send.
+func (e *RPCError) UnmarshalJSON(b []byte) error {
+	var msg string
+	if err := json.Unmarshal(b, &msg); err == nil {
+		e.Message = msg
+		return nil
+	}
+	type rpcError RPCError
+	return json.Unmarshal(b, (*rpcError)(e))
+}
+
 // NewJSONRPCRequest creates a new JSONRPCRequest
 func NewJSONRPCRequest(version string, ID int, method string, params []interface{}) *JSONRPCRequest {
 	return &JSONRPCRequest{Version: version, ID: ID, Method: method, Params: params}
 }
 
+// DefaultRequestTimeout bounds requests sent with Send, and with SendContext when the context has no deadline.
+const DefaultRequestTimeout = 5 * time.Second
+
 // Send sends the JSONRPCRequest to the specified conn.
 func (r *JSONRPCRequest) Send(conn net.Conn) ([]byte, error) {
-	err := conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	return r.SendContext(context.Background(), conn)
+}
+
+// SendContext sends the JSONRPCRequest to the specified conn, and reads the response until ctx's deadline.
+// If ctx is cancelled the conn's deadline is moved to now, which unblocks the read.
+func (r *JSONRPCRequest) SendContext(ctx context.Context, conn net.Conn) ([]byte, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultRequestTimeout)
+	}
+	err := conn.SetDeadline(deadline)
 	if err != nil {
 		return nil, err
 	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
 	reqBytes, err := json.Marshal(r)
 	if err != nil {
 		return nil, err
@@ -37,6 +91,9 @@ func (r *JSONRPCRequest) Send(conn net.Conn) ([]byte, error) {
 	}
 	resp, err := bufio.NewReader(conn).ReadBytes(byte('\n'))
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
 	return resp, err
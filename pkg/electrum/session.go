@@ -0,0 +1,362 @@
+package electrum
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sessionClosedError is ErrSessionClosed along with the reason the session closed.
+type sessionClosedError struct {
+	reason error
+}
+
+func (e *sessionClosedError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrSessionClosed, e.reason)
+}
+
+// Is matches ErrSessionClosed and the reason.
+func (e *sessionClosedError) Is(target error) bool {
+	return target == ErrSessionClosed || errors.Is(e.reason, target)
+}
+
+// ErrSessionClosed is returned when a request is sent over, or is waiting on, a session whose connection has gone away.
+var ErrSessionClosed = errors.New("electrum session closed")
+
+// Session is a long-lived connection to a node that multiplexes many in-flight requests.
+// Outgoing requests are given a session unique ID, and responses are matched back to their callers by that ID before
+// the caller's original ID is restored.
+type Session struct {
+	Node *Node
+
+	conn    net.Conn
+	writeMu sync.Mutex
+	// version is set by the handshake, before the session is shared.
+	version *ServerVersion
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]*pendingCall
+	err     error
+	done    chan struct{}
+	created time.Time
+	// lastUsed is when a request other than a keepalive was last sent or answered, and lastActive when anything was.
+	lastUsed   time.Time
+	lastActive time.Time
+	notify     func(*Notification)
+}
+
+// pendingCall is a request waiting on its response.
+type pendingCall struct {
+	ch chan []byte
+	// keepAlive marks pings sent only to keep the connection open, which don't count as use of the session.
+	keepAlive bool
+}
+
+// Notification is a message pushed by a node without being requested, such as a subscription update.
+type Notification struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// NewSession wraps an established connection to a node and starts reading responses from it.
+func NewSession(n *Node, conn net.Conn) *Session {
+	s := &Session{
+		Node:    n,
+		conn:    conn,
+		pending: make(map[uint64]*pendingCall),
+		done:    make(chan struct{}),
+		created: time.Now(),
+	}
+	s.lastUsed, s.lastActive = s.created, s.created
+	go s.readLoop()
+	return s
+}
+
+// notSentError wraps failures that happened before a request was written to the node, and so are safe to retry on a
+// fresh connection.
+type notSentError struct {
+	err error
+}
+
+func (e *notSentError) Error() string { return e.err.Error() }
+
+func (e *notSentError) Unwrap() error { return e.err }
+
+// rpcEnvelope holds the fields of a JSON RPC message needed to route it.
+type rpcEnvelope struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// SetNotificationHandler sets the function called with every notification the node pushes over the session.
+// Notifications are dropped while no handler is set. The handler is called from the session's read loop, so it must
+// not block.
+func (s *Session) SetNotificationHandler(h func(*Notification)) {
+	s.mu.Lock()
+	s.notify = h
+	s.mu.Unlock()
+}
+
+// Send writes a single JSON RPC request to the node and waits for the matching response until ctx is done.
+// The response is returned with the ID the caller used in req. Once the session has negotiated a version, server.version
+// requests are answered with it without being sent, as servers refuse to negotiate twice on one connection.
+func (s *Session) Send(ctx context.Context, req []byte) ([]byte, error) {
+	return s.send(ctx, req, false)
+}
+
+// keepAlive pings the node without counting as use of the session, so that keepalives don't stop idle sessions from
+// being reaped.
+func (s *Session) keepAlive(ctx context.Context) error {
+	req, err := newCall("server.ping", nil)
+	if err != nil {
+		return err
+	}
+	raw, err := s.send(ctx, req, true)
+	if err != nil {
+		return err
+	}
+	return decodeResult(raw, s.Node, "server.ping", nil)
+}
+
+// send is Send, with keepAlive marking the request as a keepalive.
+func (s *Session) send(ctx context.Context, req []byte, keepAlive bool) ([]byte, error) {
+	msg := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(req, &msg); err != nil {
+		return nil, fmt.Errorf("invalid JSON RPC request: %v", err)
+	}
+	origID, hasID := msg["id"]
+	if s.version != nil && string(msg["method"]) == `"server.version"` {
+		return s.versionResponse(origID, hasID)
+	}
+
+	s.mu.Lock()
+	if s.err != nil {
+		err := s.err
+		s.mu.Unlock()
+		return nil, &notSentError{err}
+	}
+	s.nextID++
+	id := s.nextID
+	ch := make(chan []byte, 1)
+	s.pending[id] = &pendingCall{ch: ch, keepAlive: keepAlive}
+	s.touch(keepAlive)
+	s.mu.Unlock()
+
+	msg["id"] = json.RawMessage(strconv.FormatUint(id, 10))
+	out, err := json.Marshal(msg)
+	if err != nil {
+		s.forget(id)
+		return nil, err
+	}
+	if err := s.write(ctx, out); err != nil {
+		s.forget(id)
+		return nil, &notSentError{err}
+	}
+
+	select {
+	case resp := <-ch:
+		return restoreID(resp, origID, hasID)
+	case <-s.done:
+		s.forget(id)
+		return nil, s.Err()
+	case <-ctx.Done():
+		s.forget(id)
+		return nil, fmt.Errorf("gave up waiting for response from %s: %w", s.Node.Host, ctx.Err())
+	}
+}
+
+// write sends a single newline delimited message to the node, giving up at ctx's deadline.
+func (s *Session) write(ctx context.Context, msg []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	if err := s.conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(append(msg, '\n'))
+	if err != nil {
+		s.fail(err)
+	}
+	return err
+}
+
+// forget removes a pending request that is no longer being waited on.
+func (s *Session) forget(id uint64) {
+	s.mu.Lock()
+	if call, ok := s.pending[id]; ok {
+		delete(s.pending, id)
+		s.touch(call.keepAlive)
+	}
+	s.mu.Unlock()
+}
+
+// touch records traffic on the session. Callers must hold s.mu.
+func (s *Session) touch(keepAlive bool) {
+	now := time.Now()
+	s.lastActive = now
+	if !keepAlive {
+		s.lastUsed = now
+	}
+}
+
+// readLoop reads newline delimited responses until the connection fails, handing each to the request waiting on it.
+func (s *Session) readLoop() {
+	r := bufio.NewReader(s.conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		var env rpcEnvelope
+		if err := json.Unmarshal(line, &env); err != nil {
+			continue
+		}
+		if env.Method != "" && (len(env.ID) == 0 || string(env.ID) == "null") {
+			s.mu.Lock()
+			notify := s.notify
+			s.mu.Unlock()
+			if notify != nil {
+				notify(&Notification{Method: env.Method, Params: env.Params})
+			}
+			continue
+		}
+		id, err := strconv.ParseUint(string(env.ID), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.mu.Lock()
+		call, ok := s.pending[id]
+		if ok {
+			delete(s.pending, id)
+			s.touch(call.keepAlive)
+		}
+		s.mu.Unlock()
+		if ok {
+			call.ch <- line
+		}
+	}
+}
+
+// fail marks the session as dead, closes the underlying connection and releases everything waiting on it.
+func (s *Session) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = &sessionClosedError{err}
+	_ = s.conn.Close()
+	s.pending = make(map[uint64]*pendingCall)
+	close(s.done)
+}
+
+// errClosedByClient is why a session closed by Close is closed.
+var errClosedByClient = errors.New("closed by client")
+
+// Close closes the session and its connection.
+func (s *Session) Close() error {
+	s.fail(errClosedByClient)
+	return nil
+}
+
+// Err returns the reason the session closed, or nil if it is still open.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// InFlight returns the number of requests waiting on a response, not counting keepalive pings.
+func (s *Session) InFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inFlight()
+}
+
+// inFlight is InFlight. Callers must hold s.mu.
+func (s *Session) inFlight() int {
+	n := 0
+	for _, call := range s.pending {
+		if !call.keepAlive {
+			n++
+		}
+	}
+	return n
+}
+
+// IdleFor returns how long the session has had no requests in flight, or zero if it is busy. Keepalive pings don't
+// count as requests.
+func (s *Session) IdleFor() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inFlight() > 0 {
+		return 0
+	}
+	return time.Since(s.lastUsed)
+}
+
+// quietFor returns how long nothing, keepalive pings included, has been sent or received on the session, or zero if
+// anything is in flight.
+func (s *Session) quietFor() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) > 0 {
+		return 0
+	}
+	return time.Since(s.lastActive)
+}
+
+// Version returns the server software and protocol version negotiated when the session was opened by a Client, or
+// nil if the session was created directly with NewSession.
+func (s *Session) Version() *ServerVersion {
+	return s.version
+}
+
+// Age returns how long ago the session's connection was established.
+func (s *Session) Age() time.Duration {
+	return time.Since(s.created)
+}
+
+// Done returns a channel that is closed when the session's connection goes away.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// versionResponse builds the response to a server.version request from the version the session negotiated.
+func (s *Session) versionResponse(id json.RawMessage, hasID bool) ([]byte, error) {
+	result, err := json.Marshal(s.version)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := json.Marshal(JSONRPCResponse{Version: "2.0", ID: id, Result: result})
+	if err != nil {
+		return nil, err
+	}
+	return restoreID(resp, id, hasID)
+}
+
+// restoreID swaps the session unique ID in a response for the ID the caller originally sent.
+func restoreID(resp []byte, origID json.RawMessage, hasID bool) ([]byte, error) {
+	msg := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(resp, &msg); err != nil {
+		return nil, fmt.Errorf("invalid JSON RPC response: %v", err)
+	}
+	if hasID {
+		msg["id"] = origID
+	} else {
+		delete(msg, "id")
+	}
+	return json.Marshal(msg)
+}
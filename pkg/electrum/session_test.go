@@ -0,0 +1,243 @@
+package electrum
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRequest is a JSON RPC request as seen by testServer.
+type testRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params []interface{}   `json:"params"`
+}
+
+// testServer is a minimal in-process Electrum server. handle is called for every request and returns the result to
+// send back, or an error which is sent as a JSON RPC error object.
+type testServer struct {
+	ln     net.Listener
+	handle func(req *testRequest) (interface{}, error)
+
+	mu    sync.Mutex
+	conns []*testConn
+}
+
+// testConn is a connection accepted by testServer.
+type testConn struct {
+	net.Conn
+	writeMu sync.Mutex
+}
+
+func (c *testConn) writeJSON(v interface{}) {
+	b, _ := json.Marshal(v)
+	c.writeMu.Lock()
+	_, _ = c.Write(append(b, '\n'))
+	c.writeMu.Unlock()
+}
+
+// testServerVersion is what test servers answer the server.version handshake with.
+var testServerVersion = []string{"ElectrumX 1.16.0", "1.4"}
+
+// newTestServer starts a test server that answers the server.version handshake itself and passes every other request
+// to handle.
+func newTestServer(t *testing.T, handle func(req *testRequest) (interface{}, error)) *testServer {
+	t.Helper()
+	return newRawTestServer(t, func(req *testRequest) (interface{}, error) {
+		if req.Method == "server.version" {
+			return testServerVersion, nil
+		}
+		return handle(req)
+	})
+}
+
+// newRawTestServer starts a test server that passes every request to handle, the handshake included.
+func newRawTestServer(t *testing.T, handle func(req *testRequest) (interface{}, error)) *testServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{ln: ln, handle: handle}
+	go s.serve()
+	t.Cleanup(s.close)
+	return s
+}
+
+// node returns a Node pointing at the server.
+func (s *testServer) node() *Node {
+	return &Node{Host: "127.0.0.1", TCPPort: s.ln.Addr().(*net.TCPAddr).Port}
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &testConn{Conn: conn}
+		s.mu.Lock()
+		s.conns = append(s.conns, c)
+		s.mu.Unlock()
+		go s.serveConn(c)
+	}
+}
+
+func (s *testServer) serveConn(conn *testConn) {
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		req := new(testRequest)
+		if err := json.Unmarshal(line, req); err != nil {
+			return
+		}
+		go func() {
+			resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+			result, err := s.handle(req)
+			if err != nil {
+				resp["error"] = map[string]interface{}{"code": 1, "message": err.Error()}
+			} else {
+				resp["result"] = result
+			}
+			conn.writeJSON(resp)
+		}()
+	}
+}
+
+// notify pushes a notification to every connected client.
+func (s *testServer) notify(method string, params ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.writeJSON(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+	}
+}
+
+// dropConns closes every connection accepted so far, leaving the listener up.
+func (s *testServer) dropConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		_ = c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testServer) close() {
+	_ = s.ln.Close()
+	s.dropConns()
+}
+
+func newTestClient() *Client {
+	l := log.New(io.Discard, "", 0)
+	return NewClient(l, l, l)
+}
+
+func TestSession_SendMultiplexed(t *testing.T) {
+	srv := newTestServer(t, func(req *testRequest) (interface{}, error) {
+		// Answer later requests first so responses arrive out of order.
+		n, _ := strconv.Atoi(req.Params[0].(string))
+		time.Sleep(time.Duration(10-n) * time.Millisecond)
+		return req.Params[0], nil
+	})
+	c := newTestClient()
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := fmt.Sprintf(`{"jsonrpc":"2.0","method":"echo","params":["%d"],"id":%d}`, i, i)
+			resp, err := c.SendRequestBytes([]byte(req), srv.node(), time.Second)
+			if err != nil {
+				t.Errorf("SendRequestBytes() error = %v", err)
+				return
+			}
+			var got struct {
+				ID     int    `json:"id"`
+				Result string `json:"result"`
+			}
+			if err := json.Unmarshal(resp, &got); err != nil {
+				t.Errorf("could not unmarshal response %s: %v", resp, err)
+				return
+			}
+			if got.ID != i || got.Result != strconv.Itoa(i) {
+				t.Errorf("SendRequestBytes() got id %d result %s, want %d", got.ID, got.Result, i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClient_SendReconnects(t *testing.T) {
+	srv := newTestServer(t, func(req *testRequest) (interface{}, error) {
+		return "pong", nil
+	})
+	c := newTestClient()
+	defer c.Close()
+	req := []byte(`{"jsonrpc":"2.0","method":"server.ping","params":[],"id":1}`)
+
+	if _, err := c.SendRequestBytes(req, srv.node(), time.Second); err != nil {
+		t.Fatalf("SendRequestBytes() error = %v", err)
+	}
+	first, _ := c.ConnectContext(context.Background(), srv.node())
+	srv.dropConns()
+	<-first.Done()
+
+	if _, err := c.SendRequestBytes(req, srv.node(), time.Second); err != nil {
+		t.Fatalf("SendRequestBytes() after dropped connection error = %v", err)
+	}
+	second, _ := c.ConnectContext(context.Background(), srv.node())
+	if first == second {
+		t.Errorf("ConnectContext() returned the dead session after reconnecting")
+	}
+}
+
+func TestSession_SendCancelled(t *testing.T) {
+	release := make(chan struct{})
+	srv := newTestServer(t, func(req *testRequest) (interface{}, error) {
+		if req.Method == "slow" {
+			<-release
+		}
+		return nil, nil
+	})
+	defer close(release)
+	c := newTestClient()
+	defer c.Close()
+	s, err := c.ConnectContext(context.Background(), srv.node())
+	if err != nil {
+		t.Fatalf("ConnectContext() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err = s.Send(ctx, []byte(`{"jsonrpc":"2.0","method":"slow","params":[],"id":1}`))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Send() error = %v, want %v", err, context.Canceled)
+	}
+	if s.InFlight() != 0 {
+		t.Errorf("InFlight() = %d after cancellation, want 0", s.InFlight())
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := s.Send(ctx, []byte(`{"jsonrpc":"2.0","method":"fast","params":[],"id":2}`)); err != nil {
+		t.Errorf("Send() after cancellation error = %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package electrum
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// DefaultTorProxy is the address of a local Tor daemon's SOCKS port.
+const DefaultTorProxy = "127.0.0.1:9050"
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socks5Version         = 0x05
+	socks5AuthNone        = 0x00
+	socks5AuthPassword    = 0x02
+	socks5AuthUnavailable = 0xff
+	socks5Connect         = 0x01
+	socks5AddrIPv4        = 0x01
+	socks5AddrDomain      = 0x03
+	socks5AddrIPv6        = 0x04
+	socks5PasswordVersion = 0x01
+)
+
+// socks5Replies describes the failure codes a SOCKS5 proxy can reply to a connect request with.
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// SOCKS5Dialer connects to addresses through a SOCKS5 proxy, such as a Tor daemon. Host names are sent to the proxy
+// unresolved, so .onion addresses and clearnet names are resolved by the proxy rather than locally.
+type SOCKS5Dialer struct {
+	// ProxyAddr is the host:port of the proxy.
+	ProxyAddr string
+	// Username and Password authenticate to the proxy. Leave them empty for proxies without authentication.
+	Username string
+	Password string
+	// IsolateStreams sends fresh random credentials with every connection. Tor keeps streams with different
+	// credentials on separate circuits, so connections can't be linked to each other by the exit or onion service.
+	// It takes precedence over Username and Password.
+	IsolateStreams bool
+	// Forward opens the connection to the proxy itself. It is a direct connection if nil.
+	Forward Dialer
+}
+
+// NewTorDialer returns a SOCKS5Dialer for a Tor daemon at proxyAddr, with stream isolation enabled.
+func NewTorDialer(proxyAddr string) *SOCKS5Dialer {
+	return &SOCKS5Dialer{ProxyAddr: proxyAddr, IsolateStreams: true}
+}
+
+// DialContext connects to addr through the proxy. Only the "tcp" networks are supported.
+func (d *SOCKS5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("socks5: unsupported network %s", network)
+	}
+	forward := d.Forward
+	if forward == nil {
+		forward = directDialer
+	}
+	conn, err := forward.DialContext(ctx, "tcp", d.ProxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: could not connect to proxy %s: %v", d.ProxyAddr, err)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultRequestTimeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	if err := d.handshake(conn, addr); err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("socks5: connecting to %s: %w", addr, ctx.Err())
+		}
+		return nil, fmt.Errorf("socks5: connecting to %s: %v", addr, err)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// credentials returns the username and password to authenticate with, if any.
+func (d *SOCKS5Dialer) credentials() (string, string, error) {
+	if !d.IsolateStreams {
+		return d.Username, d.Password, nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(b[:8]), hex.EncodeToString(b[8:]), nil
+}
+
+// handshake negotiates authentication and asks the proxy to connect to addr.
+func (d *SOCKS5Dialer) handshake(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %s", portStr)
+	}
+	username, password, err := d.credentials()
+	if err != nil {
+		return err
+	}
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("credentials too long")
+	}
+
+	method := byte(socks5AuthNone)
+	if username != "" || password != "" {
+		method = socks5AuthPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected proxy version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if method != socks5AuthPassword {
+			return errors.New("proxy requires authentication")
+		}
+		msg := []byte{socks5PasswordVersion, byte(len(username))}
+		msg = append(msg, username...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("proxy rejected credentials")
+		}
+	default:
+		return errors.New("proxy accepted none of the offered authentication methods")
+	}
+
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(append(req, socks5AddrIPv4), ip4...)
+		} else {
+			req = append(append(req, socks5AddrIPv6), ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %s too long", host)
+		}
+		req = append(append(req, socks5AddrDomain, byte(len(host))), host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// The reply is VER REP RSV ATYP BND.ADDR BND.PORT; the bound address is read and discarded.
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		if msg, ok := socks5Replies[head[1]]; ok {
+			return errors.New(msg)
+		}
+		return fmt.Errorf("proxy replied with unknown error %d", head[1])
+	}
+	var addrLen int
+	switch head[3] {
+	case socks5AddrIPv4:
+		addrLen = net.IPv4len
+	case socks5AddrIPv6:
+		addrLen = net.IPv6len
+	case socks5AddrDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		addrLen = int(l[0])
+	default:
+		return fmt.Errorf("proxy replied with unknown address type %d", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
@@ -0,0 +1,261 @@
+package electrum
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// socksConnect is a connect request seen by testSOCKS5.
+type socksConnect struct {
+	username string
+	password string
+	host     string
+	port     int
+}
+
+// testSOCKS5 is an in-process SOCKS5 proxy. Every connect request is recorded and, unless reply is set to a failure
+// code, connected to target whatever address was asked for.
+type testSOCKS5 struct {
+	ln     net.Listener
+	target string
+	reply  byte
+
+	mu       sync.Mutex
+	connects []socksConnect
+}
+
+func newTestSOCKS5(t *testing.T, target string) *testSOCKS5 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testSOCKS5{ln: ln, target: target}
+	go p.serve()
+	t.Cleanup(func() { _ = ln.Close() })
+	return p
+}
+
+func (p *testSOCKS5) requests() []socksConnect {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]socksConnect(nil), p.connects...)
+}
+
+func (p *testSOCKS5) serve() {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		go p.serveConn(conn)
+	}
+}
+
+func (p *testSOCKS5) serveConn(conn net.Conn) {
+	defer conn.Close()
+	var req socksConnect
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(socks5AuthUnavailable)
+	for _, m := range methods {
+		if m == socks5AuthNone || m == socks5AuthPassword {
+			method = m
+		}
+	}
+	_, _ = conn.Write([]byte{socks5Version, method})
+	if method == socks5AuthPassword {
+		readString := func() string {
+			l := make([]byte, 1)
+			_, _ = io.ReadFull(conn, l)
+			b := make([]byte, l[0])
+			_, _ = io.ReadFull(conn, b)
+			return string(b)
+		}
+		_, _ = io.ReadFull(conn, make([]byte, 1))
+		req.username = readString()
+		req.password = readString()
+		_, _ = conn.Write([]byte{socks5PasswordVersion, 0})
+	}
+
+	head = make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return
+	}
+	switch head[3] {
+	case socks5AddrDomain:
+		l := make([]byte, 1)
+		_, _ = io.ReadFull(conn, l)
+		b := make([]byte, l[0])
+		_, _ = io.ReadFull(conn, b)
+		req.host = string(b)
+	case socks5AddrIPv4:
+		b := make([]byte, net.IPv4len)
+		_, _ = io.ReadFull(conn, b)
+		req.host = net.IP(b).String()
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	_, _ = io.ReadFull(conn, port)
+	req.port = int(port[0])<<8 | int(port[1])
+	p.mu.Lock()
+	p.connects = append(p.connects, req)
+	p.mu.Unlock()
+
+	if p.reply != 0 {
+		_, _ = conn.Write([]byte{socks5Version, p.reply, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	upstream, err := net.Dial("tcp", p.target)
+	if err != nil {
+		_, _ = conn.Write([]byte{socks5Version, 0x05, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	_, _ = conn.Write([]byte{socks5Version, 0, 0, socks5AddrIPv4, 127, 0, 0, 1, 0, 0})
+	go func() { _, _ = io.Copy(upstream, conn) }()
+	_, _ = io.Copy(conn, upstream)
+}
+
+const testOnion = "explorerzydxu5ecjrkwceayqybizmpjjznk5izmitf2modhcusuqlid.onion"
+
+func TestClient_OnionThroughSOCKS5(t *testing.T) {
+	srv := newTestServer(t, func(req *testRequest) (interface{}, error) {
+		return "pong", nil
+	})
+	proxy := newTestSOCKS5(t, srv.ln.Addr().String())
+	l := newTestClient().InfoLogger
+	c := NewClient(l, l, l, WithTorProxy(NewTorDialer(proxy.ln.Addr().String())))
+	defer c.Close()
+
+	onion := &Node{Host: testOnion, TCPPort: 50001}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		// Unpooled sessions force a new connection each time.
+		s, err := c.OpenSession(ctx, onion)
+		if err != nil {
+			t.Fatalf("OpenSession() error = %v", err)
+		}
+		resp, err := s.Send(ctx, []byte(`{"jsonrpc":"2.0","method":"server.ping","params":[],"id":`+strconv.Itoa(i)+`}`))
+		_ = s.Close()
+		if err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+		if string(resp) == "" {
+			t.Fatalf("Send() returned an empty response")
+		}
+	}
+
+	reqs := proxy.requests()
+	if len(reqs) != 2 {
+		t.Fatalf("proxy saw %d connects, want 2", len(reqs))
+	}
+	for _, req := range reqs {
+		if req.host != testOnion || req.port != 50001 {
+			t.Errorf("proxy connect to %s:%d, want %s:50001 resolved by the proxy", req.host, req.port, testOnion)
+		}
+		if req.username == "" {
+			t.Errorf("proxy connect without credentials, want isolation credentials")
+		}
+	}
+	if reqs[0].username == reqs[1].username {
+		t.Errorf("connections shared credentials %q, want a fresh pair per connection", reqs[0].username)
+	}
+}
+
+func TestClient_OnionWithoutTor(t *testing.T) {
+	c := newTestClient()
+	defer c.Close()
+	onion := &Node{Host: testOnion, TCPPort: 50001}
+	if _, err := c.DialContext(context.Background(), onion); err != ErrTorNotConfigured {
+		t.Errorf("DialContext() error = %v, want %v", err, ErrTorNotConfigured)
+	}
+	if _, err := c.ConnectContext(context.Background(), onion); !errors.Is(err, ErrTorNotConfigured) {
+		t.Errorf("ConnectContext() error = %v, want %v", err, ErrTorNotConfigured)
+	}
+	if _, err := c.GetPeerInfoContext(context.Background(), onion, 1); !errors.Is(err, ErrTorNotConfigured) {
+		t.Errorf("GetPeerInfoContext() error = %v, want %v", err, ErrTorNotConfigured)
+	}
+}
+
+func TestSOCKS5Dialer_DialContext(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	tests := []struct {
+		name         string
+		dialer       func(proxy string) *SOCKS5Dialer
+		reply        byte
+		addr         string
+		wantErr      bool
+		wantUsername string
+	}{
+		{
+			name:   "no authentication",
+			dialer: func(proxy string) *SOCKS5Dialer { return &SOCKS5Dialer{ProxyAddr: proxy} },
+			addr:   "example.com:50001",
+		},
+		{
+			name: "static credentials",
+			dialer: func(proxy string) *SOCKS5Dialer {
+				return &SOCKS5Dialer{ProxyAddr: proxy, Username: "user", Password: "pass"}
+			},
+			addr:         "10.1.2.3:50002",
+			wantUsername: "user",
+		},
+		{
+			name:    "connection refused by proxy",
+			dialer:  func(proxy string) *SOCKS5Dialer { return &SOCKS5Dialer{ProxyAddr: proxy} },
+			reply:   0x05,
+			addr:    "example.com:50001",
+			wantErr: true,
+		},
+		{
+			name:    "proxy not listening",
+			dialer:  func(string) *SOCKS5Dialer { return &SOCKS5Dialer{ProxyAddr: "127.0.0.1:1"} },
+			addr:    "example.com:50001",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newTestSOCKS5(t, backend.Addr().String())
+			proxy.reply = tt.reply
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			conn, err := tt.dialer(proxy.ln.Addr().String()).DialContext(ctx, "tcp", tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DialContext() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			reqs := proxy.requests()
+			host, port, _ := net.SplitHostPort(tt.addr)
+			if len(reqs) != 1 || reqs[0].host != host || strconv.Itoa(reqs[0].port) != port {
+				t.Errorf("proxy connects = %+v, want one to %s", reqs, tt.addr)
+			}
+			if len(reqs) == 1 && reqs[0].username != tt.wantUsername {
+				t.Errorf("proxy username = %q, want %q", reqs[0].username, tt.wantUsername)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package electrum
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// MerkleRoot computes the merkle root of a block from the ID of a transaction in it, the merkle branch from
+// blockchain.transaction.get_merkle, and the transaction's position in the block. Hashes are hex encoded in display
+// order.
+func MerkleRoot(txid string, branch []string, pos int) (string, error) {
+	h, err := HashFromString(txid)
+	if err != nil {
+		return "", fmt.Errorf("invalid transaction ID: %v", err)
+	}
+	if len(branch) > 32 {
+		return "", fmt.Errorf("merkle branch of length %d is too long", len(branch))
+	}
+	if pos < 0 || pos >= 1<<uint(len(branch)) {
+		return "", fmt.Errorf("position %d is out of range for a merkle branch of length %d", pos, len(branch))
+	}
+	for i, s := range branch {
+		sibling, err := HashFromString(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid merkle branch hash %d: %v", i, err)
+		}
+		if pos&1 == 1 {
+			h = DoubleSHA256(append(sibling, h...))
+		} else {
+			h = DoubleSHA256(append(h, sibling...))
+		}
+		pos >>= 1
+	}
+	return HashToString(h), nil
+}
+
+// ScriptHash returns the Electrum script hash of an output script, the key the blockchain.scripthash methods take.
+func ScriptHash(script []byte) string {
+	h := sha256.Sum256(script)
+	return HashToString(h[:])
+}
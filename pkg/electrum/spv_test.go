@@ -0,0 +1,53 @@
+package electrum
+
+import (
+	"testing"
+)
+
+func TestMerkleRoot(t *testing.T) {
+	// A block of three transactions: the last is paired with itself.
+	a, b, c := DoubleSHA256([]byte("a")), DoubleSHA256([]byte("b")), DoubleSHA256([]byte("c"))
+	ab := DoubleSHA256(append(append([]byte(nil), a...), b...))
+	cc := DoubleSHA256(append(append([]byte(nil), c...), c...))
+	root := HashToString(DoubleSHA256(append(append([]byte(nil), ab...), cc...)))
+
+	tests := []struct {
+		name    string
+		txid    string
+		branch  []string
+		pos     int
+		want    string
+		wantErr bool
+	}{
+		{name: "only transaction", txid: genesisTxID, want: genesisTxID},
+		{name: "first", txid: HashToString(a), branch: []string{HashToString(b), HashToString(cc)}, pos: 0, want: root},
+		{name: "second", txid: HashToString(b), branch: []string{HashToString(a), HashToString(cc)}, pos: 1, want: root},
+		{name: "third", txid: HashToString(c), branch: []string{HashToString(c), HashToString(ab)}, pos: 2, want: root},
+		{name: "wrong position", txid: HashToString(b), branch: []string{HashToString(a), HashToString(cc)}, pos: 0},
+		{name: "position out of range", txid: HashToString(a), branch: []string{HashToString(b)}, pos: 2, wantErr: true},
+		{name: "bad hash", txid: HashToString(a), branch: []string{"00"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MerkleRoot(tt.txid, tt.branch, tt.pos)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MerkleRoot() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want != "" && got != tt.want {
+				t.Errorf("MerkleRoot() = %s, want %s", got, tt.want)
+			}
+			if tt.want == "" && !tt.wantErr && got == root {
+				t.Errorf("MerkleRoot() = %s, want anything but the block's root", got)
+			}
+		})
+	}
+}
+
+func TestScriptHash(t *testing.T) {
+	// The example from the Electrum protocol documentation: P2PKH for 1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa.
+	script := []byte{0x76, 0xa9, 0x14, 0x62, 0xe9, 0x07, 0xb1, 0x5c, 0xbf, 0x27, 0xd5, 0x42, 0x53, 0x99, 0xeb, 0xf6, 0xf0, 0xfb, 0x50, 0xeb, 0xb8, 0x8f, 0x18, 0x88, 0xac}
+	want := "8b01df4e368ea28f8dc0423bcf7a4923e3a12d307c875e47a0cfbf90b5c39161"
+	if got := ScriptHash(script); got != want {
+		t.Errorf("ScriptHash() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,458 @@
+package electrum
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// subscriptionBuffer is how many notifications a subscription holds for a slow reader before the oldest are dropped.
+	subscriptionBuffer = 16
+	// minResubscribeBackoff and maxResubscribeBackoff bound the wait between attempts to reconnect a dropped
+	// subscription session.
+	minResubscribeBackoff = time.Second
+	maxResubscribeBackoff = time.Minute
+	// maxResubscribeAttempts is how many times a dropped subscription session is redialed before its subscriptions are
+	// closed, so that their readers can move to another node.
+	maxResubscribeAttempts = 5
+)
+
+// ErrSubscriptionClosed is returned when subscribing through a client that has been closed.
+var ErrSubscriptionClosed = errors.New("electrum subscription closed")
+
+// Subscription receives the notifications a node pushes after a subscribe call.
+// If the connection to the node drops, the client reconnects and subscribes again. The result of that subscribe call is
+// delivered as a notification too, so the reader sees any change missed while disconnected. If the node can't be
+// reached again after maxResubscribeAttempts tries, the subscription is closed and Err reports why.
+type Subscription struct {
+	Method string
+	Params []interface{}
+	// Result is the result of the subscribe call that created the subscription.
+	Result json.RawMessage
+
+	key  string
+	c    chan *Notification
+	done chan struct{}
+	sub  *subscriber
+	// err is why the subscription was closed, if not by Close. It is guarded by the subscriber's lock.
+	err error
+}
+
+// Notifications returns the channel notifications are delivered on. It is closed when the subscription is.
+// If the reader falls behind, the oldest undelivered notifications are dropped.
+func (s *Subscription) Notifications() <-chan *Notification {
+	return s.c
+}
+
+// Close stops the subscription and closes its channel.
+func (s *Subscription) Close() {
+	s.sub.remove(s)
+}
+
+// Err returns why the subscription was closed: the error reconnecting to the node if the client gave up on it, or nil
+// if the subscription is still open or was closed with Close.
+func (s *Subscription) Err() error {
+	s.sub.mu.Lock()
+	defer s.sub.mu.Unlock()
+	return s.err
+}
+
+// deliver hands a notification to the subscription, dropping the oldest buffered one if the reader has fallen behind.
+// Callers must hold the subscriber's lock.
+func (s *Subscription) deliver(n *Notification) {
+	for {
+		select {
+		case s.c <- n:
+			return
+		default:
+		}
+		select {
+		case <-s.c:
+		default:
+		}
+	}
+}
+
+// subscriptionKey identifies what a subscription is for: the method, and the first param if there is one, which is
+// the script hash for blockchain.scripthash.subscribe.
+func subscriptionKey(method string, firstParam interface{}) string {
+	if firstParam == nil {
+		return method
+	}
+	b, _ := json.Marshal(firstParam)
+	return method + " " + string(b)
+}
+
+// subscriber keeps a dedicated session to a node for a client's subscriptions, and replays them after reconnecting.
+type subscriber struct {
+	client *Client
+	node   *Node
+
+	// minBackoff and maxBackoff bound the wait between reconnect attempts.
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	dialMutex sync.Mutex
+	mu        sync.Mutex
+	session   *Session
+	subs      map[string][]*Subscription
+	closed    bool
+}
+
+// Subscribe calls a subscribe method on a node and returns a Subscription delivering the notifications that follow.
+// Subscriptions to a node share one connection, kept apart from the pool so it is never reaped while idle.
+func (c *Client) Subscribe(ctx context.Context, n *Node, method string, params []interface{}) (*Subscription, error) {
+	return c.subscriber(n).subscribe(ctx, method, params)
+}
+
+// subscriber returns the client's subscriber for a node, creating it if needed.
+func (c *Client) subscriber(n *Node) *subscriber {
+	c.subscriberMutex.Lock()
+	defer c.subscriberMutex.Unlock()
+	if c.subscribers == nil {
+		c.subscribers = make(map[string]*subscriber)
+	}
+	s, ok := c.subscribers[n.key()]
+	if !ok {
+		s = &subscriber{
+			client:     c,
+			node:       n,
+			minBackoff: minResubscribeBackoff,
+			maxBackoff: maxResubscribeBackoff,
+			subs:       make(map[string][]*Subscription),
+		}
+		c.subscribers[n.key()] = s
+	}
+	return s
+}
+
+// closeSubscribers closes every subscription the client holds.
+func (c *Client) closeSubscribers() {
+	c.subscriberMutex.Lock()
+	defer c.subscriberMutex.Unlock()
+	for key, s := range c.subscribers {
+		s.close()
+		delete(c.subscribers, key)
+	}
+}
+
+func (s *subscriber) subscribe(ctx context.Context, method string, params []interface{}) (*Subscription, error) {
+	session, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var result json.RawMessage
+	if err := callSession(ctx, session, method, params, &result); err != nil {
+		return nil, err
+	}
+	var first interface{}
+	if len(params) > 0 {
+		first = params[0]
+	}
+	sub := &Subscription{
+		Method: method,
+		Params: params,
+		Result: result,
+		key:    subscriptionKey(method, first),
+		c:      make(chan *Notification, subscriptionBuffer),
+		done:   make(chan struct{}),
+		sub:    s,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrSubscriptionClosed
+	}
+	s.subs[sub.key] = append(s.subs[sub.key], sub)
+	return sub, nil
+}
+
+// connect returns the subscription session, dialing it if there is none or it has died.
+func (s *subscriber) connect(ctx context.Context) (*Session, error) {
+	s.dialMutex.Lock()
+	defer s.dialMutex.Unlock()
+	s.mu.Lock()
+	session, closed := s.session, s.closed
+	s.mu.Unlock()
+	if closed {
+		return nil, ErrSubscriptionClosed
+	}
+	if session != nil && session.Err() == nil {
+		return session, nil
+	}
+	session, err := s.client.OpenSession(ctx, s.node)
+	if err != nil {
+		return nil, err
+	}
+	session.SetNotificationHandler(s.dispatch)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = session.Close()
+		return nil, ErrSubscriptionClosed
+	}
+	s.session = session
+	s.mu.Unlock()
+	go s.watch(session)
+	return session, nil
+}
+
+// dispatch delivers a notification to the subscriptions it belongs to.
+func (s *subscriber) dispatch(n *Notification) {
+	var params []json.RawMessage
+	_ = json.Unmarshal(n.Params, &params)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var subs []*Subscription
+	if len(params) > 1 {
+		var first interface{}
+		_ = json.Unmarshal(params[0], &first)
+		subs = s.subs[subscriptionKey(n.Method, first)]
+	}
+	if len(subs) == 0 {
+		subs = s.subs[subscriptionKey(n.Method, nil)]
+	}
+	for _, sub := range subs {
+		sub.deliver(n)
+	}
+}
+
+// watch waits for a subscription session to die, then reconnects and subscribes again for as long as there are
+// subscriptions left. After maxResubscribeAttempts failed reconnects the subscriptions are closed with the last error.
+func (s *subscriber) watch(session *Session) {
+	<-session.Done()
+	backoff := s.minBackoff
+	for attempt := 1; ; attempt++ {
+		s.mu.Lock()
+		idle := s.closed || len(s.subs) == 0
+		s.mu.Unlock()
+		if idle {
+			return
+		}
+		s.client.WarningLogger.Printf("subscription connection to %s lost, reconnecting: %v\n", s.node.Host, session.Err())
+		ctx, cancel := context.WithTimeout(context.Background(), s.maxBackoff)
+		next, err := s.connect(ctx)
+		if err == nil {
+			s.resubscribe(ctx, next)
+			cancel()
+			return
+		}
+		cancel()
+		if errors.Is(err, ErrSubscriptionClosed) {
+			return
+		}
+		s.client.ErrorLogger.Printf("could not reconnect subscriptions to %s: %v\n", s.node.Host, err)
+		if attempt == maxResubscribeAttempts {
+			s.fail(fmt.Errorf("gave up reconnecting to %s after %d attempts: %w", s.node.Host, attempt, err))
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+// resubscribe repeats every subscribe call over a new session, delivering each result to the subscriptions as a
+// notification in the same shape the node would push.
+func (s *subscriber) resubscribe(ctx context.Context, session *Session) {
+	s.mu.Lock()
+	calls := make([]*Subscription, 0, len(s.subs))
+	for _, subs := range s.subs {
+		calls = append(calls, subs[0])
+	}
+	s.mu.Unlock()
+	for _, call := range calls {
+		var result json.RawMessage
+		if err := callSession(ctx, session, call.Method, call.Params, &result); err != nil {
+			s.client.ErrorLogger.Printf("could not resubscribe to %s on %s: %v\n", call.Method, s.node.Host, err)
+			continue
+		}
+		params := make([]interface{}, 0, len(call.Params)+1)
+		params = append(params, call.Params...)
+		params = append(params, result)
+		raw, err := json.Marshal(params)
+		if err != nil {
+			continue
+		}
+		n := &Notification{Method: call.Method, Params: raw}
+		s.mu.Lock()
+		for _, sub := range s.subs[call.key] {
+			sub.deliver(n)
+		}
+		s.mu.Unlock()
+	}
+	s.client.InfoLogger.Printf("resubscribed %d subscriptions on %s\n", len(calls), s.node.Host)
+}
+
+// remove drops a subscription. Once no subscriptions are left the session is closed.
+func (s *subscriber) remove(sub *Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs := s.subs[sub.key]
+	for i, v := range subs {
+		if v == sub {
+			subs = append(subs[:i], subs[i+1:]...)
+			close(sub.c)
+			close(sub.done)
+			break
+		}
+	}
+	if len(subs) > 0 {
+		s.subs[sub.key] = subs
+		return
+	}
+	delete(s.subs, sub.key)
+	if s.session == nil {
+		return
+	}
+	if len(s.subs) == 0 {
+		_ = s.session.Close()
+		s.session = nil
+		return
+	}
+	if sub.Method == "blockchain.scripthash.subscribe" {
+		go func(session *Session) {
+			ctx, cancel := context.WithTimeout(context.Background(), DefaultRequestTimeout)
+			defer cancel()
+			_ = callSession(ctx, session, "blockchain.scripthash.unsubscribe", sub.Params[:1], nil)
+		}(s.session)
+	}
+}
+
+// close closes the session and every subscription.
+func (s *subscriber) close() {
+	s.closeWith(nil)
+}
+
+// fail closes every subscription with err, and drops the subscriber from its client so that later subscriptions to
+// the node start afresh.
+func (s *subscriber) fail(err error) {
+	s.client.subscriberMutex.Lock()
+	if s.client.subscribers[s.node.key()] == s {
+		delete(s.client.subscribers, s.node.key())
+	}
+	s.client.subscriberMutex.Unlock()
+	s.closeWith(err)
+}
+
+// closeWith closes the session and every subscription, recording err as the reason.
+func (s *subscriber) closeWith(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for key, subs := range s.subs {
+		for _, sub := range subs {
+			sub.err = err
+			close(sub.c)
+			close(sub.done)
+		}
+		delete(s.subs, key)
+	}
+	if s.session != nil {
+		_ = s.session.Close()
+		s.session = nil
+	}
+}
+
+// HeaderNotification is a chain tip as reported by blockchain.headers.subscribe.
+type HeaderNotification struct {
+	Height int    `json:"height"`
+	Hex    string `json:"hex"`
+}
+
+// HeadersSubscription delivers new chain tips from blockchain.headers.subscribe.
+type HeadersSubscription struct {
+	*Subscription
+	// Tip is the chain tip when the subscription was made.
+	Tip *HeaderNotification
+	// C receives every new tip. It is closed when the subscription is.
+	C <-chan *HeaderNotification
+}
+
+// SubscribeHeaders subscribes to new chain tips using blockchain.headers.subscribe.
+func (c *Client) SubscribeHeaders(ctx context.Context, n *Node) (*HeadersSubscription, error) {
+	sub, err := c.Subscribe(ctx, n, "blockchain.headers.subscribe", nil)
+	if err != nil {
+		return nil, err
+	}
+	tip := new(HeaderNotification)
+	if err := json.Unmarshal(sub.Result, tip); err != nil {
+		sub.Close()
+		return nil, err
+	}
+	out := make(chan *HeaderNotification, subscriptionBuffer)
+	go func() {
+		defer close(out)
+		for n := range sub.Notifications() {
+			var params []*HeaderNotification
+			if err := json.Unmarshal(n.Params, &params); err != nil || len(params) == 0 {
+				continue
+			}
+			select {
+			case out <- params[len(params)-1]:
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+	return &HeadersSubscription{Subscription: sub, Tip: tip, C: out}, nil
+}
+
+// ScripthashStatus is the status of a script hash as reported by blockchain.scripthash.subscribe.
+// Status is empty if the script hash has no history.
+type ScripthashStatus struct {
+	Scripthash string
+	Status     string
+}
+
+// ScripthashSubscription delivers status changes from blockchain.scripthash.subscribe.
+type ScripthashSubscription struct {
+	*Subscription
+	// Status is the script hash's status when the subscription was made.
+	Status string
+	// C receives every status change. It is closed when the subscription is.
+	C <-chan *ScripthashStatus
+}
+
+// SubscribeScripthash subscribes to status changes of a script hash using blockchain.scripthash.subscribe.
+func (c *Client) SubscribeScripthash(ctx context.Context, n *Node, scripthash string) (*ScripthashSubscription, error) {
+	sub, err := c.Subscribe(ctx, n, "blockchain.scripthash.subscribe", []interface{}{scripthash})
+	if err != nil {
+		return nil, err
+	}
+	var status *string
+	if err := json.Unmarshal(sub.Result, &status); err != nil {
+		sub.Close()
+		return nil, err
+	}
+	out := make(chan *ScripthashStatus, subscriptionBuffer)
+	go func() {
+		defer close(out)
+		for n := range sub.Notifications() {
+			var params []*string
+			if err := json.Unmarshal(n.Params, &params); err != nil || len(params) != 2 || params[0] == nil {
+				continue
+			}
+			s := &ScripthashStatus{Scripthash: *params[0]}
+			if params[1] != nil {
+				s.Status = *params[1]
+			}
+			select {
+			case out <- s:
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+	s := &ScripthashSubscription{Subscription: sub, C: out}
+	if status != nil {
+		s.Status = *status
+	}
+	return s, nil
+}
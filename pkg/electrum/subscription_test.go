@@ -0,0 +1,144 @@
+package electrum
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// subscriptionHandler answers subscribe calls with a tip height that increases on every call, so resubscriptions are
+// distinguishable.
+func subscriptionHandler(calls *int32) func(req *testRequest) (interface{}, error) {
+	return func(req *testRequest) (interface{}, error) {
+		switch req.Method {
+		case "blockchain.headers.subscribe":
+			height := 100 + atomic.AddInt32(calls, 1)
+			return map[string]interface{}{"height": height, "hex": "00"}, nil
+		case "blockchain.scripthash.subscribe":
+			return nil, nil
+		}
+		return nil, errors.New("unknown method")
+	}
+}
+
+func receiveHeader(t *testing.T, c <-chan *HeaderNotification) *HeaderNotification {
+	t.Helper()
+	select {
+	case h, ok := <-c:
+		if !ok {
+			t.Fatalf("header channel closed")
+		}
+		return h
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for header notification")
+	}
+	return nil
+}
+
+func TestClient_SubscribeHeaders(t *testing.T) {
+	var calls int32
+	srv := newTestServer(t, subscriptionHandler(&calls))
+	c := newTestClient()
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	sub, err := c.SubscribeHeaders(ctx, srv.node())
+	if err != nil {
+		t.Fatalf("SubscribeHeaders() error = %v", err)
+	}
+	if sub.Tip.Height != 101 {
+		t.Errorf("SubscribeHeaders() tip height = %d, want 101", sub.Tip.Height)
+	}
+
+	srv.notify("blockchain.headers.subscribe", map[string]interface{}{"height": 102, "hex": "01"})
+	if got := receiveHeader(t, sub.C); got.Height != 102 || got.Hex != "01" {
+		t.Errorf("pushed header = %+v, want height 102 hex 01", got)
+	}
+
+	srv.dropConns()
+	if got := receiveHeader(t, sub.C); got.Height != 102 {
+		t.Errorf("header after resubscribing = %+v, want height 102", got)
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("subscribe calls = %d, want 2", calls)
+	}
+
+	sub.Close()
+	select {
+	case _, ok := <-sub.C:
+		if ok {
+			t.Errorf("received header after Close()")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("header channel not closed after Close()")
+	}
+}
+
+func TestClient_SubscribeScripthash(t *testing.T) {
+	var calls int32
+	srv := newTestServer(t, subscriptionHandler(&calls))
+	c := newTestClient()
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	mine, err := c.SubscribeScripthash(ctx, srv.node(), "aa")
+	if err != nil {
+		t.Fatalf("SubscribeScripthash() error = %v", err)
+	}
+	if mine.Status != "" {
+		t.Errorf("SubscribeScripthash() status = %q, want empty", mine.Status)
+	}
+	other, err := c.SubscribeScripthash(ctx, srv.node(), "bb")
+	if err != nil {
+		t.Fatalf("SubscribeScripthash() error = %v", err)
+	}
+	defer other.Close()
+
+	srv.notify("blockchain.scripthash.subscribe", "bb", "status-b")
+	srv.notify("blockchain.scripthash.subscribe", "aa", "status-a")
+	select {
+	case got := <-mine.C:
+		if got.Scripthash != "aa" || got.Status != "status-a" {
+			t.Errorf("scripthash notification = %+v, want aa status-a", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for scripthash notification")
+	}
+	mine.Close()
+}
+
+func TestClient_SubscribeHeaders_GivesUp(t *testing.T) {
+	var calls int32
+	srv := newTestServer(t, subscriptionHandler(&calls))
+	c := newTestClient()
+	defer c.Close()
+	s := c.subscriber(srv.node())
+	s.minBackoff, s.maxBackoff = time.Millisecond, 10*time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sub, err := c.SubscribeHeaders(ctx, srv.node())
+	if err != nil {
+		t.Fatalf("SubscribeHeaders() error = %v", err)
+	}
+
+	srv.close()
+	select {
+	case _, ok := <-sub.C:
+		if ok {
+			t.Fatalf("received header after the node went away")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("header channel not closed after the node went away")
+	}
+	if err := sub.Err(); err == nil || !strings.Contains(err.Error(), "gave up reconnecting") {
+		t.Errorf("Err() = %v, want the reconnect failure", err)
+	}
+	if c.subscriber(srv.node()) == s {
+		t.Errorf("client kept the failed subscriber")
+	}
+}
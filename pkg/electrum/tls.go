@@ -0,0 +1,271 @@
+package electrum
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// TLSMode selects how the certificates of TLS nodes are verified.
+type TLSMode int
+
+const (
+	// TLSTrustOnFirstUse accepts any certificate the first time a node is seen and records its fingerprint, then
+	// rejects connections presenting a different certificate. Electrum servers commonly use self-signed certificates,
+	// so this is the default.
+	TLSTrustOnFirstUse TLSMode = iota
+	// TLSVerifyCA verifies the certificate chain and host name against the system roots, or TLSPolicy.RootCAs.
+	TLSVerifyCA
+	// TLSPinned accepts only certificates matching one of TLSPolicy.Pins.
+	TLSPinned
+	// TLSInsecure accepts any certificate. Connections can be intercepted by anyone on the path.
+	TLSInsecure
+)
+
+// String implements fmt.Stringer.
+func (m TLSMode) String() string {
+	switch m {
+	case TLSTrustOnFirstUse:
+		return "tofu"
+	case TLSVerifyCA:
+		return "ca"
+	case TLSPinned:
+		return "pinned"
+	case TLSInsecure:
+		return "insecure"
+	}
+	return fmt.Sprintf("TLSMode(%d)", int(m))
+}
+
+// ParseTLSMode parses the names returned by TLSMode.String.
+func ParseTLSMode(s string) (TLSMode, error) {
+	for _, m := range []TLSMode{TLSTrustOnFirstUse, TLSVerifyCA, TLSPinned, TLSInsecure} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown TLS mode %q", s)
+}
+
+// TLSPolicy is how a node's certificate is verified.
+type TLSPolicy struct {
+	Mode TLSMode
+	// RootCAs are trusted in TLSVerifyCA mode. The system roots are used if nil.
+	RootCAs *x509.CertPool
+	// Pins are the certificates accepted in TLSPinned mode, as hex SHA-256 fingerprints of either the certificate or
+	// its subject public key info. See CertFingerprint and SPKIFingerprint.
+	Pins []string
+}
+
+// CertFingerprint returns the hex SHA-256 fingerprint of a certificate.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// SPKIFingerprint returns the hex SHA-256 fingerprint of a certificate's subject public key info, which stays the same
+// when a certificate is reissued for the same key.
+func SPKIFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint lower cases a hex fingerprint and strips the colons it is often written with.
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(fp, ":", ""))
+}
+
+// CertificateMismatchError is returned when a node presents a certificate other than the one it is pinned or known to.
+type CertificateMismatchError struct {
+	Addr string
+	// Want are the accepted fingerprints.
+	Want []string
+	// Got is the fingerprint of the certificate presented.
+	Got string
+}
+
+// Error implements the error interface.
+func (e *CertificateMismatchError) Error() string {
+	return fmt.Sprintf("certificate of %s has fingerprint %s, want %s", e.Addr, e.Got, strings.Join(e.Want, " or "))
+}
+
+// FingerprintStore records the certificate fingerprints of nodes for trust on first use.
+type FingerprintStore interface {
+	// Fingerprint returns the fingerprint recorded for addr, if any.
+	Fingerprint(addr string) (string, bool)
+	// Remember records fp as the fingerprint of addr.
+	Remember(addr, fp string) error
+}
+
+// MemoryFingerprintStore is a FingerprintStore that forgets everything when the process exits.
+type MemoryFingerprintStore struct {
+	mu           sync.Mutex
+	fingerprints map[string]string
+}
+
+// Fingerprint implements FingerprintStore.
+func (s *MemoryFingerprintStore) Fingerprint(addr string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fp, ok := s.fingerprints[addr]
+	return fp, ok
+}
+
+// Remember implements FingerprintStore.
+func (s *MemoryFingerprintStore) Remember(addr, fp string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fingerprints == nil {
+		s.fingerprints = make(map[string]string)
+	}
+	s.fingerprints[addr] = fp
+	return nil
+}
+
+// FileFingerprintStore is a FingerprintStore persisted to a JSON file mapping host:port to fingerprint.
+type FileFingerprintStore struct {
+	path string
+
+	mu           sync.Mutex
+	fingerprints map[string]string
+}
+
+// NewFileFingerprintStore loads the fingerprints stored at path. A missing file is treated as empty, and is created on
+// the first Remember.
+func NewFileFingerprintStore(path string) (*FileFingerprintStore, error) {
+	s := &FileFingerprintStore{path: path, fingerprints: make(map[string]string)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.fingerprints); err != nil {
+		return nil, fmt.Errorf("invalid fingerprint store %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Fingerprint implements FingerprintStore.
+func (s *FileFingerprintStore) Fingerprint(addr string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fp, ok := s.fingerprints[addr]
+	return fp, ok
+}
+
+// Remember implements FingerprintStore. The file is replaced atomically, so a crash can't leave it half written.
+func (s *FileFingerprintStore) Remember(addr, fp string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fingerprints[addr] = fp
+	b, err := json.MarshalIndent(s.fingerprints, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// tlsPolicy returns the verification policy for n.
+func (c *Client) tlsPolicy(n *Node) TLSPolicy {
+	if p, ok := c.NodeTLSPolicies[n.Host]; ok {
+		return p
+	}
+	return c.TLSPolicy
+}
+
+// fingerprints returns the client's fingerprint store, creating an in-memory one if none was configured.
+func (c *Client) fingerprints() FingerprintStore {
+	c.tofuMutex.Lock()
+	defer c.tofuMutex.Unlock()
+	if c.FingerprintStore == nil {
+		c.FingerprintStore = &MemoryFingerprintStore{}
+	}
+	return c.FingerprintStore
+}
+
+// tlsConfig builds the TLS configuration for connecting to addr on n.
+func (c *Client) tlsConfig(n *Node, addr string) (*tls.Config, error) {
+	p := c.tlsPolicy(n)
+	switch p.Mode {
+	case TLSVerifyCA:
+		return &tls.Config{ServerName: n.Host, RootCAs: p.RootCAs}, nil
+	case TLSInsecure:
+		return &tls.Config{ServerName: n.Host, InsecureSkipVerify: true}, nil
+	case TLSPinned:
+		if len(p.Pins) == 0 {
+			return nil, fmt.Errorf("no certificate pins configured for %s", n.Host)
+		}
+		return c.verifyLeaf(n.Host, func(cert *x509.Certificate) error {
+			got, spki := CertFingerprint(cert), SPKIFingerprint(cert)
+			for _, pin := range p.Pins {
+				if pin := normalizeFingerprint(pin); pin == got || pin == spki {
+					return nil
+				}
+			}
+			return &CertificateMismatchError{Addr: addr, Want: p.Pins, Got: got}
+		}), nil
+	case TLSTrustOnFirstUse:
+		return c.verifyLeaf(n.Host, func(cert *x509.Certificate) error {
+			return c.trustOnFirstUse(addr, CertFingerprint(cert))
+		}), nil
+	}
+	return nil, fmt.Errorf("unknown TLS mode %v", p.Mode)
+}
+
+// verifyLeaf returns a TLS configuration that skips chain verification and checks the server's leaf certificate with
+// verify instead. Rejections are logged, as they may be an interception attempt.
+func (c *Client) verifyLeaf(serverName string, verify func(cert *x509.Certificate) error) *tls.Config {
+	return &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			err := verify(state.PeerCertificates[0])
+			if err != nil {
+				c.ErrorLogger.Printf("rejecting TLS connection: %v\n", err)
+			}
+			return err
+		},
+	}
+}
+
+// trustOnFirstUse checks fp against the fingerprint recorded for addr, recording it if there is none yet.
+func (c *Client) trustOnFirstUse(addr, fp string) error {
+	store := c.fingerprints()
+	c.tofuMutex.Lock()
+	defer c.tofuMutex.Unlock()
+	known, ok := store.Fingerprint(addr)
+	if !ok {
+		c.InfoLogger.Printf("trusting certificate %s of %s on first use\n", fp, addr)
+		return store.Remember(addr, fp)
+	}
+	if normalizeFingerprint(known) != fp {
+		return &CertificateMismatchError{Addr: addr, Want: []string{known}, Got: fp}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package electrum
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCert returns a self-signed certificate for localhost.
+func newTestCert(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+// newTestTLSServer starts a test server speaking TLS with cert.
+func newTestTLSServer(t *testing.T, cert tls.Certificate) *testServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{
+		ln: tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}}),
+		handle: func(req *testRequest) (interface{}, error) {
+			if req.Method == "server.version" {
+				return testServerVersion, nil
+			}
+			return nil, nil
+		},
+	}
+	go s.serve()
+	t.Cleanup(s.close)
+	return s
+}
+
+// tlsNode returns a Node for a TLS test server.
+func tlsNode(s *testServer) *Node {
+	return &Node{Host: "localhost", SSLPort: s.ln.Addr().(*net.TCPAddr).Port}
+}
+
+func TestClient_TLSPolicy(t *testing.T) {
+	cert, parsed := newTestCert(t)
+	srv := newTestTLSServer(t, cert)
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	colons := func(fp string) string {
+		var parts []string
+		for i := 0; i < len(fp); i += 2 {
+			parts = append(parts, strings.ToUpper(fp[i:i+2]))
+		}
+		return strings.Join(parts, ":")
+	}
+
+	tests := []struct {
+		name         string
+		policy       TLSPolicy
+		wantErr      bool
+		wantMismatch bool
+	}{
+		{"trust on first use", TLSPolicy{}, false, false},
+		{"insecure", TLSPolicy{Mode: TLSInsecure}, false, false},
+		{"ca with system roots rejects self-signed", TLSPolicy{Mode: TLSVerifyCA}, true, false},
+		{"ca with configured root", TLSPolicy{Mode: TLSVerifyCA, RootCAs: pool}, false, false},
+		{"certificate pin", TLSPolicy{Mode: TLSPinned, Pins: []string{CertFingerprint(parsed)}}, false, false},
+		{"spki pin with colons", TLSPolicy{Mode: TLSPinned, Pins: []string{colons(SPKIFingerprint(parsed))}}, false, false},
+		{"wrong pin", TLSPolicy{Mode: TLSPinned, Pins: []string{strings.Repeat("00", 32)}}, true, true},
+		{"no pins", TLSPolicy{Mode: TLSPinned}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestClient().InfoLogger
+			c := NewClient(l, l, l, WithTLSPolicy(tt.policy))
+			defer c.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			conn, err := c.DialContext(ctx, tlsNode(srv))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DialContext() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if conn != nil {
+				_ = conn.Close()
+			}
+			var mismatch *CertificateMismatchError
+			if errors.As(err, &mismatch) != tt.wantMismatch {
+				t.Errorf("DialContext() error = %v, want certificate mismatch %v", err, tt.wantMismatch)
+			}
+		})
+	}
+}
+
+func TestClient_TrustOnFirstUse(t *testing.T) {
+	first, parsed := newTestCert(t)
+	srv := newTestTLSServer(t, first)
+	store, err := NewFileFingerprintStore(filepath.Join(t.TempDir(), "known_hosts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newTestClient().InfoLogger
+	c := NewClient(l, l, l, WithFingerprintStore(store))
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	addr := func(n *Node) string { return net.JoinHostPort(n.Host, strconv.Itoa(n.SSLPort)) }
+	n := tlsNode(srv)
+	for i := 0; i < 2; i++ {
+		conn, err := c.DialContext(ctx, n)
+		if err != nil {
+			t.Fatalf("DialContext() attempt %d error = %v", i, err)
+		}
+		_ = conn.Close()
+	}
+	reloaded, err := NewFileFingerprintStore(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp, ok := reloaded.Fingerprint(addr(n)); !ok || fp != CertFingerprint(parsed) {
+		t.Errorf("persisted fingerprint = %q, %v, want %s", fp, ok, CertFingerprint(parsed))
+	}
+
+	// Another server presents a different certificate for an address the first certificate is known for.
+	second, _ := newTestCert(t)
+	impostor := tlsNode(newTestTLSServer(t, second))
+	if err := store.Remember(addr(impostor), CertFingerprint(parsed)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.DialContext(ctx, impostor)
+	var mismatch *CertificateMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("DialContext() error = %v, want certificate mismatch", err)
+	}
+	if fp, _ := store.Fingerprint(addr(impostor)); fp != CertFingerprint(parsed) {
+		t.Errorf("known fingerprint replaced by %s after mismatch", fp)
+	}
+}
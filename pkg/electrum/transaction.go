@@ -0,0 +1,151 @@
+package electrum
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Transaction is a parsed Bitcoin transaction.
+type Transaction struct {
+	// TxID is the hash of the transaction without its witness data, hex encoded in display order.
+	TxID     string
+	Version  int32
+	Inputs   []TxInput
+	Outputs  []TxOutput
+	LockTime uint32
+}
+
+// TxInput is an input of a transaction. PrevTxID is hex encoded in display order.
+type TxInput struct {
+	PrevTxID  string
+	PrevIndex uint32
+	Script    []byte
+	Sequence  uint32
+	Witness   [][]byte
+}
+
+// TxOutput is an output of a transaction. Value is in satoshis.
+type TxOutput struct {
+	Value  int64
+	Script []byte
+}
+
+// HasWitness reports whether any input of the transaction carries witness data.
+func (tx *Transaction) HasWitness() bool {
+	for _, in := range tx.Inputs {
+		if len(in.Witness) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTransaction parses a hex encoded raw transaction, as returned by blockchain.transaction.get.
+func ParseTransaction(s string) (*Transaction, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transaction hex: %v", err)
+	}
+	return ParseTransactionBytes(b)
+}
+
+// ParseTransactionBytes parses a serialized transaction, in either the legacy or the segwit format. The transaction ID
+// is computed from the legacy serialization, so witness data doesn't affect it.
+func ParseTransactionBytes(b []byte) (*Transaction, error) {
+	r := &txReader{b: b}
+	tx := &Transaction{Version: int32(r.uint32())}
+	segwit := len(b) > 6 && b[4] == 0 && b[5] != 0
+	if segwit {
+		r.bytes(2)
+	}
+	// The legacy serialization is the version, the inputs and outputs, and the lock time.
+	bodyStart := r.pos
+
+	inputs := r.varInt()
+	if inputs == 0 && r.err == nil {
+		return nil, errors.New("transaction has no inputs")
+	}
+	for i := uint64(0); i < inputs && r.err == nil; i++ {
+		var in TxInput
+		in.PrevTxID = HashToString(r.bytes(32))
+		in.PrevIndex = r.uint32()
+		in.Script = r.bytes(r.varInt())
+		in.Sequence = r.uint32()
+		tx.Inputs = append(tx.Inputs, in)
+	}
+	outputs := r.varInt()
+	for i := uint64(0); i < outputs && r.err == nil; i++ {
+		var out TxOutput
+		out.Value = int64(binary.LittleEndian.Uint64(r.bytes(8)))
+		out.Script = r.bytes(r.varInt())
+		tx.Outputs = append(tx.Outputs, out)
+	}
+	bodyEnd := r.pos
+
+	if segwit {
+		for i := range tx.Inputs {
+			items := r.varInt()
+			for j := uint64(0); j < items && r.err == nil; j++ {
+				tx.Inputs[i].Witness = append(tx.Inputs[i].Witness, r.bytes(r.varInt()))
+			}
+		}
+	}
+	tx.LockTime = r.uint32()
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid transaction: %v", r.err)
+	}
+	if r.pos != len(b) {
+		return nil, fmt.Errorf("invalid transaction: %d trailing bytes", len(b)-r.pos)
+	}
+
+	legacy := make([]byte, 0, 8+bodyEnd-bodyStart)
+	legacy = append(legacy, b[:4]...)
+	legacy = append(legacy, b[bodyStart:bodyEnd]...)
+	legacy = append(legacy, b[len(b)-4:]...)
+	tx.TxID = HashToString(DoubleSHA256(legacy))
+	return tx, nil
+}
+
+// txReader reads the fields of a serialized transaction, remembering the first error so that it can be checked once.
+// After an error every read returns zero values.
+type txReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+// bytes returns the next n bytes. After an error it returns zeroes, enough of them for the fixed size fields but no
+// more, so that a malformed length can't make it allocate without limit.
+func (r *txReader) bytes(n uint64) []byte {
+	if r.err == nil && n > uint64(len(r.b)-r.pos) {
+		r.err = fmt.Errorf("unexpected end of data at byte %d", r.pos)
+	}
+	if r.err != nil {
+		if n > 32 {
+			n = 32
+		}
+		return make([]byte, n)
+	}
+	out := r.b[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return out
+}
+
+func (r *txReader) uint32() uint32 {
+	return binary.LittleEndian.Uint32(r.bytes(4))
+}
+
+func (r *txReader) varInt() uint64 {
+	switch prefix := r.bytes(1)[0]; prefix {
+	case 0xfd:
+		return uint64(binary.LittleEndian.Uint16(r.bytes(2)))
+	case 0xfe:
+		return uint64(binary.LittleEndian.Uint32(r.bytes(4)))
+	case 0xff:
+		return binary.LittleEndian.Uint64(r.bytes(8))
+	default:
+		return uint64(prefix)
+	}
+}
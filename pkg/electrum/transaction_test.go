@@ -0,0 +1,62 @@
+package electrum
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+const (
+	// genesisTxHex is the coinbase transaction of the genesis block.
+	genesisTxHex = "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d04ffff001d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000"
+	genesisTxID  = "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b"
+)
+
+// withWitness returns the genesis coinbase in the segwit format, with a two item witness on its input.
+func withWitness() string {
+	b, _ := hex.DecodeString(genesisTxHex)
+	outputsEnd := len(b) - 4
+	var out []byte
+	out = append(out, b[:4]...)
+	out = append(out, 0x00, 0x01)
+	out = append(out, b[4:outputsEnd]...)
+	out = append(out, 0x02, 0x03, 0xaa, 0xbb, 0xcc, 0x00)
+	out = append(out, b[outputsEnd:]...)
+	return hex.EncodeToString(out)
+}
+
+func TestParseTransaction(t *testing.T) {
+	tests := []struct {
+		name        string
+		hex         string
+		wantTxID    string
+		wantWitness bool
+		wantErr     bool
+	}{
+		{name: "legacy", hex: genesisTxHex, wantTxID: genesisTxID},
+		{name: "segwit", hex: withWitness(), wantTxID: genesisTxID, wantWitness: true},
+		{name: "truncated", hex: genesisTxHex[:120], wantErr: true},
+		{name: "trailing bytes", hex: genesisTxHex + "00", wantErr: true},
+		{name: "not hex", hex: "zz", wantErr: true},
+		{name: "huge length", hex: "0100000001" + "00ff" + "ffffffffffffffff", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx, err := ParseTransaction(tt.hex)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTransaction() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tx.TxID != tt.wantTxID {
+				t.Errorf("TxID = %s, want %s", tx.TxID, tt.wantTxID)
+			}
+			if tx.HasWitness() != tt.wantWitness {
+				t.Errorf("HasWitness() = %v, want %v", tx.HasWitness(), tt.wantWitness)
+			}
+			if len(tx.Inputs) != 1 || len(tx.Outputs) != 1 || tx.Outputs[0].Value != 5000000000 || tx.Version != 1 {
+				t.Errorf("ParseTransaction() = %+v, want one input and one 50 BTC output", tx)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package electrum
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TransportPolicy selects which transports Dial uses to reach a node.
+type TransportPolicy int
+
+const (
+	// TransportPreferTLS connects with TLS when the node offers it, and falls back to plain TCP if the TLS connection
+	// can't be made. It never falls back when the node's certificate was rejected, as that may be an interception
+	// attempt trying to force a downgrade.
+	TransportPreferTLS TransportPolicy = iota
+	// TransportTLSOnly only connects with TLS.
+	TransportTLSOnly
+	// TransportTCPOnly only connects with plain TCP.
+	TransportTCPOnly
+	// TransportTorOnly connects to every node through the client's OnionDialer, clearnet nodes included, preferring
+	// TLS as TransportPreferTLS does.
+	TransportTorOnly
+)
+
+// String implements fmt.Stringer.
+func (p TransportPolicy) String() string {
+	switch p {
+	case TransportPreferTLS:
+		return "prefer-tls"
+	case TransportTLSOnly:
+		return "tls-only"
+	case TransportTCPOnly:
+		return "tcp-only"
+	case TransportTorOnly:
+		return "tor-only"
+	}
+	return fmt.Sprintf("TransportPolicy(%d)", int(p))
+}
+
+// ParseTransportPolicy parses the names returned by TransportPolicy.String.
+func ParseTransportPolicy(s string) (TransportPolicy, error) {
+	for _, p := range []TransportPolicy{TransportPreferTLS, TransportTLSOnly, TransportTCPOnly, TransportTorOnly} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown transport policy %q", s)
+}
+
+// Transports a connection can be attempted over.
+const (
+	TransportTLS = "tls"
+	TransportTCP = "tcp"
+)
+
+// TransportAttempt is a failed attempt to connect to a node over one transport.
+type TransportAttempt struct {
+	Transport string
+	Err       error
+}
+
+// ConnectError is returned when no transport allowed by the client's policy could connect to a node.
+type ConnectError struct {
+	Host     string
+	Policy   TransportPolicy
+	Attempts []TransportAttempt
+}
+
+// Error implements the error interface.
+func (e *ConnectError) Error() string {
+	if len(e.Attempts) == 0 {
+		return fmt.Sprintf("could not connect to %s: no transport allowed by %s policy is offered", e.Host, e.Policy)
+	}
+	attempts := make([]string, len(e.Attempts))
+	for i, a := range e.Attempts {
+		attempts[i] = fmt.Sprintf("%s: %v", a.Transport, a.Err)
+	}
+	return fmt.Sprintf("could not connect to %s with %s policy: %s", e.Host, e.Policy, strings.Join(attempts, "; "))
+}
+
+// Unwrap returns the error of the last attempt.
+func (e *ConnectError) Unwrap() error {
+	if len(e.Attempts) == 0 {
+		return nil
+	}
+	return e.Attempts[len(e.Attempts)-1].Err
+}
+
+// transports returns the transports to try for n, in order.
+func (c *Client) transports(n *Node) []string {
+	switch c.Transport {
+	case TransportTLSOnly:
+		return []string{TransportTLS}
+	case TransportTCPOnly:
+		return []string{TransportTCP}
+	}
+	var out []string
+	if n.SupportsTLS() {
+		out = append(out, TransportTLS)
+	}
+	if n.TCPPort > 0 {
+		out = append(out, TransportTCP)
+	}
+	return out
+}
+
+// certificateRejected reports whether err is a TLS failure caused by the node's certificate, rather than by the
+// connection.
+func certificateRejected(err error) bool {
+	var mismatch *CertificateMismatchError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &mismatch) || errors.As(err, &unknownAuthority) || errors.As(err, &hostname) ||
+		errors.As(err, &invalid)
+}
@@ -0,0 +1,152 @@
+package electrum
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// closedPort returns a local port nothing is listening on.
+func closedPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	_ = ln.Close()
+	return port
+}
+
+func TestClient_ConnectTransportPolicy(t *testing.T) {
+	tcp := newTestServer(t, func(req *testRequest) (interface{}, error) {
+		return nil, nil
+	})
+	cert, _ := newTestCert(t)
+	tlsSrv := newTestTLSServer(t, cert)
+	tcpPort := tcp.ln.Addr().(*net.TCPAddr).Port
+	tlsPort := tlsSrv.ln.Addr().(*net.TCPAddr).Port
+
+	tests := []struct {
+		name         string
+		policy       TransportPolicy
+		tls          TLSPolicy
+		node         *Node
+		wantTLS      bool
+		wantAttempts []string
+	}{
+		{
+			name:    "prefer tls uses tls",
+			node:    &Node{Host: "localhost", SSLPort: tlsPort, TCPPort: tcpPort},
+			wantTLS: true,
+		},
+		{
+			name: "prefer tls falls back to tcp",
+			node: &Node{Host: "localhost", SSLPort: closedPort(t), TCPPort: tcpPort},
+		},
+		{
+			name:         "prefer tls does not fall back on rejected certificate",
+			tls:          TLSPolicy{Mode: TLSPinned, Pins: []string{strings.Repeat("00", 32)}},
+			node:         &Node{Host: "localhost", SSLPort: tlsPort, TCPPort: tcpPort},
+			wantAttempts: []string{TransportTLS},
+		},
+		{
+			name:         "prefer tls reports every attempt",
+			node:         &Node{Host: "localhost", SSLPort: closedPort(t), TCPPort: closedPort(t)},
+			wantAttempts: []string{TransportTLS, TransportTCP},
+		},
+		{
+			name:         "prefer tls with no usable port",
+			node:         &Node{Host: "localhost"},
+			wantAttempts: []string{},
+		},
+		{
+			name:         "tls only does not fall back",
+			policy:       TransportTLSOnly,
+			node:         &Node{Host: "localhost", SSLPort: closedPort(t), TCPPort: tcpPort},
+			wantAttempts: []string{TransportTLS},
+		},
+		{
+			name:   "tcp only skips tls",
+			policy: TransportTCPOnly,
+			node:   &Node{Host: "localhost", SSLPort: tlsPort, TCPPort: tcpPort},
+		},
+		{
+			name:         "tcp only without tcp port",
+			policy:       TransportTCPOnly,
+			node:         &Node{Host: "localhost", SSLPort: tlsPort},
+			wantAttempts: []string{TransportTCP},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestClient().InfoLogger
+			c := NewClient(l, l, l, WithTransportPolicy(tt.policy), WithTLSPolicy(tt.tls))
+			defer c.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			conn, err := c.DialContext(ctx, tt.node)
+			if tt.wantAttempts != nil {
+				var connErr *ConnectError
+				if !errors.As(err, &connErr) {
+					t.Fatalf("DialContext() error = %v, want *ConnectError", err)
+				}
+				got := []string{}
+				for _, a := range connErr.Attempts {
+					got = append(got, a.Transport)
+				}
+				if !reflect.DeepEqual(got, tt.wantAttempts) {
+					t.Errorf("attempts = %v, want %v", got, tt.wantAttempts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DialContext() error = %v", err)
+			}
+			defer conn.Close()
+			if _, isTLS := conn.(interface{ ConnectionState() tls.ConnectionState }); isTLS != tt.wantTLS {
+				t.Errorf("connection is TLS = %v, want %v", isTLS, tt.wantTLS)
+			}
+		})
+	}
+}
+
+func TestClient_ConnectTorOnly(t *testing.T) {
+	srv := newTestServer(t, func(req *testRequest) (interface{}, error) {
+		return nil, nil
+	})
+	n := &Node{Host: "electrum.example.com", TCPPort: 50001}
+	l := newTestClient().InfoLogger
+
+	c := NewClient(l, l, l, WithTransportPolicy(TransportTorOnly))
+	if _, err := c.DialContext(context.Background(), n); err != ErrTorNotConfigured {
+		t.Errorf("DialContext() without tor error = %v, want %v", err, ErrTorNotConfigured)
+	}
+	_ = c.Close()
+
+	var mu sync.Mutex
+	var dialed []string
+	tor := DialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+		var d net.Dialer
+		return d.DialContext(ctx, network, srv.ln.Addr().String())
+	})
+	c = NewClient(l, l, l, WithTransportPolicy(TransportTorOnly), WithOnionDialer(tor))
+	defer c.Close()
+	conn, err := c.DialContext(context.Background(), n)
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	_ = conn.Close()
+	if want := []string{"electrum.example.com:50001"}; !reflect.DeepEqual(dialed, want) {
+		t.Errorf("tor dials = %v, want %v", dialed, want)
+	}
+}
@@ -0,0 +1,272 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// Candidate is a peer a Balancer may pick, along with what the relay knows about it.
+type Candidate struct {
+	Node   *electrum.Node
+	Health PeerHealth
+	// Outstanding is how many forwarded requests the relay is waiting on the peer to answer.
+	Outstanding int
+}
+
+// Balancer chooses which peer a request is forwarded to.
+type Balancer interface {
+	// Pick returns the index of the chosen candidate. candidates is never empty and is in the order the peers were
+	// registered. key identifies the client the request came from, and is empty when there is none.
+	Pick(candidates []Candidate, key string) int
+}
+
+// Option configures optional behaviour of a Relay.
+type Option func(*Relay)
+
+// WithBalancer sets the strategy used to choose peers. WeightedRandomBalancer is used otherwise.
+func WithBalancer(b Balancer) Option {
+	return func(r *Relay) {
+		r.Balancer = b
+	}
+}
+
+// Balancer names accepted by ParseBalancer.
+const (
+	BalancerWeightedRandom   = "weighted-random"
+	BalancerRoundRobin       = "round-robin"
+	BalancerLeastOutstanding = "least-outstanding"
+	BalancerPowerOfTwo       = "power-of-two"
+	BalancerConsistentHash   = "consistent-hash"
+)
+
+// ParseBalancer returns a new balancer of the strategy with the given name.
+func ParseBalancer(name string) (Balancer, error) {
+	switch name {
+	case BalancerWeightedRandom:
+		return WeightedRandomBalancer{}, nil
+	case BalancerRoundRobin:
+		return &RoundRobinBalancer{}, nil
+	case BalancerLeastOutstanding:
+		return LeastOutstandingBalancer{}, nil
+	case BalancerPowerOfTwo:
+		return PowerOfTwoBalancer{}, nil
+	case BalancerConsistentHash:
+		return ConsistentHashBalancer{}, nil
+	}
+	return nil, fmt.Errorf("unknown balancer %q", name)
+}
+
+// WeightedRandomBalancer picks peers at random, weighted by their health score.
+type WeightedRandomBalancer struct{}
+
+// minScore is the weight given to peers whose score is lower, so that every peer keeps a small share of traffic and its
+// score can recover.
+const minScore = 0.01
+
+// Pick implements Balancer.
+func (WeightedRandomBalancer) Pick(candidates []Candidate, _ string) int {
+	total := 0.0
+	for _, c := range candidates {
+		total += math.Max(c.Health.Score, minScore)
+	}
+	pick := rand.Float64() * total
+	for i, c := range candidates {
+		score := math.Max(c.Health.Score, minScore)
+		if pick < score {
+			return i
+		}
+		pick -= score
+	}
+	return len(candidates) - 1
+}
+
+// RoundRobinBalancer picks peers in turn. It must not be copied after first use.
+type RoundRobinBalancer struct {
+	next uint64
+}
+
+// Pick implements Balancer.
+func (b *RoundRobinBalancer) Pick(candidates []Candidate, _ string) int {
+	n := atomic.AddUint64(&b.next, 1) - 1
+	return int(n % uint64(len(candidates)))
+}
+
+// LeastOutstandingBalancer picks the peer with the fewest requests in flight, breaking ties at random.
+type LeastOutstandingBalancer struct{}
+
+// Pick implements Balancer.
+func (LeastOutstandingBalancer) Pick(candidates []Candidate, _ string) int {
+	best, ties := 0, 0
+	for i, c := range candidates {
+		switch {
+		case c.Outstanding < candidates[best].Outstanding:
+			best, ties = i, 1
+		case c.Outstanding == candidates[best].Outstanding:
+			// Reservoir sampling keeps each tied peer equally likely.
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+	return best
+}
+
+// PowerOfTwoBalancer picks two peers at random and takes the one with the lower average latency. Peers with no latency
+// measured yet are preferred, so that they get measured.
+type PowerOfTwoBalancer struct{}
+
+// Pick implements Balancer.
+func (PowerOfTwoBalancer) Pick(candidates []Candidate, _ string) int {
+	if len(candidates) == 1 {
+		return 0
+	}
+	a := rand.Intn(len(candidates))
+	b := rand.Intn(len(candidates) - 1)
+	if b >= a {
+		b++
+	}
+	if candidates[b].Health.Latency < candidates[a].Health.Latency {
+		return b
+	}
+	return a
+}
+
+// ConsistentHashBalancer sends every request from the same client to the same peer for as long as that peer is
+// available, so that server-side caches stay warm and clients see a consistent view of the chain. It uses rendezvous
+// hashing: when a peer is added or removed only the clients mapped to it move. Requests without a client key are
+// spread at random.
+type ConsistentHashBalancer struct{}
+
+// Pick implements Balancer.
+func (ConsistentHashBalancer) Pick(candidates []Candidate, key string) int {
+	if key == "" {
+		return rand.Intn(len(candidates))
+	}
+	best, bestWeight := 0, uint64(0)
+	for i, c := range candidates {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(c.Node.Host))
+		if w := h.Sum64(); i == 0 || w > bestWeight {
+			best, bestWeight = i, w
+		}
+	}
+	return best
+}
+
+type clientKeyContextKey struct{}
+
+// WithClientKey returns a context carrying key as the identity of the client a request is made for, used by balancers
+// that pin clients to peers.
+func WithClientKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, clientKeyContextKey{}, key)
+}
+
+// ClientKey returns the client key carried by ctx, or an empty string if there is none.
+func ClientKey(ctx context.Context) string {
+	key, _ := ctx.Value(clientKeyContextKey{}).(string)
+	return key
+}
+
+// remoteHost returns the client key for an HTTP request: the remote address without its port.
+func remoteHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// balancer returns the relay's balancer.
+func (r *Relay) balancer() Balancer {
+	if r.Balancer == nil {
+		return WeightedRandomBalancer{}
+	}
+	return r.Balancer
+}
+
+// outstanding counts the requests in flight to each peer, by host.
+type outstanding struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (o *outstanding) get(host string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.counts[host]
+}
+
+func (o *outstanding) add(host string, delta int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.counts == nil {
+		o.counts = make(map[string]int)
+	}
+	o.counts[host] += delta
+	if o.counts[host] <= 0 {
+		delete(o.counts, host)
+	}
+}
+
+// pick chooses one of peers with the relay's balancer, or returns nil if there are none. Peers whose circuit breaker is
+// open are left out. So are unhealthy peers, unless every peer is unhealthy, since trying a peer believed to be down
+// beats refusing the request outright.
+func (r *Relay) pick(peers []electrum.Node, key string) *electrum.Node {
+	health := r.Health()
+	all := make([]Candidate, 0, len(peers))
+	healthy := make([]Candidate, 0, len(peers))
+	for i := range peers {
+		if !r.breakerAvailable(peers[i].Host) {
+			continue
+		}
+		c := Candidate{Node: &peers[i], Health: health.Peer(peers[i].Host), Outstanding: r.outstanding.get(peers[i].Host)}
+		all = append(all, c)
+		if c.Health.Healthy {
+			healthy = append(healthy, c)
+		}
+	}
+	candidates := healthy
+	if len(candidates) == 0 {
+		candidates = all
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	i := r.balancer().Pick(candidates, key)
+	if i < 0 || i >= len(candidates) {
+		i = 0
+	}
+	return candidates[i].Node
+}
+
+// send forwards req to n if its circuit breaker allows it, keeping count of the requests outstanding to it, reporting
+// the outcome to the health checker and the breaker, and sampling the response time for hedging.
+func (r *Relay) send(ctx context.Context, n *electrum.Node, req []byte) ([]byte, error) {
+	if !r.breakerAllow(n.Host) {
+		return nil, ErrCircuitOpen
+	}
+	r.outstanding.add(n.Host, 1)
+	defer r.outstanding.add(n.Host, -1)
+	start := time.Now()
+	resp, err := r.ElectrumClient.SendRequestBytesContext(ctx, req, n)
+	latency := time.Since(start)
+	r.Health().Observe(n, latency, err)
+	r.breakerRecord(n.Host, err)
+	if err == nil {
+		r.latencies.add(latency)
+	}
+	return resp, err
+}
@@ -0,0 +1,140 @@
+package relay
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// candidates returns a candidate for each host, in order.
+func candidates(hosts ...string) []Candidate {
+	out := make([]Candidate, len(hosts))
+	for i, h := range hosts {
+		out[i] = Candidate{Node: &electrum.Node{Host: h}, Health: PeerHealth{Host: h, Healthy: true, Score: neutralScore}}
+	}
+	return out
+}
+
+func TestParseBalancer(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Balancer
+		wantErr bool
+	}{
+		{BalancerWeightedRandom, WeightedRandomBalancer{}, false},
+		{BalancerRoundRobin, &RoundRobinBalancer{}, false},
+		{BalancerLeastOutstanding, LeastOutstandingBalancer{}, false},
+		{BalancerPowerOfTwo, PowerOfTwoBalancer{}, false},
+		{BalancerConsistentHash, ConsistentHashBalancer{}, false},
+		{"random", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseBalancer(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseBalancer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseBalancer() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeightedRandomBalancer(t *testing.T) {
+	c := candidates("a", "b", "c")
+	c[0].Health.Score = 0
+	c[1].Health.Score = 1
+	c[2].Health.Score = 0
+	counts := make([]int, len(c))
+	for i := 0; i < 1000; i++ {
+		counts[WeightedRandomBalancer{}.Pick(c, "")]++
+	}
+	if counts[1] < 900 {
+		t.Errorf("picks = %v, want the peer scoring 1 picked almost always", counts)
+	}
+	if counts[0]+counts[2] == 0 {
+		t.Errorf("picks = %v, want peers scoring 0 to keep a small share", counts)
+	}
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	b := &RoundRobinBalancer{}
+	c := candidates("a", "b", "c")
+	var got []int
+	for i := 0; i < 6; i++ {
+		got = append(got, b.Pick(c, ""))
+	}
+	if want := []int{0, 1, 2, 0, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("picks = %v, want %v", got, want)
+	}
+}
+
+func TestLeastOutstandingBalancer(t *testing.T) {
+	c := candidates("a", "b", "c", "d")
+	c[0].Outstanding = 3
+	c[1].Outstanding = 1
+	c[2].Outstanding = 5
+	c[3].Outstanding = 1
+	seen := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		seen[LeastOutstandingBalancer{}.Pick(c, "")] = true
+	}
+	if want := map[int]bool{1: true, 3: true}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("picked %v, want both least loaded peers %v", seen, want)
+	}
+}
+
+func TestPowerOfTwoBalancer(t *testing.T) {
+	c := candidates("fast", "slow")
+	c[0].Health.Latency = 10 * time.Millisecond
+	c[1].Health.Latency = time.Second
+	for i := 0; i < 50; i++ {
+		if got := (PowerOfTwoBalancer{}).Pick(c, ""); got != 0 {
+			t.Fatalf("Pick() = %d, want the faster peer", got)
+		}
+	}
+	if got := (PowerOfTwoBalancer{}).Pick(c[:1], ""); got != 0 {
+		t.Errorf("Pick() of one candidate = %d, want 0", got)
+	}
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	c := candidates("a", "b", "c", "d", "e")
+	b := ConsistentHashBalancer{}
+	for _, key := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"} {
+		first := c[b.Pick(c, key)].Node.Host
+		if again := c[b.Pick(c, key)].Node.Host; again != first {
+			t.Errorf("key %s went to %s then %s", key, first, again)
+		}
+		// Removing a peer only moves the clients that were on it.
+		fewer := append(candidates(), c[1:]...)
+		if got := fewer[b.Pick(fewer, key)].Node.Host; got != first && first != "a" {
+			t.Errorf("key %s moved from %s to %s when a was removed", key, first, got)
+		}
+	}
+}
+
+func TestRelay_pick(t *testing.T) {
+	r := NewRelay(nil, nil, newTestClient(t), WithBalancer(&RoundRobinBalancer{}))
+	peers := []electrum.Node{{Host: "a"}, {Host: "down"}, {Host: "b"}}
+	for i := 0; i < 3; i++ {
+		r.Health().Observe(&peers[1], 0, context.DeadlineExceeded)
+	}
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, r.pick(peers, "").Host)
+	}
+	if want := []string{"a", "b", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("picks = %v, want %v skipping the unhealthy peer", got, want)
+	}
+	if n := r.pick(peers[1:2], ""); n == nil || n.Host != "down" {
+		t.Errorf("pick() of only unhealthy peers = %v, want the unhealthy peer", n)
+	}
+	if n := r.pick(nil, ""); n != nil {
+		t.Errorf("pick() of no peers = %v, want nil", n)
+	}
+}
@@ -0,0 +1,124 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+const (
+	// MaxBatchSize is the largest JSON RPC batch the relay accepts.
+	MaxBatchSize = 1000
+	// MaxRequestSize is the largest request body the relay reads, so that memory is bounded along with the batch
+	// size: maxCallSize for each call of the largest batch.
+	MaxRequestSize = MaxBatchSize * maxCallSize
+	// maxCallSize is the room allowed for each call of a batch. Calls are mostly well under a kilobyte; the whole of
+	// MaxRequestSize leaves room for broadcasting transactions far larger than the standard limit of 100 kvB.
+	maxCallSize = 4 << 10
+	// batchChunkSize is how many calls of a batch are sent to the same peer. Larger batches are split across peers.
+	batchChunkSize = 50
+)
+
+// sendFunc sends a single JSON RPC request upstream and returns its response.
+type sendFunc func(ctx context.Context, req []byte) ([]byte, error)
+
+// IsBatch reports whether req is a JSON RPC batch, i.e. a JSON array rather than a single request object.
+func IsBatch(req []byte) bool {
+	b := bytes.TrimLeft(req, " \t\r\n")
+	return len(b) > 0 && b[0] == '['
+}
+
+// ForwardBatchContext forwards each call in a JSON RPC batch and returns the batch of responses, in the order the calls
+// were made. The relay's method policy is applied to each call, and a call that is forbidden, malformed or fails
+// upstream gets an error response of its own without affecting the rest of the batch. Batches larger than
+// batchChunkSize are split across peers. Calls without an ID are notifications and get no response; if every call is a
+// notification the returned response is empty.
+func (r *Relay) ForwardBatchContext(ctx context.Context, req []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultTimeout)
+		defer cancel()
+	}
+	return r.forwardBatch(ctx, req, func(chunk int) sendFunc {
+		n := r.pickPeer(ctx)
+		return func(ctx context.Context, req []byte) ([]byte, error) {
+			return r.forward(ctx, req, n)
+		}
+	})
+}
+
+// forwardBatch forwards each call of a batch concurrently. sender is called once per chunk of batchChunkSize calls
+// and returns the function the chunk's calls are sent with.
+func (r *Relay) forwardBatch(ctx context.Context, req []byte, sender func(chunk int) sendFunc) ([]byte, error) {
+	var calls []json.RawMessage
+	if err := json.Unmarshal(req, &calls); err != nil {
+		return parseError(err).Response(nil), nil
+	}
+	switch {
+	case len(calls) == 0:
+		return invalidRequest("empty batch").Response(nil), nil
+	case len(calls) > MaxBatchSize:
+		return invalidRequest("batch too large").Response(nil), nil
+	}
+
+	responses := make([][]byte, len(calls))
+	var wg sync.WaitGroup
+	for start := 0; start < len(calls); start += batchChunkSize {
+		send := sender(start / batchChunkSize)
+		end := start + batchChunkSize
+		if end > len(calls) {
+			end = len(calls)
+		}
+		for i := start; i < end; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				responses[i] = r.forwardCall(ctx, calls[i], send)
+			}(i)
+		}
+	}
+	wg.Wait()
+
+	out := make([]json.RawMessage, 0, len(responses))
+	for _, resp := range responses {
+		if resp != nil {
+			out = append(out, bytes.TrimSpace(resp))
+		}
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(out)
+}
+
+// forwardCall forwards a single call of a batch, returning its response, an error response, or nil if the call is a
+// notification.
+func (r *Relay) forwardCall(ctx context.Context, call json.RawMessage, send sendFunc) []byte {
+	id, err := r.checkCall(call)
+	notification := id == nil
+	if err != nil {
+		e := AsError(err)
+		if notification && e.Code == CodeMethodForbidden {
+			return nil
+		}
+		return e.Response(id)
+	}
+	resp, err := send(ctx, call)
+	if notification {
+		return nil
+	}
+	if err != nil {
+		log.Printf("error forwarding batched call %s: %v\n", call, err)
+		return upstreamError(ctx, err).Response(id)
+	}
+	return resp
+}
+
+// sessionSender sends every call over s.
+func sessionSender(s *electrum.Session) func(chunk int) sendFunc {
+	return func(int) sendFunc { return s.Send }
+}
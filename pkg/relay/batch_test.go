@@ -0,0 +1,140 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+func TestIsBatch(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		want bool
+	}{
+		{"single request", `{"jsonrpc":"2.0","method":"server.ping","id":1}`, false},
+		{"batch", `[{"jsonrpc":"2.0","method":"server.ping","id":1}]`, true},
+		{"batch with leading whitespace", " \n\t[]", true},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsBatch([]byte(tt.req)); got != tt.want {
+				t.Errorf("IsBatch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelay_ForwardBatchContext(t *testing.T) {
+	upstream := newFakeElectrum(t, func(req *fakeRequest) (interface{}, error) {
+		switch req.Method {
+		case "blockchain.scripthash.get_history":
+			return []interface{}{req.Params[0]}, nil
+		case "server.ping":
+			return nil, nil
+		}
+		return nil, &electrum.RPCError{Code: -32601, Message: "unknown method"}
+	})
+	r := &Relay{
+		Peers:            []electrum.Node{upstream.node()},
+		ForbiddenMethods: []string{"blockchain.transaction.broadcast"},
+		ElectrumClient:   newTestClient(t),
+	}
+
+	type response struct {
+		ID     json.RawMessage    `json:"id"`
+		Result json.RawMessage    `json:"result"`
+		Error  *electrum.RPCError `json:"error"`
+	}
+	forward := func(t *testing.T, req string) []response {
+		t.Helper()
+		b, err := r.ForwardRequestContext(context.Background(), []byte(req))
+		if err != nil {
+			t.Fatalf("ForwardRequestContext() error = %v", err)
+		}
+		if len(b) == 0 {
+			return nil
+		}
+		if !IsBatch(b) {
+			b = append(append([]byte("["), b...), ']')
+		}
+		var out []response
+		if err := json.Unmarshal(b, &out); err != nil {
+			t.Fatalf("invalid batch response %s: %v", b, err)
+		}
+		return out
+	}
+
+	t.Run("per element results and errors in order", func(t *testing.T) {
+		got := forward(t, `[
+			{"jsonrpc":"2.0","method":"blockchain.scripthash.get_history","params":["aa"],"id":"a"},
+			{"jsonrpc":"2.0","method":"server.ping","params":[]},
+			{"jsonrpc":"2.0","method":"no.such.method","params":[],"id":2},
+			42,
+			{"jsonrpc":"2.0","method":"blockchain.scripthash.get_history","params":["bb"],"id":3},
+			{"jsonrpc":"2.0","method":"blockchain.transaction.broadcast","params":["00"],"id":4}
+		]`)
+		if len(got) != 5 {
+			t.Fatalf("got %d responses, want 5 (the notification has none): %+v", len(got), got)
+		}
+		if string(got[0].ID) != `"a"` || string(got[0].Result) != `["aa"]` {
+			t.Errorf("response 0 = id %s result %s, want id \"a\" result [\"aa\"]", got[0].ID, got[0].Result)
+		}
+		if string(got[1].ID) != "2" || got[1].Error == nil || got[1].Error.Message != "unknown method" {
+			t.Errorf("response 1 = %+v, want upstream error for id 2", got[1])
+		}
+		if string(got[2].ID) != "null" || got[2].Error == nil || got[2].Error.Code != -32600 {
+			t.Errorf("response 2 = %+v, want invalid request error", got[2])
+		}
+		if string(got[3].ID) != "3" || string(got[3].Result) != `["bb"]` {
+			t.Errorf("response 3 = id %s result %s, want id 3 result [\"bb\"]", got[3].ID, got[3].Result)
+		}
+		if string(got[4].ID) != "4" || got[4].Error == nil || got[4].Error.Code != -32601 {
+			t.Errorf("response 4 = %+v, want forbidden method error for id 4", got[4])
+		}
+		if n := upstream.called("blockchain.transaction.broadcast"); n != 0 {
+			t.Errorf("forbidden method forwarded %d times", n)
+		}
+	})
+
+	t.Run("large batch split into chunks keeps order", func(t *testing.T) {
+		calls := make([]string, 3*batchChunkSize+7)
+		for i := range calls {
+			calls[i] = fmt.Sprintf(`{"jsonrpc":"2.0","method":"blockchain.scripthash.get_history","params":["%d"],"id":%d}`, i, i)
+		}
+		got := forward(t, "["+strings.Join(calls, ",")+"]")
+		if len(got) != len(calls) {
+			t.Fatalf("got %d responses, want %d", len(got), len(calls))
+		}
+		for i, resp := range got {
+			if string(resp.ID) != fmt.Sprint(i) || string(resp.Result) != fmt.Sprintf(`["%d"]`, i) {
+				t.Fatalf("response %d = id %s result %s, want id and result %d", i, resp.ID, resp.Result, i)
+			}
+		}
+	})
+
+	t.Run("notifications only", func(t *testing.T) {
+		if got := forward(t, `[{"jsonrpc":"2.0","method":"server.ping","params":[]}]`); got != nil {
+			t.Errorf("got %+v, want no response", got)
+		}
+	})
+
+	t.Run("empty batch", func(t *testing.T) {
+		got := forward(t, `[]`)
+		if len(got) != 1 || got[0].Error == nil || got[0].Error.Code != -32600 {
+			t.Errorf("got %+v, want a single invalid request error", got)
+		}
+	})
+
+	t.Run("malformed batch", func(t *testing.T) {
+		got := forward(t, `[{"jsonrpc":"2.0"`)
+		if len(got) != 1 || got[0].Error == nil || got[0].Error.Code != -32700 {
+			t.Errorf("got %+v, want a single parse error", got)
+		}
+	})
+}
@@ -0,0 +1,277 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a peer's circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets requests through. It is the state of peers nothing is known about.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen stops requests from being sent to the peer until its cooldown is over.
+	BreakerOpen
+	// BreakerHalfOpen lets a single trial request through, which closes the breaker if it succeeds and opens it again
+	// if it fails.
+	BreakerHalfOpen
+)
+
+// String returns the name of the state.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// MarshalText implements encoding.TextMarshaler, so that states are reported by name.
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ErrCircuitOpen is returned for requests to a peer whose circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerConfig controls when a peer's circuit breaker opens and for how long. Zero fields take their values from
+// DefaultBreakerConfig.
+type BreakerConfig struct {
+	// ConsecutiveFailures is how many requests in a row must fail to open the breaker.
+	ConsecutiveFailures int
+	// ErrorRate is the fraction of requests within Window that must fail to open the breaker, once at least
+	// MinRequests have been made in it.
+	ErrorRate   float64
+	MinRequests int
+	Window      time.Duration
+	// Cooldown is how long the breaker stays open before a trial request is let through.
+	Cooldown time.Duration
+}
+
+// DefaultBreakerConfig is the circuit breaker configuration used for unset fields of Relay.BreakerConfig.
+var DefaultBreakerConfig = BreakerConfig{
+	ConsecutiveFailures: 5,
+	ErrorRate:           0.5,
+	MinRequests:         20,
+	Window:              time.Minute,
+	Cooldown:            30 * time.Second,
+}
+
+// withDefaults fills unset fields from DefaultBreakerConfig.
+func (c BreakerConfig) withDefaults() BreakerConfig {
+	d := DefaultBreakerConfig
+	if c.ConsecutiveFailures <= 0 {
+		c.ConsecutiveFailures = d.ConsecutiveFailures
+	}
+	if c.ErrorRate <= 0 || c.ErrorRate > 1 {
+		c.ErrorRate = d.ErrorRate
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = d.MinRequests
+	}
+	if c.Window <= 0 {
+		c.Window = d.Window
+	}
+	if c.Cooldown <= 0 {
+		c.Cooldown = d.Cooldown
+	}
+	return c
+}
+
+// WithBreakerConfig sets when peers' circuit breakers open. DefaultBreakerConfig is used otherwise.
+func WithBreakerConfig(config BreakerConfig) Option {
+	return func(r *Relay) {
+		r.BreakerConfig = config
+	}
+}
+
+// BreakerTransition is a change in the state of a peer's circuit breaker.
+type BreakerTransition struct {
+	Host     string
+	From, To BreakerState
+	// Err is the failure that opened the breaker, if it was opened.
+	Err error
+}
+
+// WithBreakerHandler sets a function called with every change in the state of a peer's circuit breaker.
+func WithBreakerHandler(handler func(BreakerTransition)) Option {
+	return func(r *Relay) {
+		r.BreakerHandler = handler
+	}
+}
+
+// BreakerStatus is the state of a peer's circuit breaker, for reporting.
+type BreakerStatus struct {
+	State               BreakerState `json:"state"`
+	Since               time.Time    `json:"since"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	// Requests and Failures are counted over the current error rate window.
+	Requests int `json:"requests"`
+	Failures int `json:"failures"`
+}
+
+// breaker is the circuit breaker of a single peer.
+type breaker struct {
+	BreakerStatus
+	windowStart time.Time
+	// trial is set while the single request allowed through a half-open breaker is in flight.
+	trial bool
+}
+
+// breakers holds the circuit breakers of the relay's peers, by host.
+type breakers struct {
+	mu    sync.Mutex
+	peers map[string]*breaker
+}
+
+func (b *breakers) get(host string, now time.Time) *breaker {
+	if b.peers == nil {
+		b.peers = make(map[string]*breaker)
+	}
+	br, ok := b.peers[host]
+	if !ok {
+		br = &breaker{BreakerStatus: BreakerStatus{Since: now}, windowStart: now}
+		b.peers[host] = br
+	}
+	return br
+}
+
+// breakerAvailable reports whether a request to host would be let through, without letting it through.
+func (r *Relay) breakerAvailable(host string) bool {
+	config := r.BreakerConfig.withDefaults()
+	b := &r.breakers
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.peers[host]
+	if !ok {
+		return true
+	}
+	switch br.State {
+	case BreakerOpen:
+		return time.Since(br.Since) >= config.Cooldown
+	case BreakerHalfOpen:
+		return !br.trial
+	}
+	return true
+}
+
+// breakerAllow reports whether a request may be sent to host. An open breaker whose cooldown is over goes half-open and
+// lets this request through as its trial.
+func (r *Relay) breakerAllow(host string) bool {
+	config := r.BreakerConfig.withDefaults()
+	now := time.Now()
+	b := &r.breakers
+	b.mu.Lock()
+	br := b.get(host, now)
+	var transition *BreakerTransition
+	allowed := true
+	switch br.State {
+	case BreakerOpen:
+		if now.Sub(br.Since) < config.Cooldown {
+			allowed = false
+			break
+		}
+		transition = br.moveTo(host, BreakerHalfOpen, nil, now)
+		br.trial = true
+	case BreakerHalfOpen:
+		if br.trial {
+			allowed = false
+			break
+		}
+		br.trial = true
+	}
+	b.mu.Unlock()
+	r.breakerChanged(transition)
+	return allowed
+}
+
+// breakerRecord records the outcome of a request to host. Requests abandoned by their caller say nothing about the
+// peer and aren't counted, though an abandoned trial lets another request be tried.
+func (r *Relay) breakerRecord(host string, err error) {
+	config := r.BreakerConfig.withDefaults()
+	now := time.Now()
+	b := &r.breakers
+	b.mu.Lock()
+	br := b.get(host, now)
+	if errors.Is(err, context.Canceled) {
+		br.trial = false
+		b.mu.Unlock()
+		return
+	}
+	var transition *BreakerTransition
+	if now.Sub(br.windowStart) >= config.Window {
+		br.Requests, br.Failures, br.windowStart = 0, 0, now
+	}
+	br.Requests++
+	if err != nil {
+		br.Failures++
+		br.ConsecutiveFailures++
+	} else {
+		br.ConsecutiveFailures = 0
+	}
+	switch br.State {
+	case BreakerHalfOpen:
+		br.trial = false
+		if err != nil {
+			transition = br.moveTo(host, BreakerOpen, err, now)
+		} else {
+			transition = br.moveTo(host, BreakerClosed, nil, now)
+		}
+	case BreakerClosed:
+		if err == nil {
+			break
+		}
+		if br.ConsecutiveFailures >= config.ConsecutiveFailures ||
+			br.Requests >= config.MinRequests && float64(br.Failures)/float64(br.Requests) >= config.ErrorRate {
+			transition = br.moveTo(host, BreakerOpen, err, now)
+		}
+	}
+	b.mu.Unlock()
+	r.breakerChanged(transition)
+}
+
+// moveTo changes the breaker's state. Closing it starts its counts afresh.
+func (br *breaker) moveTo(host string, to BreakerState, err error, now time.Time) *BreakerTransition {
+	t := &BreakerTransition{Host: host, From: br.State, To: to, Err: err}
+	br.State, br.Since = to, now
+	if to == BreakerClosed {
+		br.ConsecutiveFailures, br.Requests, br.Failures, br.windowStart = 0, 0, 0, now
+	}
+	return t
+}
+
+// breakerChanged logs a transition and passes it to BreakerHandler. t may be nil.
+func (r *Relay) breakerChanged(t *BreakerTransition) {
+	if t == nil {
+		return
+	}
+	if t.Err != nil {
+		log.Printf("circuit breaker for %s went from %s to %s: %v\n", t.Host, t.From, t.To, t.Err)
+	} else {
+		log.Printf("circuit breaker for %s went from %s to %s\n", t.Host, t.From, t.To)
+	}
+	if r.BreakerHandler != nil {
+		r.BreakerHandler(*t)
+	}
+}
+
+// BreakerSnapshot returns the state of the circuit breaker of every peer requests have been sent to, keyed by host.
+func (r *Relay) BreakerSnapshot() map[string]BreakerStatus {
+	b := &r.breakers
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make(map[string]BreakerStatus, len(b.peers))
+	for host, br := range b.peers {
+		out[host] = br.BreakerStatus
+	}
+	return out
+}
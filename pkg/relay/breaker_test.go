@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// transitionRecorder collects breaker transitions.
+type transitionRecorder struct {
+	mu  sync.Mutex
+	got []BreakerState
+}
+
+func (tr *transitionRecorder) handle(t BreakerTransition) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.got = append(tr.got, t.To)
+}
+
+func (tr *transitionRecorder) states() []BreakerState {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return append([]BreakerState(nil), tr.got...)
+}
+
+func TestRelay_breaker(t *testing.T) {
+	errDown := errors.New("connection refused")
+	const cooldown = 20 * time.Millisecond
+	tests := []struct {
+		name     string
+		config   BreakerConfig
+		outcomes []error
+		wantOpen bool
+	}{
+		{
+			name:     "consecutive failures",
+			config:   BreakerConfig{ConsecutiveFailures: 3},
+			outcomes: []error{nil, errDown, errDown, errDown},
+			wantOpen: true,
+		},
+		{
+			name:     "failures interrupted by a success",
+			config:   BreakerConfig{ConsecutiveFailures: 3},
+			outcomes: []error{errDown, errDown, nil, errDown, errDown},
+		},
+		{
+			name:     "error rate",
+			config:   BreakerConfig{ConsecutiveFailures: 10, ErrorRate: 0.5, MinRequests: 4},
+			outcomes: []error{nil, errDown, nil, errDown},
+			wantOpen: true,
+		},
+		{
+			name:     "error rate below minimum requests",
+			config:   BreakerConfig{ConsecutiveFailures: 10, ErrorRate: 0.5, MinRequests: 4},
+			outcomes: []error{errDown, nil, errDown},
+		},
+		{
+			name:     "cancellations are not failures",
+			config:   BreakerConfig{ConsecutiveFailures: 2},
+			outcomes: []error{context.Canceled, context.Canceled, errDown},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Cooldown = cooldown
+			var tr transitionRecorder
+			r := NewRelay(nil, nil, nil, WithBreakerConfig(tt.config), WithBreakerHandler(tr.handle))
+			for _, err := range tt.outcomes {
+				r.breakerRecord("a", err)
+			}
+			if open := !r.breakerAllow("a"); open != tt.wantOpen {
+				t.Fatalf("breaker open = %v, want %v", open, tt.wantOpen)
+			}
+			if !tt.wantOpen {
+				return
+			}
+			if r.breakerAvailable("a") {
+				t.Error("breakerAvailable() = true during the cooldown")
+			}
+
+			time.Sleep(cooldown)
+			if !r.breakerAvailable("a") || !r.breakerAllow("a") {
+				t.Fatal("trial request refused after the cooldown")
+			}
+			if r.breakerAvailable("a") || r.breakerAllow("a") {
+				t.Fatal("second request allowed while the trial is in flight")
+			}
+			r.breakerRecord("a", errDown)
+			if r.breakerAllow("a") {
+				t.Fatal("request allowed after the trial failed")
+			}
+
+			time.Sleep(cooldown)
+			if !r.breakerAllow("a") {
+				t.Fatal("trial request refused after the second cooldown")
+			}
+			r.breakerRecord("a", context.Canceled)
+			if !r.breakerAllow("a") {
+				t.Fatal("trial request refused after the first trial was abandoned")
+			}
+			r.breakerRecord("a", nil)
+			if !r.breakerAllow("a") {
+				t.Fatal("request refused after the trial succeeded")
+			}
+
+			want := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}
+			if got := tr.states(); !reflect.DeepEqual(got, want) {
+				t.Errorf("transitions = %v, want %v", got, want)
+			}
+			if got := r.BreakerSnapshot()["a"]; got.State != BreakerClosed || got.ConsecutiveFailures != 0 {
+				t.Errorf("BreakerSnapshot() = %+v, want a reset closed breaker", got)
+			}
+		})
+	}
+}
+
+func TestRelay_pickSkipsOpenBreakers(t *testing.T) {
+	r := NewRelay(nil, nil, nil, WithBreakerConfig(BreakerConfig{ConsecutiveFailures: 1, Cooldown: time.Hour}))
+	peers := []electrum.Node{{Host: "a"}, {Host: "b"}}
+	r.breakerRecord("a", errors.New("connection refused"))
+	for i := 0; i < 20; i++ {
+		if n := r.pick(peers, ""); n == nil || n.Host != "b" {
+			t.Fatalf("pick() = %v, want b", n)
+		}
+	}
+	r.breakerRecord("b", errors.New("connection refused"))
+	if n := r.pick(peers, ""); n != nil {
+		t.Errorf("pick() = %v, want nil with every breaker open", n)
+	}
+	if got := r.BreakerSnapshot()["b"].State; got != BreakerOpen {
+		t.Errorf("BreakerSnapshot() state = %v, want open", got)
+	}
+}
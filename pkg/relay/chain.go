@@ -0,0 +1,200 @@
+package relay
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tylerchambers/electrumrelay/pkg/chain"
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// WithHeaderChain makes the relay keep c synced with its peers' headers. Header requests are then answered from it, and
+// peers whose tip is not on it are unhealthy. Syncing starts with TrackChain.
+func WithHeaderChain(c *chain.Chain) Option {
+	return func(r *Relay) {
+		r.Chain = c
+	}
+}
+
+// ChainStatus reports the relay's header chain.
+type ChainStatus struct {
+	Network string `json:"network"`
+	Height  int    `json:"height"`
+	Tip     string `json:"tip"`
+	// Work is the total work of the chain, in hex.
+	Work string `json:"work"`
+}
+
+// chainStatus reports Chain, or nil if the relay doesn't keep one.
+func (r *Relay) chainStatus() *ChainStatus {
+	if r.Chain == nil {
+		return nil
+	}
+	height, tip := r.Chain.Tip()
+	return &ChainStatus{Network: r.Chain.Params().Name, Height: height, Tip: tip.Hash, Work: r.Chain.Work().Text(16)}
+}
+
+// TrackChain keeps Chain synced in the background. It fetches the headers a peer has above the tip, then follows the
+// peer's new tips with blockchain.headers.subscribe, moving to another peer whenever the peer fails, sends invalid
+// headers, or is on a branch with less work.
+func (r *Relay) TrackChain() {
+	if r.Chain == nil {
+		return
+	}
+	r.chainOnce.Do(func() {
+		go r.trackChain()
+	})
+}
+
+func (r *Relay) trackChain() {
+	for {
+		n := r.pickPeer(context.Background())
+		if n == nil {
+			time.Sleep(headerRetryInterval)
+			continue
+		}
+		err := r.followChain(n)
+		log.Printf("stopped following the chain on %s: %v\n", n.Host, err)
+		time.Sleep(headerRetryInterval)
+	}
+}
+
+// followChain syncs Chain from n, and again whenever n announces a new tip, until that fails or the subscription ends.
+// Every health check Interval it also checks that n is still healthy, and that the chain hasn't stayed behind the tip
+// the relay's peers report, as it would if n stopped announcing tips without the subscription failing. It returns if
+// either check fails, so that trackChain moves to another peer.
+func (r *Relay) followChain(n *electrum.Node) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	sub, err := r.ElectrumClient.SubscribeHeaders(ctx, n)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	src := timeoutSource{chain.NodeSource{Client: r.ElectrumClient, Node: n}}
+	if err := r.syncChain(src, sub.Tip); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(r.Health().config.Interval)
+	defer ticker.Stop()
+	behind := false
+	for {
+		select {
+		case tip, ok := <-sub.C:
+			if !ok {
+				if err := sub.Err(); err != nil {
+					return err
+				}
+				return errors.New("headers subscription ended")
+			}
+			if err := r.syncChain(src, tip); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if p := r.Health().Peer(n.Host); !p.Healthy {
+				return fmt.Errorf("%s is unhealthy: %s", n.Host, p.Reason)
+			}
+			// A chain that is behind at one check may just be about to sync a new tip, but not at two in a row.
+			tip, height := r.Health().NetworkTip(), r.Chain.Height()
+			if tip > height && behind {
+				return fmt.Errorf("chain is stuck at %d while peers report a tip at %d", height, tip)
+			}
+			behind = tip > height
+		}
+	}
+}
+
+// syncChain syncs Chain from src after src announced tip, unless the chain already has it.
+func (r *Relay) syncChain(src chain.Source, tip *electrum.HeaderNotification) error {
+	if h, err := electrum.ParseBlockHeader(tip.Hex); err == nil {
+		if have, ok := r.Chain.Header(tip.Height); ok && have.Hash == h.Hash {
+			return nil
+		}
+	}
+	before := r.Chain.Height()
+	if err := r.Chain.Sync(context.Background(), src); err != nil {
+		return err
+	}
+	if height := r.Chain.Height(); height != before {
+		_, h := r.Chain.Tip()
+		log.Printf("header chain synced to %s at height %d\n", h.Hash, height)
+	}
+	return nil
+}
+
+// timeoutSource bounds each fetch from a chain.Source by DefaultTimeout, so that an unresponsive peer can't stall a
+// sync spanning many fetches.
+type timeoutSource struct {
+	chain.Source
+}
+
+func (s timeoutSource) Headers(ctx context.Context, start, count int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+	defer cancel()
+	return s.Source.Headers(ctx, start, count)
+}
+
+// offChain reports whether a peer's tip conflicts with Chain: whether the chain has a different block at its height.
+// Tips above the chain's can't be judged until the chain catches up.
+func (r *Relay) offChain(height int, hash string) bool {
+	if r.Chain == nil || hash == "" {
+		return false
+	}
+	h, ok := r.Chain.Header(height)
+	return ok && h.Hash != hash
+}
+
+// fromChain answers blockchain.block.header and blockchain.block.headers requests from Chain, so that clients are given
+// headers the relay has validated rather than whatever a peer sends. Requests for checkpoint proofs, which need merkle
+// branches the chain doesn't keep, and for headers above its tip are left to be forwarded.
+func (r *Relay) fromChain(req []byte, method string) ([]byte, bool) {
+	if r.Chain == nil || (method != "blockchain.block.header" && method != "blockchain.block.headers") {
+		return nil, false
+	}
+	var call struct {
+		ID     json.RawMessage `json:"id"`
+		Params []int           `json:"params"`
+	}
+	if err := json.Unmarshal(req, &call); err != nil || len(call.Params) == 0 {
+		return nil, false
+	}
+	var result interface{}
+	switch method {
+	case "blockchain.block.header":
+		if len(call.Params) > 1 && call.Params[1] != 0 {
+			return nil, false
+		}
+		raw := r.Chain.RawHeaders(call.Params[0], 1)
+		if len(raw) == 0 {
+			return nil, false
+		}
+		result = hex.EncodeToString(raw)
+	case "blockchain.block.headers":
+		if len(call.Params) < 2 || len(call.Params) > 2 && call.Params[2] != 0 {
+			return nil, false
+		}
+		start, count := call.Params[0], call.Params[1]
+		if count > chain.MaxChunk {
+			count = chain.MaxChunk
+		}
+		if start < 0 || count <= 0 || start+count-1 > r.Chain.Height() {
+			return nil, false
+		}
+		raw := r.Chain.RawHeaders(start, count)
+		result = electrum.BlockHeaders{Count: len(raw) / electrum.HeaderSize, Hex: hex.EncodeToString(raw), Max: chain.MaxChunk}
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		return nil, false
+	}
+	resp, err := json.Marshal(electrum.JSONRPCResponse{Version: "2.0", ID: call.ID, Result: b})
+	if err != nil {
+		return nil, false
+	}
+	return resp, true
+}
@@ -0,0 +1,228 @@
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tylerchambers/electrumrelay/pkg/chain"
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// regtestChain returns a regtest header chain n blocks high. tag sets the blocks' merkle roots, so that chains built
+// with different tags fork after genesis.
+func regtestChain(t *testing.T, n int, tag byte) *chain.Chain {
+	t.Helper()
+	c, err := chain.New(&chain.RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := c.RawHeaders(0, 1)
+	var headers []byte
+	for i := 0; i < n; i++ {
+		b := make([]byte, electrum.HeaderSize)
+		binary.LittleEndian.PutUint32(b[0:4], 0x20000000)
+		copy(b[4:36], electrum.DoubleSHA256(prev))
+		b[36] = tag
+		binary.LittleEndian.PutUint32(b[68:72], binary.LittleEndian.Uint32(prev[68:72])+600)
+		binary.LittleEndian.PutUint32(b[72:76], regtestBits)
+		for nonce := uint32(0); ; nonce++ {
+			binary.LittleEndian.PutUint32(b[76:80], nonce)
+			if h, _ := electrum.ParseBlockHeaderBytes(b); h.CheckProofOfWork() == nil {
+				break
+			}
+		}
+		headers = append(headers, b...)
+		prev = b
+	}
+	if err := c.Connect(1, headers); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newChainElectrum returns a fake server whose blockchain is c.
+func newChainElectrum(t *testing.T, ip string, c *chain.Chain) *fakeElectrum {
+	return newFakeElectrumAt(t, ip, func(req *fakeRequest) (interface{}, error) {
+		switch req.Method {
+		case "server.ping":
+			return nil, nil
+		case "blockchain.headers.subscribe":
+			height := c.Height()
+			return map[string]interface{}{"height": height, "hex": hex.EncodeToString(c.RawHeaders(height, 1))}, nil
+		case "blockchain.block.headers":
+			raw := c.RawHeaders(int(req.Params[0].(float64)), int(req.Params[1].(float64)))
+			return electrum.BlockHeaders{Count: len(raw) / electrum.HeaderSize, Hex: hex.EncodeToString(raw), Max: chain.MaxChunk}, nil
+		case "blockchain.block.header":
+			return "upstream", nil
+		}
+		return nil, errors.New("unknown method")
+	})
+}
+
+func TestRelay_fromChain(t *testing.T) {
+	c := regtestChain(t, 3, 1)
+	upstream := newFakeElectrum(t, func(req *fakeRequest) (interface{}, error) {
+		return "upstream", nil
+	})
+	r := NewRelay([]electrum.Node{upstream.node()}, nil, newTestClient(t), WithHeaderChain(c))
+
+	tests := []struct {
+		name   string
+		req    string
+		want   interface{}
+		served bool
+	}{
+		{"header", `{"jsonrpc":"2.0","id":7,"method":"blockchain.block.header","params":[2]}`, hex.EncodeToString(c.RawHeaders(2, 1)), true},
+		{"header with zero cp_height", `{"jsonrpc":"2.0","id":7,"method":"blockchain.block.header","params":[2,0]}`, hex.EncodeToString(c.RawHeaders(2, 1)), true},
+		{"header with proof", `{"jsonrpc":"2.0","id":7,"method":"blockchain.block.header","params":[2,3]}`, "upstream", false},
+		{"header above the tip", `{"jsonrpc":"2.0","id":7,"method":"blockchain.block.header","params":[4]}`, "upstream", false},
+		{"headers", `{"jsonrpc":"2.0","id":7,"method":"blockchain.block.headers","params":[1,3]}`,
+			map[string]interface{}{"count": 3.0, "hex": hex.EncodeToString(c.RawHeaders(1, 3)), "max": float64(chain.MaxChunk)}, true},
+		{"headers past the tip", `{"jsonrpc":"2.0","id":7,"method":"blockchain.block.headers","params":[1,4]}`, "upstream", false},
+		{"other method", `{"jsonrpc":"2.0","id":7,"method":"blockchain.relayfee","params":[]}`, "upstream", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := r.fromChain([]byte(tt.req), requestMethod([]byte(tt.req))); ok != tt.served {
+				t.Errorf("fromChain() served = %v, want %v", ok, tt.served)
+			}
+			resp, err := r.forward(context.Background(), []byte(tt.req), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var env struct {
+				ID     int         `json:"id"`
+				Result interface{} `json:"result"`
+			}
+			if err := json.Unmarshal(resp, &env); err != nil {
+				t.Fatal(err)
+			}
+			if env.ID != 7 {
+				t.Errorf("response id = %d, want 7", env.ID)
+			}
+			got, _ := json.Marshal(env.Result)
+			want, _ := json.Marshal(tt.want)
+			if string(got) != string(want) {
+				t.Errorf("result = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestRelay_TrackChain(t *testing.T) {
+	upstream := regtestChain(t, 20, 1)
+	peer := newChainElectrum(t, "127.0.0.1", upstream)
+	c, err := chain.New(&chain.RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRelay([]electrum.Node{peer.node()}, nil, newTestClient(t), WithHeaderChain(c))
+	r.TrackChain()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Height() != upstream.Height() {
+		if time.Now().After(deadline) {
+			t.Fatalf("chain height = %d after 5s, want %d", c.Height(), upstream.Height())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, tip := c.Tip()
+	_, want := upstream.Tip()
+	if tip.Hash != want.Hash {
+		t.Errorf("tip = %s, want %s", tip.Hash, want.Hash)
+	}
+	if status := r.Status().Chain; status == nil || status.Height != 20 || status.Tip != want.Hash || status.Network != "regtest" {
+		t.Errorf("Status().Chain = %+v, want regtest at height 20 with tip %s", status, want.Hash)
+	}
+}
+
+func TestHealthChecker_OffChain(t *testing.T) {
+	best := regtestChain(t, 5, 1)
+	tests := []struct {
+		name     string
+		upstream *chain.Chain
+		healthy  bool
+	}{
+		{"tip on the chain", regtestChain(t, 3, 1), true},
+		{"tip on another branch", regtestChain(t, 3, 2), false},
+		{"tip above the chain", regtestChain(t, 7, 2), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := newChainElectrum(t, "127.0.0.1", tt.upstream)
+			r := NewRelay([]electrum.Node{peer.node()}, nil, newTestClient(t), WithHeaderChain(best))
+			n := peer.node()
+			if err := r.Health().Check(context.Background(), &n); err != nil {
+				t.Fatal(err)
+			}
+			p := r.Health().Peer(n.Host)
+			if p.Healthy != tt.healthy {
+				t.Errorf("Healthy = %v (%s), want %v", p.Healthy, p.Reason, tt.healthy)
+			}
+			if !tt.healthy && !strings.Contains(p.Reason, "not on the best chain") {
+				t.Errorf("Reason = %q, want it to say the tip is not on the best chain", p.Reason)
+			}
+		})
+	}
+}
+
+func TestRelay_followChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		degrade func(h *HealthChecker, peer *electrum.Node)
+		wantErr string
+	}{
+		{"peer turns unhealthy", func(h *HealthChecker, peer *electrum.Node) {
+			for i := 0; i < DefaultHealthConfig.UnhealthyAfter; i++ {
+				h.Observe(peer, 0, errors.New("connection reset"))
+			}
+		}, "unhealthy"},
+		{"peers report a higher tip", func(h *HealthChecker, peer *electrum.Node) {
+			for _, host := range []string{"a", "b"} {
+				h.record(host, 0, nil, func(p *PeerHealth) { p.TipHeight = 50 })
+			}
+		}, "stuck at 5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := newChainElectrum(t, "127.0.0.1", regtestChain(t, 5, 1))
+			c, err := chain.New(&chain.RegTestParams)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewRelay([]electrum.Node{peer.node()}, nil, newTestClient(t), WithHeaderChain(c))
+			r.HealthConfig = HealthConfig{Interval: 10 * time.Millisecond}
+			n := peer.node()
+			done := make(chan error, 1)
+			go func() { done <- r.followChain(&n) }()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for c.Height() != 5 {
+				if time.Now().After(deadline) {
+					t.Fatalf("chain height = %d after 5s, want 5", c.Height())
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			select {
+			case err := <-done:
+				t.Fatalf("followChain() returned %v while the peer was fine", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			tt.degrade(r.Health(), &n)
+			select {
+			case err := <-done:
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("followChain() error = %v, want it to say %q", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("followChain() kept following a degraded peer")
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// JSON RPC error codes returned by the relay. Codes from -32000 to -32099 are reserved by JSON RPC 2.0 for
+// implementation defined server errors, and are used for failures reaching upstream servers.
+const (
+	CodeParseError      = -32700
+	CodeInvalidRequest  = -32600
+	CodeMethodForbidden = -32601
+	CodeInternalError   = -32603
+	CodeUpstreamError   = -32000
+	CodeUpstreamTimeout = -32001
+	CodeNoPeers         = -32002
+	CodeDisagreement    = -32003
+	CodeUnverified      = -32004
+)
+
+// ErrNoPeers is returned when the relay has no peer to forward a request to.
+var ErrNoPeers = errors.New("no peers available")
+
+// Error is a failure handling a JSON RPC request, carrying the JSON RPC error code and HTTP status it is reported with.
+type Error struct {
+	Code    int
+	Message string
+	Status  int
+	// Err is the underlying cause, which is logged but not sent to clients.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+// Unwrap returns the underlying cause.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Response builds the JSON RPC error response for a request with the given id.
+func (e *Error) Response(id json.RawMessage) []byte {
+	return errorResponse(id, e.Code, e.Message)
+}
+
+func parseError(err error) *Error {
+	return &Error{Code: CodeParseError, Message: "parse error", Status: http.StatusBadRequest, Err: err}
+}
+
+func invalidRequest(message string) *Error {
+	return &Error{Code: CodeInvalidRequest, Message: "invalid request: " + message, Status: http.StatusBadRequest}
+}
+
+func methodForbidden() *Error {
+	return &Error{Code: CodeMethodForbidden, Message: "method is forbidden by the relay", Status: http.StatusForbidden}
+}
+
+// upstreamError classifies a failure forwarding a request upstream. ctx is the context the request was made with, so
+// that timeouts can be told apart from other failures even when the cause has been flattened into a message.
+func upstreamError(ctx context.Context, err error) *Error {
+	switch {
+	case errors.Is(err, ErrUnverified):
+		return &Error{Code: CodeUnverified, Message: "transaction failed verification", Status: http.StatusBadGateway, Err: err}
+	case errors.Is(err, ErrDisagreement):
+		return &Error{Code: CodeDisagreement, Message: "upstream servers disagree", Status: http.StatusBadGateway, Err: err}
+	case errors.Is(err, ErrNoPeers):
+		return &Error{Code: CodeNoPeers, Message: "no upstream servers available", Status: http.StatusServiceUnavailable, Err: err}
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return &Error{Code: CodeUpstreamTimeout, Message: "upstream request timed out", Status: http.StatusGatewayTimeout, Err: err}
+	}
+	return &Error{Code: CodeUpstreamError, Message: "upstream request failed", Status: http.StatusBadGateway, Err: err}
+}
+
+// AsError returns err as an *Error, treating errors that aren't as internal errors.
+func AsError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Code: CodeInternalError, Message: "internal error", Status: http.StatusInternalServerError, Err: err}
+}
+
+// RequestID returns the id of a single JSON RPC request, or nil if it has none or can't be parsed.
+func RequestID(req []byte) json.RawMessage {
+	var env struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(req, &env); err != nil {
+		return nil
+	}
+	return env.ID
+}
+
+// errorResponse builds a JSON RPC error response.
+func errorResponse(id json.RawMessage, code int, message string) []byte {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	b, _ := json.Marshal(&electrum.JSONRPCResponse{
+		Version: "2.0",
+		ID:      id,
+		Error:   &electrum.RPCError{Code: code, Message: message},
+	})
+	return b
+}
@@ -0,0 +1,153 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// fakeRequest is a JSON RPC request as seen by fakeElectrum.
+type fakeRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params []interface{}   `json:"params"`
+}
+
+// fakeElectrum is an in-process Electrum server. It answers the server.version handshake itself, and handle returns
+// the result for every other request, or an error which is sent back as a JSON RPC error object.
+type fakeElectrum struct {
+	ln     net.Listener
+	handle func(req *fakeRequest) (interface{}, error)
+
+	mu    sync.Mutex
+	conns []*fakeConn
+	calls map[string]int
+}
+
+type fakeConn struct {
+	net.Conn
+	writeMu sync.Mutex
+}
+
+func (c *fakeConn) writeJSON(v interface{}) {
+	b, _ := json.Marshal(v)
+	c.writeMu.Lock()
+	_, _ = c.Write(append(b, '\n'))
+	c.writeMu.Unlock()
+}
+
+func newFakeElectrum(t *testing.T, handle func(req *fakeRequest) (interface{}, error)) *fakeElectrum {
+	t.Helper()
+	return newFakeElectrumAt(t, "127.0.0.1", handle)
+}
+
+// newFakeElectrumAt is like newFakeElectrum, but listens on the given loopback IP, so that tests can run several
+// servers that the relay tells apart by host.
+func newFakeElectrumAt(t *testing.T, ip string, handle func(req *fakeRequest) (interface{}, error)) *fakeElectrum {
+	t.Helper()
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeElectrum{ln: ln, handle: handle, calls: make(map[string]int)}
+	go f.serve()
+	t.Cleanup(f.close)
+	return f
+}
+
+// node returns a Node pointing at the server.
+func (f *fakeElectrum) node() electrum.Node {
+	addr := f.ln.Addr().(*net.TCPAddr)
+	return electrum.Node{Host: addr.IP.String(), TCPPort: addr.Port}
+}
+
+// called returns how many times method has been requested.
+func (f *fakeElectrum) called(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+func (f *fakeElectrum) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &fakeConn{Conn: conn}
+		f.mu.Lock()
+		f.conns = append(f.conns, c)
+		f.mu.Unlock()
+		go f.serveConn(c)
+	}
+}
+
+func (f *fakeElectrum) serveConn(c *fakeConn) {
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		req := new(fakeRequest)
+		if err := json.Unmarshal(line, req); err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.calls[req.Method]++
+		f.mu.Unlock()
+		go func() {
+			resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+			var result interface{}
+			var err error
+			if req.Method == "server.version" {
+				result = []string{"ElectrumX 1.16.0", "1.4"}
+			} else {
+				result, err = f.handle(req)
+			}
+			var rpcErr *electrum.RPCError
+			switch {
+			case errors.As(err, &rpcErr):
+				resp["error"] = rpcErr
+			case err != nil:
+				resp["error"] = map[string]interface{}{"code": 1, "message": err.Error()}
+			default:
+				resp["result"] = result
+			}
+			c.writeJSON(resp)
+		}()
+	}
+}
+
+// notify pushes a notification to every connected client.
+func (f *fakeElectrum) notify(method string, params ...interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		c.writeJSON(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+	}
+}
+
+func (f *fakeElectrum) close() {
+	_ = f.ln.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		_ = c.Close()
+	}
+}
+
+// newTestClient returns an electrum client that discards its logs.
+func newTestClient(t *testing.T) *electrum.Client {
+	l := log.New(io.Discard, "", 0)
+	c := electrum.NewClient(l, l, l)
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
@@ -0,0 +1,226 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+const (
+	// headerHistory is how many recent headers the feed keeps for clients resuming with Last-Event-ID.
+	headerHistory = 64
+	// headerClientBuffer is how many events a feed client can fall behind by before it is disconnected.
+	headerClientBuffer = 16
+	// headerKeepAlive is how often an idle event stream is sent a comment to keep proxies from closing it.
+	headerKeepAlive = 30 * time.Second
+	// headerRetryInterval is how long the feed waits before subscribing again after losing its upstream.
+	headerRetryInterval = 5 * time.Second
+)
+
+// HeaderEvent is a new chain tip, as sent to feed clients.
+type HeaderEvent struct {
+	Height int                   `json:"height"`
+	Hex    string                `json:"hex"`
+	Header *electrum.BlockHeader `json:"header"`
+}
+
+// HeaderFeed fans new chain tips out from a single upstream blockchain.headers.subscribe subscription to any number of
+// clients, and serves them as a Server-Sent Events stream.
+type HeaderFeed struct {
+	relay *Relay
+
+	startOnce sync.Once
+	mu        sync.Mutex
+	clients   map[chan *HeaderEvent]struct{}
+	history   []*HeaderEvent
+}
+
+// NewHeaderFeed creates a feed of the chain tips seen by the relay's peers. The upstream subscription is made when the
+// first client connects.
+func NewHeaderFeed(r *Relay) *HeaderFeed {
+	return &HeaderFeed{relay: r, clients: make(map[chan *HeaderEvent]struct{})}
+}
+
+// HeaderFeed returns the relay's shared header feed.
+func (r *Relay) HeaderFeed() *HeaderFeed {
+	r.headerFeedOnce.Do(func() {
+		r.headerFeed = NewHeaderFeed(r)
+	})
+	return r.headerFeed
+}
+
+// run keeps an upstream headers subscription open for the lifetime of the feed, moving to another peer whenever the
+// subscription ends, as it does once the client gives up reconnecting to the peer.
+func (f *HeaderFeed) run() {
+	for {
+		n := f.relay.pickPeer(context.Background())
+		if n == nil {
+			time.Sleep(headerRetryInterval)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+		sub, err := f.relay.ElectrumClient.SubscribeHeaders(ctx, n)
+		cancel()
+		if err != nil {
+			log.Printf("could not subscribe to headers on %s: %v\n", n.Host, err)
+			time.Sleep(headerRetryInterval)
+			continue
+		}
+		f.publish(sub.Tip)
+		for tip := range sub.C {
+			f.publish(tip)
+		}
+		log.Printf("headers subscription to %s ended: %v\n", n.Host, sub.Err())
+		time.Sleep(headerRetryInterval)
+	}
+}
+
+// publish sends a new tip to every client and records it for resuming clients. Repeats of the latest tip, as seen
+// after resubscribing, are ignored.
+func (f *HeaderFeed) publish(tip *electrum.HeaderNotification) {
+	header, err := electrum.ParseBlockHeader(tip.Hex)
+	if err != nil {
+		log.Printf("ignoring unparseable header at height %d: %v\n", tip.Height, err)
+		return
+	}
+	e := &HeaderEvent{Height: tip.Height, Hex: tip.Hex, Header: header}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if last := len(f.history) - 1; last >= 0 && f.history[last].Hex == e.Hex {
+		return
+	}
+	f.history = append(f.history, e)
+	if len(f.history) > headerHistory {
+		f.history = f.history[len(f.history)-headerHistory:]
+	}
+	for c := range f.clients {
+		select {
+		case c <- e:
+		default:
+			// The client has fallen too far behind; closing its channel disconnects it.
+			delete(f.clients, c)
+			close(c)
+		}
+	}
+}
+
+// subscribe registers a client, returning the events it should be sent first. If lastEventID names a remembered
+// event, every event after it is replayed, including tips that replaced it at the same height; if it names an event
+// that has since been forgotten or reorganized away, every remembered event from its height up is. Otherwise the
+// client starts from the current tip.
+func (f *HeaderFeed) subscribe(lastEventID string) (chan *HeaderEvent, []*HeaderEvent) {
+	f.startOnce.Do(func() { go f.run() })
+	c := make(chan *HeaderEvent, headerClientBuffer)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.clients[c] = struct{}{}
+	if len(f.history) == 0 {
+		return c, nil
+	}
+	last, hash, err := parseHeaderEventID(lastEventID)
+	if err != nil {
+		return c, []*HeaderEvent{f.history[len(f.history)-1]}
+	}
+	for i, e := range f.history {
+		if e.Height == last && e.Header.Hash == hash {
+			return c, append([]*HeaderEvent(nil), f.history[i+1:]...)
+		}
+	}
+	var replay []*HeaderEvent
+	for _, e := range f.history {
+		if e.Height > last || (e.Height == last && hash != "") {
+			replay = append(replay, e)
+		}
+	}
+	return c, replay
+}
+
+// headerEventID returns the SSE event ID of an event: its height and block hash.
+func headerEventID(e *HeaderEvent) string {
+	return strconv.Itoa(e.Height) + ":" + e.Header.Hash
+}
+
+// parseHeaderEventID parses an event ID made by headerEventID. A bare height is accepted too, with an empty hash.
+func parseHeaderEventID(id string) (int, string, error) {
+	height, hash := id, ""
+	if i := strings.IndexByte(id, ':'); i >= 0 {
+		height, hash = id[:i], id[i+1:]
+	}
+	h, err := strconv.Atoi(height)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid event ID %q", id)
+	}
+	return h, hash, nil
+}
+
+// unsubscribe removes a client.
+func (f *HeaderFeed) unsubscribe(c chan *HeaderEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.clients[c]; ok {
+		delete(f.clients, c)
+		close(c)
+	}
+}
+
+// ServeHTTP streams new chain tips as Server-Sent Events. Each event's ID is its height and block hash, so reconnecting
+// clients that send Last-Event-ID are replayed the tips they missed, even when a reorg replaced the last tip they saw.
+func (f *HeaderFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	c, replay := f.subscribe(r.Header.Get("Last-Event-ID"))
+	defer f.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range replay {
+		if err := writeHeaderEvent(w, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(headerKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-c:
+			if !ok {
+				return
+			}
+			if err := writeHeaderEvent(w, e); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeHeaderEvent writes a single event in the Server-Sent Events format.
+func writeHeaderEvent(w http.ResponseWriter, e *HeaderEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: header\ndata: %s\n\n", headerEventID(e), b)
+	return err
+}
@@ -0,0 +1,148 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+const (
+	testHeader0 = "0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a29ab5f49ffff001d1dac2b7c"
+	testHeader1 = "010000006fe28c0ab6f1b372c1a6a246ae63f74f931e8365e15a089c68d6190000000000982051fd1e4ba744bbbe680e1fee14677ba1a3c3540bf7b1cdb606e857233e0e61bc6649ffff001d01e36299"
+	testHash0   = "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f"
+	testHash1   = "00000000839a8e6886ab5951d76f411475428afc90947ee320161bbf18eb6048"
+)
+
+// sseEvent is a single parsed Server-Sent Event.
+type sseEvent struct {
+	id    string
+	event string
+	data  HeaderEvent
+}
+
+// readSSE reads the next event from r, skipping comments.
+func readSSE(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var e sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && e.event != "":
+			return e
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.data); err != nil {
+				t.Fatalf("invalid event data %q: %v", line, err)
+			}
+		}
+	}
+}
+
+func TestHeaderFeed_ServeHTTP(t *testing.T) {
+	upstream := newFakeElectrum(t, func(req *fakeRequest) (interface{}, error) {
+		if req.Method == "blockchain.headers.subscribe" {
+			return map[string]interface{}{"height": 0, "hex": testHeader0}, nil
+		}
+		return nil, errors.New("unknown method")
+	})
+	r := &Relay{
+		Peers:          []electrum.Node{upstream.node()},
+		ElectrumClient: newTestClient(t),
+	}
+	srv := httptest.NewServer(r.HeaderFeed())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	connect := func(lastEventID string) *bufio.Reader {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET error = %v", err)
+		}
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+		}
+		return bufio.NewReader(resp.Body)
+	}
+
+	first := connect("")
+	e := readSSE(t, first)
+	if e.id != "0:"+testHash0 || e.event != "header" || e.data.Hex != testHeader0 {
+		t.Fatalf("first event = %+v, want genesis header", e)
+	}
+	if e.data.Header == nil || e.data.Header.Hash != testHash0 {
+		t.Errorf("first event header = %+v, want parsed genesis header", e.data.Header)
+	}
+
+	upstream.notify("blockchain.headers.subscribe", map[string]interface{}{"height": 1, "hex": testHeader1})
+	if e := readSSE(t, first); e.id != "1:"+testHash1 || e.data.Height != 1 || e.data.Hex != testHeader1 {
+		t.Errorf("second event = %+v, want height 1", e)
+	}
+
+	resumed := connect("0:" + testHash0)
+	if e := readSSE(t, resumed); e.id != "1:"+testHash1 || e.data.Hex != testHeader1 {
+		t.Errorf("resumed event = %+v, want replay of height 1", e)
+	}
+
+	if n := upstream.called("blockchain.headers.subscribe"); n != 1 {
+		t.Errorf("upstream subscriptions = %d, want 1", n)
+	}
+}
+
+func TestHeaderFeed_subscribe(t *testing.T) {
+	// testHeader1b replaces testHeader1 at height 1, as after a reorg.
+	testHeader1b := testHeader1[:len(testHeader1)-8] + "00000000"
+	f := NewHeaderFeed(&Relay{})
+	f.startOnce.Do(func() {})
+	for _, tip := range []*electrum.HeaderNotification{{Height: 0, Hex: testHeader0}, {Height: 1, Hex: testHeader1}, {Height: 1, Hex: testHeader1b}} {
+		f.publish(tip)
+	}
+
+	tests := []struct {
+		name        string
+		lastEventID string
+		want        []string
+	}{
+		{"no ID", "", []string{testHeader1b}},
+		{"invalid ID", "tip", []string{testHeader1b}},
+		{"remembered event", "0:" + testHash0, []string{testHeader1, testHeader1b}},
+		{"tip replaced at the same height", "1:" + testHash1, []string{testHeader1b}},
+		{"forgotten event", "1:" + strings.Repeat("0", 64), []string{testHeader1, testHeader1b}},
+		{"bare height", "0", []string{testHeader1, testHeader1b}},
+		{"latest tip", "1:" + f.history[2].Header.Hash, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, replay := f.subscribe(tt.lastEventID)
+			defer f.unsubscribe(c)
+			var got []string
+			for _, e := range replay {
+				got = append(got, e.Hex)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("subscribe(%q) replayed %d events %v, want %v", tt.lastEventID, len(got), got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,386 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// HealthConfig controls how peers are checked and when they are considered unhealthy. Zero fields take their values
+// from DefaultHealthConfig.
+type HealthConfig struct {
+	// Interval is how often every peer is probed.
+	Interval time.Duration
+	// Timeout bounds each probe.
+	Timeout time.Duration
+	// Concurrency is how many peers are probed at once.
+	Concurrency int
+	// UnhealthyAfter is how many failures in a row, from probes or forwarded requests, make a peer unhealthy.
+	UnhealthyAfter int
+	// MaxTipLag is how many blocks a peer's tip may be behind the network's before the peer is unhealthy.
+	MaxTipLag int
+	// Smoothing is the weight, between 0 and 1, given to each new sample in the rolling latency and error rate.
+	Smoothing float64
+	// ReferenceLatency is the latency at which a peer's score is halved.
+	ReferenceLatency time.Duration
+}
+
+// DefaultHealthConfig is the health checking configuration used for unset fields of Relay.HealthConfig.
+var DefaultHealthConfig = HealthConfig{
+	Interval:         30 * time.Second,
+	Timeout:          10 * time.Second,
+	Concurrency:      16,
+	UnhealthyAfter:   3,
+	MaxTipLag:        2,
+	Smoothing:        0.3,
+	ReferenceLatency: 250 * time.Millisecond,
+}
+
+// withDefaults fills unset fields from DefaultHealthConfig.
+func (c HealthConfig) withDefaults() HealthConfig {
+	d := DefaultHealthConfig
+	if c.Interval <= 0 {
+		c.Interval = d.Interval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = d.Timeout
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = d.Concurrency
+	}
+	if c.UnhealthyAfter <= 0 {
+		c.UnhealthyAfter = d.UnhealthyAfter
+	}
+	if c.MaxTipLag <= 0 {
+		c.MaxTipLag = d.MaxTipLag
+	}
+	if c.Smoothing <= 0 || c.Smoothing > 1 {
+		c.Smoothing = d.Smoothing
+	}
+	if c.ReferenceLatency <= 0 {
+		c.ReferenceLatency = d.ReferenceLatency
+	}
+	return c
+}
+
+// neutralScore is the score of peers nothing is known about yet, so that new peers get a share of traffic.
+const neutralScore = 0.5
+
+// PeerHealth is what the relay knows about the health of a peer.
+type PeerHealth struct {
+	Host    string  `json:"host"`
+	Healthy bool    `json:"healthy"`
+	Score   float64 `json:"score"`
+	// Reason explains why an unhealthy peer is unhealthy.
+	Reason string `json:"reason,omitempty"`
+	// Latency is the rolling average round trip time.
+	Latency time.Duration `json:"latency_ns"`
+	// ErrorRate is the rolling fraction of probes and requests that failed.
+	ErrorRate           float64   `json:"error_rate"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Successes           int       `json:"successes"`
+	Failures            int       `json:"failures"`
+	TipHeight           int       `json:"tip_height,omitempty"`
+	TipHash             string    `json:"tip_hash,omitempty"`
+	ServerSoftware      string    `json:"server_software,omitempty"`
+	LastChecked         time.Time `json:"last_checked,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+}
+
+// HealthChecker probes the relay's peers in the background and keeps rolling statistics of how they perform, both in
+// probes and when forwarding requests, from which each peer is judged healthy or not and given a score.
+type HealthChecker struct {
+	relay  *Relay
+	config HealthConfig
+
+	mu    sync.Mutex
+	peers map[string]*PeerHealth
+	// tip is networkTip, recomputed by record whenever a peer's part in it changes, so that evaluating a peer doesn't
+	// mean going through all of them.
+	tip int
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stop      chan struct{}
+}
+
+// NewHealthChecker creates a health checker for the relay's peers. Probing starts with Start.
+func NewHealthChecker(r *Relay, config HealthConfig) *HealthChecker {
+	return &HealthChecker{
+		relay:  r,
+		config: config.withDefaults(),
+		peers:  make(map[string]*PeerHealth),
+		stop:   make(chan struct{}),
+	}
+}
+
+// Health returns the relay's health checker, creating it from HealthConfig on first use.
+func (r *Relay) Health() *HealthChecker {
+	r.healthOnce.Do(func() {
+		r.health = NewHealthChecker(r, r.HealthConfig)
+	})
+	return r.health
+}
+
+// Start probes every peer now and then every Interval, until Stop is called.
+func (h *HealthChecker) Start() {
+	h.startOnce.Do(func() {
+		go h.run()
+	})
+}
+
+// Stop stops background probing.
+func (h *HealthChecker) Stop() {
+	h.stopOnce.Do(func() {
+		close(h.stop)
+	})
+}
+
+func (h *HealthChecker) run() {
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-h.stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		h.CheckAll(ctx)
+		cancel()
+		select {
+		case <-ticker.C:
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// CheckAll probes every peer the relay can reach, a few at a time.
+func (h *HealthChecker) CheckAll(ctx context.Context) {
+	peers := h.relay.eligiblePeers()
+	sem := make(chan struct{}, h.config.Concurrency)
+	var wg sync.WaitGroup
+	for i := range peers {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func(n *electrum.Node) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := h.Check(ctx, n); err != nil {
+				log.Printf("health check of %s failed: %v\n", n.Host, err)
+			}
+		}(&peers[i])
+	}
+	wg.Wait()
+}
+
+// Check probes a single peer on a fresh connection: it connects, completes the server.version handshake, times a
+// server.ping, and fetches the peer's tip. The result is recorded in the peer's statistics.
+func (h *HealthChecker) Check(ctx context.Context, n *electrum.Node) error {
+	ctx, cancel := context.WithTimeout(ctx, h.config.Timeout)
+	defer cancel()
+	latency, tip, software, err := h.probe(ctx, n)
+	if errors.Is(err, context.Canceled) {
+		// The checker was stopped; this says nothing about the peer.
+		return err
+	}
+	h.record(n.Host, latency, err, func(p *PeerHealth) {
+		p.LastChecked = time.Now()
+		if err == nil {
+			p.TipHeight, p.TipHash = tip.Height, tip.Hash
+			p.ServerSoftware = software
+		}
+	})
+	return err
+}
+
+// probeTip is a peer's tip as reported to a probe.
+type probeTip struct {
+	Height int
+	Hash   string
+}
+
+func (h *HealthChecker) probe(ctx context.Context, n *electrum.Node) (time.Duration, probeTip, string, error) {
+	s, err := h.relay.ElectrumClient.OpenSession(ctx, n)
+	if err != nil {
+		return 0, probeTip{}, "", err
+	}
+	defer s.Close()
+	start := time.Now()
+	if err := s.Call(ctx, "server.ping", nil, nil); err != nil {
+		return 0, probeTip{}, "", fmt.Errorf("server.ping: %w", err)
+	}
+	latency := time.Since(start)
+	var tip electrum.HeaderNotification
+	if err := s.Call(ctx, "blockchain.headers.subscribe", nil, &tip); err != nil {
+		return 0, probeTip{}, "", fmt.Errorf("blockchain.headers.subscribe: %w", err)
+	}
+	header, err := electrum.ParseBlockHeader(tip.Hex)
+	if err != nil {
+		return 0, probeTip{}, "", fmt.Errorf("blockchain.headers.subscribe: %w", err)
+	}
+	var software string
+	if v := s.Version(); v != nil {
+		software = v.Software
+	}
+	return latency, probeTip{Height: tip.Height, Hash: header.Hash}, software, nil
+}
+
+// Observe records the outcome of a request forwarded to a peer. Only failures to get a response count against the
+// peer; error responses from the server are the client's problem, not the peer's.
+func (h *HealthChecker) Observe(n *electrum.Node, latency time.Duration, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	h.record(n.Host, latency, err, nil)
+}
+
+// ObserveConnState records a change in the state of a connection to a peer, so that connections failing or missing
+// keepalives count against it. Set it as the relay's electrum client's ConnStateHandler.
+func (h *HealthChecker) ObserveConnState(change electrum.ConnStateChange) {
+	switch change.State {
+	case electrum.ConnFailed, electrum.ConnUnresponsive:
+		h.record(change.Node.Host, 0, change.Err, nil)
+	case electrum.ConnDisconnected:
+		if change.Err != nil {
+			h.record(change.Node.Host, 0, change.Err, nil)
+		}
+	}
+}
+
+// record updates the rolling statistics of the peer with the given host. A zero latency is not sampled. update, if
+// not nil, is called with the peer's statistics while they are locked.
+func (h *HealthChecker) record(host string, latency time.Duration, err error, update func(p *PeerHealth)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.peers[host]
+	if !ok {
+		p = &PeerHealth{Host: host}
+		h.peers[host] = p
+	}
+	reported, height := h.reportsTip(p), p.TipHeight
+	alpha := h.config.Smoothing
+	failed := 0.0
+	if err != nil {
+		failed = 1
+		p.Failures++
+		p.ConsecutiveFailures++
+		p.LastError = err.Error()
+	} else {
+		p.Successes++
+		p.ConsecutiveFailures = 0
+		p.LastError = ""
+	}
+	if p.Successes+p.Failures == 1 {
+		p.ErrorRate = failed
+	} else {
+		p.ErrorRate = alpha*failed + (1-alpha)*p.ErrorRate
+	}
+	if latency > 0 {
+		if p.Latency == 0 {
+			p.Latency = latency
+		} else {
+			p.Latency = time.Duration(alpha*float64(latency) + (1-alpha)*float64(p.Latency))
+		}
+	}
+	if update != nil {
+		update(p)
+	}
+	if h.reportsTip(p) != reported || p.TipHeight != height {
+		h.tip = h.networkTip()
+	}
+}
+
+// NetworkTip returns the tip height the network is taken to be at, from the tips its peers reported when last probed,
+// or 0 if none have been.
+func (h *HealthChecker) NetworkTip() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.tip
+}
+
+// networkTip returns the tip height the network is taken to be at: the second highest tip reported, so that a single
+// peer claiming an inflated height can't make every other peer look stale. With one peer reporting it is that peer's.
+// Callers must hold h.mu.
+func (h *HealthChecker) networkTip() int {
+	var tips []int
+	for _, p := range h.peers {
+		if h.reportsTip(p) {
+			tips = append(tips, p.TipHeight)
+		}
+	}
+	if len(tips) == 0 {
+		return 0
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(tips)))
+	if len(tips) == 1 {
+		return tips[0]
+	}
+	return tips[1]
+}
+
+// reportsTip reports whether p's tip counts towards networkTip: whether it has reported one and isn't failing.
+func (h *HealthChecker) reportsTip(p *PeerHealth) bool {
+	return p.TipHeight > 0 && p.ConsecutiveFailures < h.config.UnhealthyAfter
+}
+
+// evaluate fills in whether p is healthy, and its score. Scores are between 0 and 1: the fraction of recent requests
+// that succeeded, scaled down as latency grows past ReferenceLatency. Unhealthy peers score 0, and so do peers whose
+// tip is not on the relay's header chain.
+func (h *HealthChecker) evaluate(p PeerHealth, tip int) PeerHealth {
+	p.Healthy, p.Reason = true, ""
+	switch {
+	case p.ConsecutiveFailures >= h.config.UnhealthyAfter:
+		p.Healthy, p.Reason = false, fmt.Sprintf("%d consecutive failures", p.ConsecutiveFailures)
+	case p.TipHeight > 0 && tip-p.TipHeight > h.config.MaxTipLag:
+		p.Healthy, p.Reason = false, fmt.Sprintf("tip %d is %d blocks behind the network", p.TipHeight, tip-p.TipHeight)
+	case h.relay.offChain(p.TipHeight, p.TipHash):
+		p.Healthy, p.Reason = false, fmt.Sprintf("tip %s at %d is not on the best chain", p.TipHash, p.TipHeight)
+	}
+	switch {
+	case !p.Healthy:
+		p.Score = 0
+	case p.Latency == 0:
+		p.Score = neutralScore * (1 - p.ErrorRate)
+	default:
+		p.Score = (1 - p.ErrorRate) / (1 + float64(p.Latency)/float64(h.config.ReferenceLatency))
+	}
+	return p
+}
+
+// Peer returns the health of the peer with the given host. Peers nothing is known about yet are healthy, with a
+// neutral score.
+func (h *HealthChecker) Peer(host string) PeerHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.peers[host]
+	if !ok {
+		return PeerHealth{Host: host, Healthy: true, Score: neutralScore}
+	}
+	return h.evaluate(*p, h.tip)
+}
+
+// Snapshot returns the health of every peer anything is known about, keyed by host.
+func (h *HealthChecker) Snapshot() map[string]PeerHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make(map[string]PeerHealth, len(h.peers))
+	for host, p := range h.peers {
+		out[host] = h.evaluate(*p, h.tip)
+	}
+	return out
+}
@@ -0,0 +1,141 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// newTipElectrum starts a fake Electrum server on the given loopback IP at the given tip height.
+func newTipElectrum(t *testing.T, ip string, height int) *fakeElectrum {
+	return newFakeElectrumAt(t, ip, func(req *fakeRequest) (interface{}, error) {
+		switch req.Method {
+		case "server.ping":
+			return nil, nil
+		case "blockchain.headers.subscribe":
+			return map[string]interface{}{"height": height, "hex": testHeader0}, nil
+		}
+		return nil, errors.New("unknown method")
+	})
+}
+
+// deadNode returns a node nothing is listening on.
+func deadNode(t *testing.T) electrum.Node {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	_ = ln.Close()
+	return electrum.Node{Host: "127.0.0.2", TCPPort: port}
+}
+
+func TestHealthChecker_CheckAll(t *testing.T) {
+	up := newTipElectrum(t, "127.0.0.1", 100)
+	behind := newTipElectrum(t, "127.0.0.3", 90)
+	also := newTipElectrum(t, "127.0.0.4", 101)
+	peers := []electrum.Node{up.node(), behind.node(), also.node(), deadNode(t)}
+	r := &Relay{
+		Peers:          peers,
+		ElectrumClient: newTestClient(t),
+		HealthConfig:   HealthConfig{UnhealthyAfter: 2, Timeout: time.Second},
+	}
+	for i := 0; i < 2; i++ {
+		r.Health().CheckAll(context.Background())
+	}
+
+	tests := []struct {
+		host        string
+		wantHealthy bool
+		wantTip     int
+	}{
+		{peers[0].Host, true, 100},
+		{peers[1].Host, false, 90},
+		{peers[2].Host, true, 101},
+		{peers[3].Host, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			p := r.Health().Peer(tt.host)
+			if p.Healthy != tt.wantHealthy {
+				t.Errorf("Healthy = %v (%s), want %v", p.Healthy, p.Reason, tt.wantHealthy)
+			}
+			if p.TipHeight != tt.wantTip {
+				t.Errorf("TipHeight = %d, want %d", p.TipHeight, tt.wantTip)
+			}
+			if tt.wantHealthy && (p.Score <= 0 || p.Latency <= 0 || p.ErrorRate != 0 || p.ServerSoftware == "") {
+				t.Errorf("healthy peer stats = %+v, want a score, latency, software and no errors", p)
+			}
+			if !tt.wantHealthy && p.Score != 0 {
+				t.Errorf("unhealthy peer Score = %v, want 0", p.Score)
+			}
+		})
+	}
+
+	for i := 0; i < 50; i++ {
+		n := r.pickPeer(context.Background())
+		if h := r.Health().Peer(n.Host); !h.Healthy {
+			t.Fatalf("pickPeer() returned unhealthy peer %s", n.Host)
+		}
+	}
+}
+
+func TestHealthChecker_Observe(t *testing.T) {
+	r := &Relay{ElectrumClient: newTestClient(t), HealthConfig: HealthConfig{UnhealthyAfter: 2}}
+	h := r.Health()
+	n := &electrum.Node{Host: "electrum.example.com"}
+
+	if p := h.Peer(n.Host); !p.Healthy || p.Score != neutralScore {
+		t.Errorf("unknown peer = %+v, want healthy with a neutral score", p)
+	}
+	h.Observe(n, 10*time.Millisecond, nil)
+	h.Observe(n, 0, context.Canceled)
+	if p := h.Peer(n.Host); p.Failures != 0 || p.Latency != 10*time.Millisecond {
+		t.Errorf("peer = %+v, want one success and cancellations ignored", p)
+	}
+	h.ObserveConnState(electrum.ConnStateChange{Node: n, State: electrum.ConnUnresponsive, Err: errors.New("missed ping")})
+	h.ObserveConnState(electrum.ConnStateChange{Node: n, State: electrum.ConnDisconnected})
+	h.ObserveConnState(electrum.ConnStateChange{Node: n, State: electrum.ConnFailed, Err: errors.New("refused")})
+	p := h.Peer(n.Host)
+	if p.Healthy || p.ConsecutiveFailures != 2 || p.LastError != "refused" {
+		t.Errorf("peer = %+v, want unhealthy after two failures", p)
+	}
+	h.Observe(n, 10*time.Millisecond, nil)
+	if p := h.Peer(n.Host); !p.Healthy || p.ErrorRate <= 0 || p.ErrorRate >= 1 {
+		t.Errorf("peer = %+v, want healthy again with a partial error rate", p)
+	}
+}
+
+func TestHealthChecker_NetworkTip(t *testing.T) {
+	r := &Relay{ElectrumClient: newTestClient(t), HealthConfig: HealthConfig{UnhealthyAfter: 2}}
+	h := r.Health()
+	tip := func(height int) func(p *PeerHealth) {
+		return func(p *PeerHealth) { p.TipHeight = height }
+	}
+	steps := []struct {
+		name  string
+		apply func()
+		want  int
+	}{
+		{"no tips", func() {}, 0},
+		{"one tip", func() { h.record("a", 0, nil, tip(100)) }, 100},
+		{"second highest", func() { h.record("b", 0, nil, tip(120)); h.record("c", 0, nil, tip(130)) }, 120},
+		{"failing peer left out", func() {
+			h.record("b", 0, errors.New("refused"), nil)
+			h.record("b", 0, errors.New("refused"), nil)
+		}, 100},
+		{"recovered peer counted again", func() { h.record("b", 0, nil, nil) }, 120},
+		{"tip moves", func() { h.record("a", 0, nil, tip(125)) }, 125},
+	}
+	for _, step := range steps {
+		step.apply()
+		if got := h.NetworkTip(); got != step.want {
+			t.Errorf("%s: NetworkTip() = %d, want %d", step.name, got, step.want)
+		}
+	}
+}
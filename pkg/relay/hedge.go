@@ -0,0 +1,174 @@
+package relay
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// HedgeConfig controls hedged requests: when a peer is slow to answer a read-only request, the request is also sent to
+// a second peer, and whichever answers first wins. Zero fields take their values from DefaultHedgeConfig.
+type HedgeConfig struct {
+	// Percentile, between 0 and 1, picks the delay after which a request is hedged from the distribution of recent
+	// response times. At 0.95 about one request in twenty is hedged.
+	Percentile float64
+	// MinDelay and MaxDelay bound the delay. MaxDelay is used until MinSamples response times have been seen.
+	MinDelay   time.Duration
+	MaxDelay   time.Duration
+	MinSamples int
+	// Methods are patterns of the methods that may be hedged, matched as by MatchMethod. They must be safe to send more
+	// than once; blockchain.transaction.broadcast is never hedged.
+	Methods []string
+}
+
+// DefaultHedgeConfig is the hedging configuration used for unset fields of Relay.Hedging.
+var DefaultHedgeConfig = HedgeConfig{
+	Percentile: 0.95,
+	MinDelay:   5 * time.Millisecond,
+	MaxDelay:   time.Second,
+	MinSamples: 20,
+	Methods:    DefaultRetryMethods,
+}
+
+// WithHedging enables hedged requests.
+func WithHedging(config HedgeConfig) Option {
+	return func(r *Relay) {
+		r.Hedging = &config
+	}
+}
+
+// withDefaults fills unset fields from DefaultHedgeConfig.
+func (c HedgeConfig) withDefaults() HedgeConfig {
+	d := DefaultHedgeConfig
+	if c.Percentile <= 0 || c.Percentile > 1 {
+		c.Percentile = d.Percentile
+	}
+	if c.MinDelay <= 0 {
+		c.MinDelay = d.MinDelay
+	}
+	if c.MaxDelay <= 0 {
+		c.MaxDelay = d.MaxDelay
+	}
+	if c.MinDelay > c.MaxDelay {
+		c.MinDelay = c.MaxDelay
+	}
+	if c.MinSamples <= 0 {
+		c.MinSamples = d.MinSamples
+	}
+	if c.Methods == nil {
+		c.Methods = d.Methods
+	}
+	return c
+}
+
+// latencySamples is how many recent response times the relay keeps to derive the hedge delay from.
+const latencySamples = 512
+
+// latencies is a ring of recent response times of successful requests, across all peers and methods.
+type latencies struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.samples) < latencySamples {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencySamples
+}
+
+// percentile returns the p-th percentile of the samples, or false if there are fewer than min of them.
+func (l *latencies) percentile(p float64, min int) (time.Duration, bool) {
+	l.mu.Lock()
+	sorted := append([]time.Duration(nil), l.samples...)
+	l.mu.Unlock()
+	if len(sorted) == 0 || len(sorted) < min {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i], true
+}
+
+// hedgeDelay returns how long to wait for a peer before hedging.
+func (r *Relay) hedgeDelay(config HedgeConfig) time.Duration {
+	d, ok := r.latencies.percentile(config.Percentile, config.MinSamples)
+	switch {
+	case !ok || d > config.MaxDelay:
+		return config.MaxDelay
+	case d < config.MinDelay:
+		return config.MinDelay
+	}
+	return d
+}
+
+// hedge sends req to n. If hedging is enabled for the method and n hasn't answered within the hedge delay, req is also
+// sent to a peer not in tried, and the first successful response is returned. The request still in flight is then
+// cancelled: its session forgets it and drops the response if it comes, so the connection stays usable. hedge returns
+// the hosts req was sent to, and the last failure if none succeeded.
+func (r *Relay) hedge(ctx context.Context, n *electrum.Node, req []byte, method string, tried []string) ([]byte, []string, error) {
+	if r.Hedging == nil || method == broadcastMethod {
+		resp, err := r.send(ctx, n, req)
+		return resp, []string{n.Host}, err
+	}
+	config := r.Hedging.withDefaults()
+	if !matchAny(config.Methods, method) {
+		resp, err := r.send(ctx, n, req)
+		return resp, []string{n.Host}, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		resp []byte
+		err  error
+	}
+	// Buffered so that the loser can finish after hedge has returned.
+	results := make(chan result, 2)
+	start := func(n *electrum.Node) {
+		go func() {
+			resp, err := r.send(ctx, n, req)
+			results <- result{resp, err}
+		}()
+	}
+	start(n)
+	hosts := []string{n.Host}
+	pending := 1
+	timer := time.NewTimer(r.hedgeDelay(config))
+	defer timer.Stop()
+	var err error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			exclude := append(append([]string(nil), tried...), hosts...)
+			second := r.pick(untried(r.eligiblePeers(), exclude), ClientKey(ctx))
+			if second == nil {
+				continue
+			}
+			start(second)
+			hosts = append(hosts, second.Host)
+			pending++
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.resp, hosts, nil
+			}
+			err = res.err
+		}
+	}
+	return nil, hosts, err
+}
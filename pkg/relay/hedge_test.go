@@ -0,0 +1,103 @@
+package relay
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+func TestRelay_hedge(t *testing.T) {
+	const slowness = 300 * time.Millisecond
+	slow := newFakeElectrumAt(t, "127.0.0.1", func(req *fakeRequest) (interface{}, error) {
+		time.Sleep(slowness)
+		return "slow", nil
+	})
+	fast := newFakeElectrumAt(t, "127.0.0.3", func(req *fakeRequest) (interface{}, error) {
+		return "fast", nil
+	})
+
+	tests := []struct {
+		name      string
+		peers     []electrum.Node
+		method    string
+		hedging   *HedgeConfig
+		wantHosts []string
+	}{
+		{
+			name:      "slow peer is hedged",
+			peers:     []electrum.Node{slow.node(), fast.node()},
+			method:    "blockchain.scripthash.get_balance",
+			hedging:   &HedgeConfig{MaxDelay: 20 * time.Millisecond},
+			wantHosts: []string{slow.node().Host, fast.node().Host},
+		},
+		{
+			name:      "fast peer is not hedged",
+			peers:     []electrum.Node{fast.node(), slow.node()},
+			method:    "blockchain.scripthash.get_balance",
+			hedging:   &HedgeConfig{MaxDelay: 100 * time.Millisecond},
+			wantHosts: []string{fast.node().Host},
+		},
+		{
+			name:      "broadcasts are never hedged",
+			peers:     []electrum.Node{slow.node(), fast.node()},
+			method:    "blockchain.transaction.broadcast",
+			hedging:   &HedgeConfig{MaxDelay: 20 * time.Millisecond, Methods: []string{"*"}},
+			wantHosts: []string{slow.node().Host},
+		},
+		{
+			name:      "hedging disabled",
+			peers:     []electrum.Node{slow.node(), fast.node()},
+			method:    "blockchain.scripthash.get_balance",
+			wantHosts: []string{slow.node().Host},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRelay(tt.peers, nil, newTestClient(t), WithBalancer(&RoundRobinBalancer{}))
+			r.Hedging = tt.hedging
+			req := []byte(`{"jsonrpc":"2.0","method":"` + tt.method + `","params":[],"id":1}`)
+			first := r.pickPeer(context.Background())
+			resp, hosts, err := r.hedge(context.Background(), first, req, tt.method, nil)
+			if err != nil || len(resp) == 0 {
+				t.Fatalf("hedge() = %s, %v, want a response", resp, err)
+			}
+			if !reflect.DeepEqual(hosts, tt.wantHosts) {
+				t.Errorf("hedge() sent to %v, want %v", hosts, tt.wantHosts)
+			}
+			if len(hosts) < 2 {
+				return
+			}
+			// The losing request is cancelled rather than left to run its course.
+			deadline := time.Now().Add(slowness / 2)
+			for r.outstanding.get(slow.node().Host) != 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("request to the slow peer still outstanding after the hedge won")
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestRelay_hedgeDelay(t *testing.T) {
+	r := &Relay{}
+	config := HedgeConfig{Percentile: 0.9, MinDelay: 2 * time.Millisecond, MaxDelay: 50 * time.Millisecond, MinSamples: 10}.withDefaults()
+	if got := r.hedgeDelay(config); got != config.MaxDelay {
+		t.Errorf("hedgeDelay() without samples = %v, want MaxDelay", got)
+	}
+	for i := 1; i <= 10; i++ {
+		r.latencies.add(time.Duration(i) * time.Millisecond)
+	}
+	if got, want := r.hedgeDelay(config), 9*time.Millisecond; got != want {
+		t.Errorf("hedgeDelay() = %v, want the 90th percentile %v", got, want)
+	}
+	for i := 0; i < latencySamples; i++ {
+		r.latencies.add(time.Millisecond)
+	}
+	if got := r.hedgeDelay(config); got != config.MinDelay {
+		t.Errorf("hedgeDelay() = %v, want MinDelay once old samples have been replaced", got)
+	}
+}
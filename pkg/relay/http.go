@@ -0,0 +1,45 @@
+package relay
+
+import (
+	"log"
+	"net/http"
+)
+
+// ServeHTTP handles a JSON RPC request or batch posted in the body of an HTTP request, and writes the response.
+// Failures are reported as JSON RPC error responses echoing the request's id, with an HTTP status matching the
+// failure. Error responses from the upstream server are passed through unchanged with status 200.
+func (r *Relay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	body, err := r.validateRequest(w, req)
+	if err != nil {
+		writeError(w, body, err)
+		return
+	}
+	resp, err := r.ForwardRequestContext(WithClientKey(req.Context(), remoteHost(req)), body)
+	if err != nil {
+		writeError(w, body, err)
+		return
+	}
+	if len(resp) == 0 {
+		// Batches made up only of notifications have no response.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if _, err := w.Write(resp); err != nil {
+		log.Printf("error writing response to %s: %v\n", req.RemoteAddr, err)
+	}
+}
+
+// writeError logs err and writes it as a JSON RPC error response to req.
+func writeError(w http.ResponseWriter, req []byte, err error) {
+	log.Println(err)
+	e := AsError(err)
+	var id []byte
+	if !IsBatch(req) {
+		id = RequestID(req)
+	}
+	w.WriteHeader(e.Status)
+	if _, err := w.Write(e.Response(id)); err != nil {
+		log.Printf("error writing error response: %v\n", err)
+	}
+}
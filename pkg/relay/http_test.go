@@ -0,0 +1,141 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+func TestRelay_ServeHTTP(t *testing.T) {
+	upstream := newFakeElectrum(t, func(req *fakeRequest) (interface{}, error) {
+		switch req.Method {
+		case "server.ping":
+			return nil, nil
+		case "blockchain.transaction.get":
+			return nil, &electrum.RPCError{Code: 2, Message: "daemon error: transaction not found"}
+		case "blockchain.estimatefee":
+			time.Sleep(time.Second)
+			return 0.0001, nil
+		}
+		return nil, &electrum.RPCError{Code: -32601, Message: "unknown method"}
+	})
+
+	tests := []struct {
+		name       string
+		peers      []electrum.Node
+		body       string
+		timeout    time.Duration
+		wantStatus int
+		wantID     string
+		wantCode   int
+		wantResp   string
+	}{
+		{
+			name:       "success",
+			body:       `{"jsonrpc":"2.0","method":"server.ping","params":[],"id":"abc"}`,
+			wantStatus: http.StatusOK,
+			wantID:     `"abc"`,
+		},
+		{
+			name:       "parse error",
+			body:       `{"jsonrpc":"2.0",`,
+			wantStatus: http.StatusBadRequest,
+			wantID:     "null",
+			wantCode:   CodeParseError,
+		},
+		{
+			name:       "invalid request",
+			body:       `{"jsonrpc":"2.0","params":[],"id":4}`,
+			wantStatus: http.StatusBadRequest,
+			wantID:     "4",
+			wantCode:   CodeInvalidRequest,
+		},
+		{
+			name:       "body too large",
+			body:       strings.Repeat(" ", MaxRequestSize) + `{"jsonrpc":"2.0","method":"server.ping","params":[],"id":9}`,
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantID:     "null",
+			wantCode:   CodeInvalidRequest,
+		},
+		{
+			name:       "forbidden method",
+			body:       `{"jsonrpc":"2.0","method":"server.banner","params":[],"id":5}`,
+			wantStatus: http.StatusForbidden,
+			wantID:     "5",
+			wantCode:   CodeMethodForbidden,
+		},
+		{
+			name:       "upstream error passed through",
+			body:       `{"jsonrpc":"2.0","method":"blockchain.transaction.get","params":["00"],"id":6}`,
+			wantStatus: http.StatusOK,
+			wantID:     "6",
+			wantCode:   2,
+			wantResp:   "daemon error: transaction not found",
+		},
+		{
+			name:       "upstream timeout",
+			body:       `{"jsonrpc":"2.0","method":"blockchain.estimatefee","params":[1],"id":7}`,
+			timeout:    100 * time.Millisecond,
+			wantStatus: http.StatusGatewayTimeout,
+			wantID:     "7",
+			wantCode:   CodeUpstreamTimeout,
+		},
+		{
+			name:       "no peers",
+			peers:      []electrum.Node{},
+			body:       `{"jsonrpc":"2.0","method":"server.ping","params":[],"id":8}`,
+			wantStatus: http.StatusServiceUnavailable,
+			wantID:     "8",
+			wantCode:   CodeNoPeers,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peers := tt.peers
+			if peers == nil {
+				peers = []electrum.Node{upstream.node()}
+			}
+			r := &Relay{
+				Peers:            peers,
+				ForbiddenMethods: []string{"server.banner"},
+				ElectrumClient:   newTestClient(t),
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			if tt.timeout > 0 {
+				ctx, cancel := context.WithTimeout(req.Context(), tt.timeout)
+				defer cancel()
+				req = req.WithContext(ctx)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			var resp electrum.JSONRPCResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid response %s: %v", w.Body, err)
+			}
+			if string(resp.ID) != tt.wantID {
+				t.Errorf("id = %s, want %s", resp.ID, tt.wantID)
+			}
+			switch {
+			case tt.wantCode == 0 && resp.Error != nil:
+				t.Errorf("error = %v, want none", resp.Error)
+			case tt.wantCode != 0 && (resp.Error == nil || resp.Error.Code != tt.wantCode):
+				t.Errorf("error = %v, want code %d", resp.Error, tt.wantCode)
+			case tt.wantResp != "" && resp.Error.Message != tt.wantResp:
+				t.Errorf("error message = %q, want %q", resp.Error.Message, tt.wantResp)
+			}
+		})
+	}
+}
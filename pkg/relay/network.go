@@ -0,0 +1,128 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// WithNetwork makes the relay serve network n: peers are only registered once they are verified to serve it.
+func WithNetwork(n electrum.Network) Option {
+	return func(r *Relay) {
+		r.Network = &n
+	}
+}
+
+// ErrWrongNetwork is returned, wrapped in a *NetworkError, for peers that serve a different network than the relay.
+var ErrWrongNetwork = errors.New("peer serves a different network")
+
+// NetworkError is a peer that serves a different network than the relay.
+type NetworkError struct {
+	Host string
+	// Want is the relay's network, and GenesisHash the genesis block hash the peer reported.
+	Want        string
+	GenesisHash string
+}
+
+// Error implements the error interface.
+func (e *NetworkError) Error() string {
+	got := "the chain with genesis block " + e.GenesisHash
+	if n := electrum.NetworkByGenesis(e.GenesisHash); n != nil {
+		got = n.Name
+	}
+	return fmt.Sprintf("peer %s serves %s, not %s", e.Host, got, e.Want)
+}
+
+// Is makes NetworkError match ErrWrongNetwork.
+func (e *NetworkError) Is(target error) bool {
+	return target == ErrWrongNetwork
+}
+
+// VerifyPeer checks that n serves the relay's Network, by the genesis block hash it reports in server.features, and
+// records the network in n. Any peer passes if the relay has no Network.
+func (r *Relay) VerifyPeer(ctx context.Context, n *electrum.Node) error {
+	if r.Network == nil {
+		return nil
+	}
+	features, err := r.ElectrumClient.ServerFeatures(ctx, n)
+	if err != nil {
+		return fmt.Errorf("server.features of %s: %w", n.Host, err)
+	}
+	if !strings.EqualFold(features.GenesisHash, r.Network.GenesisHash) {
+		return &NetworkError{Host: n.Host, Want: r.Network.Name, GenesisHash: features.GenesisHash}
+	}
+	n.Network = r.Network.Name
+	return nil
+}
+
+// verifyConcurrency is how many peers are verified at once.
+const verifyConcurrency = 16
+
+// verifyPeers verifies peers a few at a time, each within DefaultTimeout, returning those that serve the relay's
+// Network, in order, and the last failure of those that don't. Failures are logged.
+func (r *Relay) verifyPeers(ctx context.Context, peers []electrum.Node) ([]electrum.Node, error) {
+	peers = append([]electrum.Node(nil), peers...)
+	errs := make([]error, len(peers))
+	sem := make(chan struct{}, verifyConcurrency)
+	var wg sync.WaitGroup
+	for i := range peers {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			ctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+			defer cancel()
+			errs[i] = r.VerifyPeer(ctx, &peers[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var verified []electrum.Node
+	var last error
+	for i, err := range errs {
+		if err != nil {
+			log.Printf("not registering %s: %v\n", peers[i].Host, err)
+			last = err
+			continue
+		}
+		verified = append(verified, peers[i])
+	}
+	return verified, last
+}
+
+// BootstrapServers registers each of servers, once verified to serve the relay's Network if it has one, and then the
+// peers it lists, as BootstrapContext does. Registering each server is given DefaultTimeout. It fails only if no
+// peers are registered at all, so that one unreachable server, or a lone regtest server with no peers to list, doesn't
+// stop the relay from starting.
+func (r *Relay) BootstrapServers(ctx context.Context, servers []electrum.Node) error {
+	var last error
+	for i := range servers {
+		server := servers[i]
+		sctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+		err := r.RegisterPeerContext(sctx, &server)
+		cancel()
+		if err == nil {
+			err = r.BootstrapContext(ctx, &server)
+		}
+		if err != nil {
+			log.Printf("bootstrapping from %s: %v\n", server.Host, err)
+			last = err
+		}
+	}
+	r.PeerMutex.Lock()
+	peers := len(r.Peers)
+	r.PeerMutex.Unlock()
+	if peers == 0 {
+		if last == nil {
+			last = errors.New("no bootstrap servers")
+		}
+		return fmt.Errorf("no peers registered: %w", last)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// newNetworkElectrum returns a fake server on network that lists peers in server.peers.subscribe.
+func newNetworkElectrum(t *testing.T, ip string, network *electrum.Network, peers ...electrum.Node) *fakeElectrum {
+	return newFakeElectrumAt(t, ip, func(req *fakeRequest) (interface{}, error) {
+		switch req.Method {
+		case "server.features":
+			return electrum.ServerFeatures{GenesisHash: network.GenesisHash, ProtocolMin: "1.4", ProtocolMax: "1.4.2"}, nil
+		case "server.peers.subscribe":
+			list := [][]interface{}{}
+			for _, p := range peers {
+				list = append(list, []interface{}{p.Host, p.Host, []interface{}{"v1.4", "t" + strconv.Itoa(p.TCPPort)}})
+			}
+			return list, nil
+		}
+		return nil, errors.New("unknown method")
+	})
+}
+
+func TestRelay_VerifyPeer(t *testing.T) {
+	regtest := newNetworkElectrum(t, "127.0.0.1", &electrum.RegTest)
+	testnet := newNetworkElectrum(t, "127.0.0.3", &electrum.TestNet)
+	broken := newFakeElectrumAt(t, "127.0.0.4", func(req *fakeRequest) (interface{}, error) {
+		return nil, errors.New("unknown method")
+	})
+
+	tests := []struct {
+		name    string
+		network *electrum.Network
+		peer    electrum.Node
+		wantErr error
+		errText string
+	}{
+		{"same network", &electrum.RegTest, regtest.node(), nil, ""},
+		{"different network", &electrum.RegTest, testnet.node(), ErrWrongNetwork, "serves testnet, not regtest"},
+		{"features fail", &electrum.RegTest, broken.node(), errors.New(""), "server.features"},
+		{"relay without a network", nil, testnet.node(), nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []Option
+			if tt.network != nil {
+				opts = append(opts, WithNetwork(*tt.network))
+			}
+			r := NewRelay(nil, nil, newTestClient(t), opts...)
+			n := tt.peer
+			err := r.VerifyPeer(context.Background(), &n)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("VerifyPeer() error = %v", err)
+			case tt.wantErr != nil && err == nil:
+				t.Fatal("VerifyPeer() succeeded")
+			case tt.wantErr == ErrWrongNetwork && !errors.Is(err, ErrWrongNetwork):
+				t.Errorf("VerifyPeer() error = %v, want %v", err, ErrWrongNetwork)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.errText) {
+				t.Errorf("VerifyPeer() error = %q, want it to contain %q", err, tt.errText)
+			}
+			wantNetwork := ""
+			if err == nil && tt.network != nil {
+				wantNetwork = tt.network.Name
+			}
+			if n.Network != wantNetwork {
+				t.Errorf("Network = %q, want %q", n.Network, wantNetwork)
+			}
+		})
+	}
+}
+
+func TestRelay_BootstrapServers(t *testing.T) {
+	good := newNetworkElectrum(t, "127.0.0.3", &electrum.RegTest)
+	wrong := newNetworkElectrum(t, "127.0.0.4", &electrum.MainNet)
+	lister := newNetworkElectrum(t, "127.0.0.1", &electrum.RegTest, good.node(), wrong.node(), deadNode(t))
+	lone := newNetworkElectrum(t, "127.0.0.5", &electrum.RegTest)
+
+	tests := []struct {
+		name      string
+		servers   []electrum.Node
+		wantHosts []string
+		wantErr   bool
+	}{
+		{"registers the server and its peers on the network", []electrum.Node{lister.node()}, []string{"127.0.0.1", "127.0.0.3"}, false},
+		{"lone server", []electrum.Node{lone.node()}, []string{"127.0.0.5"}, false},
+		{"skips servers on other networks", []electrum.Node{wrong.node(), lone.node()}, []string{"127.0.0.5"}, false},
+		{"skips duplicates", []electrum.Node{lister.node(), good.node()}, []string{"127.0.0.1", "127.0.0.3"}, false},
+		{"no server on the network", []electrum.Node{wrong.node()}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRelay(nil, nil, newTestClient(t), WithNetwork(electrum.RegTest))
+			err := r.BootstrapServers(context.Background(), tt.servers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("BootstrapServers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var hosts []string
+			for _, p := range r.Peers {
+				hosts = append(hosts, p.Host)
+				if p.Network != electrum.RegTest.Name {
+					t.Errorf("peer %s Network = %q, want %q", p.Host, p.Network, electrum.RegTest.Name)
+				}
+			}
+			sort.Strings(hosts)
+			if strings.Join(hosts, ",") != strings.Join(tt.wantHosts, ",") {
+				t.Errorf("peers = %v, want %v", hosts, tt.wantHosts)
+			}
+		})
+	}
+}
+
+func TestRelay_BootstrapServersParsed(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	_ = ln.Close()
+	srv := newNetworkElectrum(t, "::1", &electrum.RegTest)
+	n, err := electrum.RegTest.ParseServer(fmt.Sprintf("[::1]:%d:t", srv.node().TCPPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRelay(nil, nil, newTestClient(t), WithNetwork(electrum.RegTest))
+	if err := r.BootstrapServers(context.Background(), []electrum.Node{*n}); err != nil {
+		t.Fatalf("BootstrapServers() error = %v", err)
+	}
+	if len(r.Peers) != 1 || r.Peers[0].Host != "::1" {
+		t.Errorf("peers = %+v, want just ::1", r.Peers)
+	}
+}
+
+func TestRelay_RegisterPeersNetwork(t *testing.T) {
+	good := newNetworkElectrum(t, "127.0.0.3", &electrum.RegTest)
+	wrong := newNetworkElectrum(t, "127.0.0.4", &electrum.TestNet)
+
+	r := NewRelay(nil, nil, newTestClient(t), WithNetwork(electrum.RegTest))
+	if err := r.RegisterPeers([]electrum.Node{good.node(), wrong.node()}); !errors.Is(err, ErrWrongNetwork) {
+		t.Errorf("RegisterPeers() error = %v, want %v", err, ErrWrongNetwork)
+	}
+	if len(r.Peers) != 0 {
+		t.Errorf("RegisterPeers() registered %d peers despite failing", len(r.Peers))
+	}
+	wrongNode := wrong.node()
+	if err := r.RegisterPeer(&wrongNode); !errors.Is(err, ErrWrongNetwork) {
+		t.Errorf("RegisterPeer() error = %v, want %v", err, ErrWrongNetwork)
+	}
+	if err := r.RegisterPeers([]electrum.Node{good.node()}); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Peers) != 1 || r.Peers[0].Network != "regtest" {
+		t.Errorf("Peers = %+v, want just the regtest peer", r.Peers)
+	}
+}
@@ -0,0 +1,211 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// QuorumConfig controls consensus reads: requests for the selected methods are sent to several peers at once, and a
+// response is only returned once enough of them agree on it. Zero fields take their values from DefaultQuorumConfig.
+type QuorumConfig struct {
+	// Methods are patterns of the methods that need a quorum, matched as by MatchMethod.
+	Methods []string
+	// Peers is how many peers each request is sent to, and Agree how many of them must return the same result.
+	Peers int
+	Agree int
+}
+
+// DefaultQuorumMethods are the methods that need a quorum by default: those a lying or lagging server could mislead a
+// wallet with.
+var DefaultQuorumMethods = []string{
+	"blockchain.headers.subscribe",
+	"blockchain.scripthash.get_balance",
+	"blockchain.transaction.get",
+}
+
+// DefaultQuorumConfig is the consensus configuration used for unset fields of Relay.Quorum.
+var DefaultQuorumConfig = QuorumConfig{
+	Methods: DefaultQuorumMethods,
+	Peers:   3,
+	Agree:   2,
+}
+
+// WithQuorum enables consensus reads.
+func WithQuorum(config QuorumConfig) Option {
+	return func(r *Relay) {
+		r.Quorum = &config
+	}
+}
+
+// withDefaults fills unset fields from DefaultQuorumConfig.
+func (c QuorumConfig) withDefaults() QuorumConfig {
+	d := DefaultQuorumConfig
+	if c.Methods == nil {
+		c.Methods = d.Methods
+	}
+	if c.Peers <= 0 {
+		c.Peers = d.Peers
+	}
+	if c.Agree <= 0 {
+		c.Agree = d.Agree
+	}
+	if c.Agree > c.Peers {
+		c.Agree = c.Peers
+	}
+	return c
+}
+
+// ErrDisagreement is returned, wrapped in a *QuorumError, when peers asked for a quorum return different results.
+var ErrDisagreement = errors.New("peers disagree")
+
+// QuorumGroup is a set of peers that returned the same result.
+type QuorumGroup struct {
+	Peers []string
+	// Result is the normalized result the peers agreed on: the JSON RPC result, or the code of the JSON RPC error.
+	Result json.RawMessage
+}
+
+// QuorumError is a request for which too few peers returned the same result.
+type QuorumError struct {
+	Method string
+	// Agree is how many peers had to agree.
+	Agree int
+	// Groups are the results returned, with the peers that returned each, in the order they were first seen.
+	Groups []QuorumGroup
+	// Failed are the peers that returned no usable response, and Err the last of their failures.
+	Failed []string
+	Err    error
+}
+
+// Error implements the error interface.
+func (e *QuorumError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "no %d peers agreed on %s:", e.Agree, e.Method)
+	for _, g := range e.Groups {
+		fmt.Fprintf(&b, " [%s] returned %s;", strings.Join(g.Peers, ", "), g.Result)
+	}
+	if len(e.Failed) > 0 {
+		fmt.Fprintf(&b, " [%s] failed: %v", strings.Join(e.Failed, ", "), e.Err)
+	}
+	return strings.TrimSuffix(b.String(), ";")
+}
+
+// Unwrap returns ErrDisagreement if peers returned different results, and otherwise the last failure.
+func (e *QuorumError) Unwrap() error {
+	if len(e.Groups) > 1 {
+		return ErrDisagreement
+	}
+	return e.Err
+}
+
+// quorum returns the consensus configuration for method, or nil if it doesn't need a quorum.
+func (r *Relay) quorum(method string) *QuorumConfig {
+	if r.Quorum == nil {
+		return nil
+	}
+	config := r.Quorum.withDefaults()
+	if !matchAny(config.Methods, method) {
+		return nil
+	}
+	return &config
+}
+
+// forwardQuorum sends req to config.Peers peers at once and returns the first response config.Agree of them agree on,
+// cancelling the requests still in flight. Results are compared after normalizing them, so that formatting and key
+// order don't matter. Any disagreement is logged with the peers on each side, so that lying servers can be found.
+func (r *Relay) forwardQuorum(ctx context.Context, req []byte, method string, config *QuorumConfig) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var peers []*electrum.Node
+	var hosts []string
+	for len(peers) < config.Peers {
+		n := r.pick(untried(r.eligiblePeers(), hosts), ClientKey(ctx))
+		if n == nil {
+			break
+		}
+		peers = append(peers, n)
+		hosts = append(hosts, n.Host)
+	}
+	if len(peers) < config.Agree {
+		return nil, fmt.Errorf("%d peers must agree on %s but %d are available: %w", config.Agree, method, len(peers), ErrNoPeers)
+	}
+
+	type answer struct {
+		host string
+		resp []byte
+		err  error
+	}
+	answers := make(chan answer, len(peers))
+	for _, n := range peers {
+		go func(n *electrum.Node) {
+			resp, err := r.send(ctx, n, req)
+			answers <- answer{n.Host, resp, err}
+		}(n)
+	}
+
+	qe := &QuorumError{Method: method, Agree: config.Agree}
+	groups := make(map[string]int)
+	for range peers {
+		a := <-answers
+		result, err := a.resp, a.err
+		if err == nil {
+			result, err = normalizeResponse(a.resp)
+		}
+		if err != nil {
+			qe.Failed = append(qe.Failed, a.host)
+			qe.Err = err
+			continue
+		}
+		i, ok := groups[string(result)]
+		if !ok {
+			i = len(qe.Groups)
+			groups[string(result)] = i
+			qe.Groups = append(qe.Groups, QuorumGroup{Result: result})
+		}
+		qe.Groups[i].Peers = append(qe.Groups[i].Peers, a.host)
+		if len(qe.Groups[i].Peers) >= config.Agree {
+			if len(qe.Groups) > 1 {
+				log.Printf("peers disagree on %s, going with the majority: %v\n", method, qe)
+			}
+			return a.resp, nil
+		}
+	}
+	if len(qe.Groups) > 1 {
+		log.Printf("peers disagree on %s: %v\n", method, qe)
+	}
+	return nil, qe
+}
+
+// normalizeResponse returns the part of a JSON RPC response peers are expected to agree on, in a canonical form: the
+// result re-encoded with its object keys sorted, or for an error just its code, since servers word their messages
+// differently.
+func normalizeResponse(resp []byte) (json.RawMessage, error) {
+	var env struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Code int `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(resp, &env); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if env.Error != nil {
+		return json.RawMessage(fmt.Sprintf(`{"error":{"code":%d}}`, env.Error.Code)), nil
+	}
+	var result interface{}
+	d := json.NewDecoder(bytes.NewReader(env.Result))
+	d.UseNumber()
+	if len(env.Result) > 0 {
+		if err := d.Decode(&result); err != nil {
+			return nil, fmt.Errorf("invalid result: %w", err)
+		}
+	}
+	return json.Marshal(result)
+}
@@ -0,0 +1,140 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// newResultElectrum starts a fake Electrum server on the given loopback IP that answers every request with result, or
+// with an error if result is empty.
+func newResultElectrum(t *testing.T, ip, result string) electrum.Node {
+	return newFakeElectrumAt(t, ip, func(req *fakeRequest) (interface{}, error) {
+		if result == "" {
+			return nil, errors.New("no such transaction")
+		}
+		return json.RawMessage(result), nil
+	}).node()
+}
+
+func TestRelay_forwardQuorum(t *testing.T) {
+	const balance = `{"confirmed":1000,"unconfirmed":0}`
+	tests := []struct {
+		name    string
+		results []string
+		dead    bool
+		config  QuorumConfig
+		want    string
+		wantErr error
+		// wantGroups are the sorted peer groups of a disagreement.
+		wantGroups [][]string
+	}{
+		{
+			name:    "all agree",
+			results: []string{balance, balance, balance},
+			want:    balance,
+		},
+		{
+			name:    "agreement ignores formatting and key order",
+			results: []string{balance, `{ "unconfirmed": 0, "confirmed": 1000 }`, `{"confirmed":5,"unconfirmed":0}`},
+			want:    balance,
+		},
+		{
+			name:       "no majority",
+			results:    []string{balance, `{"confirmed":5,"unconfirmed":0}`, `{"confirmed":7,"unconfirmed":0}`},
+			wantErr:    ErrDisagreement,
+			wantGroups: [][]string{{"127.0.0.1"}, {"127.0.0.3"}, {"127.0.0.4"}},
+		},
+		{
+			name:       "unanimity required",
+			results:    []string{balance, balance, `{"confirmed":5,"unconfirmed":0}`},
+			config:     QuorumConfig{Agree: 3},
+			wantErr:    ErrDisagreement,
+			wantGroups: [][]string{{"127.0.0.1", "127.0.0.3"}, {"127.0.0.4"}},
+		},
+		{
+			name:    "errors agree by code",
+			results: []string{"", "", balance},
+		},
+		{
+			name:    "a failed peer doesn't count",
+			results: []string{balance, balance},
+			dead:    true,
+			want:    balance,
+		},
+		{
+			name:    "too few peers",
+			results: []string{balance},
+			wantErr: ErrNoPeers,
+		},
+	}
+	ips := []string{"127.0.0.1", "127.0.0.3", "127.0.0.4"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var peers []electrum.Node
+			for i, result := range tt.results {
+				peers = append(peers, newResultElectrum(t, ips[i], result))
+			}
+			if tt.dead {
+				peers = append(peers, deadNode(t))
+			}
+			r := NewRelay(peers, nil, newTestClient(t), WithQuorum(tt.config))
+			req := []byte(`{"jsonrpc":"2.0","method":"blockchain.scripthash.get_balance","params":["ab"],"id":"q"}`)
+			resp, err := r.forward(context.Background(), req, nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("forward() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				var qe *QuorumError
+				if tt.wantGroups != nil && errors.As(err, &qe) {
+					var groups [][]string
+					for _, g := range qe.Groups {
+						sort.Strings(g.Peers)
+						groups = append(groups, g.Peers)
+					}
+					sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+					if !reflect.DeepEqual(groups, tt.wantGroups) {
+						t.Errorf("groups = %v, want %v", groups, tt.wantGroups)
+					}
+				}
+				if code := upstreamError(context.Background(), err).Code; tt.wantErr == ErrDisagreement && code != CodeDisagreement {
+					t.Errorf("upstreamError() code = %d, want %d", code, CodeDisagreement)
+				}
+				return
+			}
+			var got electrum.JSONRPCResponse
+			if err := json.Unmarshal(resp, &got); err != nil {
+				t.Fatalf("forward() = %s, not a JSON RPC response: %v", resp, err)
+			}
+			if string(got.ID) != `"q"` {
+				t.Errorf("response id = %s, want the caller's", got.ID)
+			}
+			if tt.want == "" {
+				if got.Error == nil {
+					t.Errorf("forward() = %s, want the error the peers agreed on", resp)
+				}
+				return
+			}
+			want, _ := normalizeResponse([]byte(`{"result":` + tt.want + `}`))
+			if norm, _ := normalizeResponse(resp); string(norm) != string(want) {
+				t.Errorf("forward() = %s, want result %s", resp, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelay_forwardQuorumOtherMethods(t *testing.T) {
+	only := newFakeElectrum(t, func(req *fakeRequest) (interface{}, error) {
+		return 1, nil
+	})
+	r := NewRelay([]electrum.Node{only.node()}, nil, newTestClient(t), WithQuorum(QuorumConfig{}))
+	req := []byte(`{"jsonrpc":"2.0","method":"blockchain.relayfee","params":[],"id":1}`)
+	if _, err := r.forward(context.Background(), req, nil); err != nil {
+		t.Errorf("forward() of a method without a quorum error = %v", err)
+	}
+}
@@ -1,29 +1,88 @@
 package relay
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
-	"strings"
+	"path"
 	"sync"
 	"time"
 
+	"github.com/tylerchambers/electrumrelay/pkg/chain"
 	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+	"github.com/tylerchambers/electrumrelay/pkg/websocket"
 )
 
 // Relay represents an electrum relay.
 // Handles the logic of finding peers, then taking and forwarding requests to them.
 type Relay struct {
-	Peers            []electrum.Node
-	PeerMutex        sync.Mutex
+	Peers     []electrum.Node
+	PeerMutex sync.Mutex
+	// ForbiddenMethods are method patterns the relay refuses to forward. See MatchMethod for the pattern syntax.
 	ForbiddenMethods []string
-	ElectrumClient   *electrum.Client
+	// AllowedMethods, if not empty, switches the relay to allow-list mode: only methods matching one of these patterns
+	// are forwarded. ForbiddenMethods still applies on top of it.
+	AllowedMethods []string
+	ElectrumClient *electrum.Client
+	// Upgrader upgrades requests to ServeWebSocket. Unless its CheckOrigin is set, origins are checked against
+	// AllowedOrigins.
+	Upgrader websocket.Upgrader
+	// AllowedOrigins are the origins, such as https://wallet.example.com, whose web pages may open WebSocket sessions
+	// besides the relay's own; "*" allows any. By default only pages served by the relay itself may, so that other
+	// sites can't use the relay from their visitors' browsers. Clients that send no Origin are not browsers, and are
+	// always allowed.
+	AllowedOrigins []string
+
+	// HealthConfig controls how peers are health checked. Unset fields take their values from DefaultHealthConfig.
+	HealthConfig HealthConfig
+	// Balancer chooses the peer each request is forwarded to among the healthy ones. WeightedRandomBalancer is used if
+	// it is nil.
+	Balancer Balancer
+	// RetryConfig controls how requests that fail upstream are retried on other peers. Unset fields take their values
+	// from DefaultRetryConfig.
+	RetryConfig RetryConfig
+	// BreakerConfig controls when a peer's circuit breaker opens, stopping requests to it. Unset fields take their values
+	// from DefaultBreakerConfig.
+	BreakerConfig BreakerConfig
+	// BreakerHandler, if not nil, is called with every change in the state of a peer's circuit breaker.
+	BreakerHandler func(BreakerTransition)
+	// Hedging, if not nil, enables hedged requests: read-only requests a peer is slow to answer are also sent to a
+	// second peer. Unset fields take their values from DefaultHedgeConfig.
+	Hedging *HedgeConfig
+	// Quorum, if not nil, enables consensus reads: requests for the methods it selects are sent to several peers, and
+	// only answered if enough of them agree. Unset fields take their values from DefaultQuorumConfig.
+	Quorum *QuorumConfig
+	// VerifyTransactions sets whether transactions returned by blockchain.transaction.get are checked against merkle
+	// proofs and block headers, and what happens to those that fail.
+	VerifyTransactions VerifyMode
+	// Network, if not nil, is the network the relay serves. Peers are only registered once server.features shows that
+	// they serve it.
+	Network *electrum.Network
+	// Chain, if not nil, is the header chain the relay validates its peers' headers into, once TrackChain is called.
+	// Header requests are answered from it, and peers whose tip is not on it are unhealthy.
+	Chain *chain.Chain
+
+	outstanding    outstanding
+	retryBudget    retryBudget
+	breakers       breakers
+	latencies      latencies
+	headerFeedOnce sync.Once
+	headerFeed     *HeaderFeed
+	healthOnce     sync.Once
+	health         *HealthChecker
+	chainOnce      sync.Once
 }
 
 // NewRelay constructs a new JSON RPC Relay.
-func NewRelay(peers []electrum.Node, forbiddenMethods []string, electrumClient *electrum.Client) *Relay {
-	return &Relay{Peers: peers, PeerMutex: sync.Mutex{}, ForbiddenMethods: forbiddenMethods, ElectrumClient: electrumClient}
+func NewRelay(peers []electrum.Node, forbiddenMethods []string, electrumClient *electrum.Client, opts ...Option) *Relay {
+	r := &Relay{Peers: peers, PeerMutex: sync.Mutex{}, ForbiddenMethods: forbiddenMethods, ElectrumClient: electrumClient}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
 
 func (r *Relay) NoOnions() []electrum.Node {
@@ -36,90 +95,297 @@ func (r *Relay) NoOnions() []electrum.Node {
 	return out
 }
 
+// DefaultTimeout bounds upstream calls made without a context deadline.
+const DefaultTimeout = time.Second * 10
+
 // Bootstrap takes an initial peer, asks for its peers, then registers them.
 func (r *Relay) Bootstrap(initialPeer *electrum.Node) error {
+	return r.BootstrapContext(context.Background(), initialPeer)
+}
+
+// BootstrapContext is like Bootstrap, but gives up when ctx is done. If the relay has a Network, the initial peer must
+// be verified to serve it, and only the peers it lists that are verified to serve it are registered. Asking the initial
+// peer is given DefaultTimeout, and so is verifying each of its peers, so that a long list doesn't run out of time.
+func (r *Relay) BootstrapContext(ctx context.Context, initialPeer *electrum.Node) error {
+	ictx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+	defer cancel()
+	if r.Network != nil && initialPeer.Network != r.Network.Name {
+		if err := r.VerifyPeer(ictx, initialPeer); err != nil {
+			return err
+		}
+	}
 	// Make a random request ID
-	peers, err := r.ElectrumClient.GetPeerInfo(initialPeer, rand.Intn(512), time.Second*10)
+	peers, err := r.ElectrumClient.GetPeerInfoContext(ictx, initialPeer, rand.Intn(512))
 	if err != nil {
 		return err
 	}
-	err = r.RegisterPeers(peers)
-	if err != nil {
-		return err
+	for _, peer := range peers {
+		if !peer.IsValid() {
+			return fmt.Errorf("invalid peer: %s not registering any", peer.Host)
+		}
+	}
+	if r.Network != nil {
+		peers, err = r.verifyPeers(ctx, peers)
+		if len(peers) == 0 {
+			return fmt.Errorf("none of the peers of %s serve %s: %w", initialPeer.Host, r.Network.Name, err)
+		}
 	}
+	r.addPeers(peers...)
 	return nil
 }
 
-// RegisterPeer adds a peer to the relay's slice of peers.
+// RegisterPeer adds a peer to the relay's slice of peers. If the relay has a Network, the peer is only added once it
+// is verified to serve it.
 func (r *Relay) RegisterPeer(peer *electrum.Node) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	return r.RegisterPeerContext(ctx, peer)
+}
+
+// RegisterPeerContext is like RegisterPeer, but gives up when ctx is done.
+func (r *Relay) RegisterPeerContext(ctx context.Context, peer *electrum.Node) error {
 	if !peer.IsValid() {
 		return fmt.Errorf("invalid peer: %s not registering", peer.Host)
 	}
-	r.PeerMutex.Lock()
-	r.Peers = append(r.Peers, *peer)
-	r.PeerMutex.Unlock()
+	if err := r.VerifyPeer(ctx, peer); err != nil {
+		return fmt.Errorf("not registering %s: %w", peer.Host, err)
+	}
+	r.addPeers(*peer)
 	return nil
 }
 
-// RegisterPeers adds a slice of peers to the relay's slice of peers.
+// RegisterPeers adds a slice of peers to the relay's slice of peers. If the relay has a Network, they are only added
+// once every one of them is verified to serve it.
 func (r *Relay) RegisterPeers(peers []electrum.Node) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	return r.RegisterPeersContext(ctx, peers)
+}
+
+// RegisterPeersContext is like RegisterPeers, but gives up when ctx is done.
+func (r *Relay) RegisterPeersContext(ctx context.Context, peers []electrum.Node) error {
 	for _, peer := range peers {
 		if !peer.IsValid() {
 			return fmt.Errorf("invalid peer: %s not registering any", peer.Host)
 		}
 	}
-	r.PeerMutex.Lock()
-	r.Peers = append(r.Peers, peers...)
-	r.PeerMutex.Unlock()
+	if r.Network != nil {
+		verified, err := r.verifyPeers(ctx, peers)
+		if err != nil {
+			return fmt.Errorf("not registering any: %w", err)
+		}
+		peers = verified
+	}
+	r.addPeers(peers...)
 	return nil
 }
 
+// addPeers appends peers to the relay's slice of peers, skipping any already in it.
+func (r *Relay) addPeers(peers ...electrum.Node) {
+	r.PeerMutex.Lock()
+	defer r.PeerMutex.Unlock()
+	for _, peer := range peers {
+		known := false
+		for _, p := range r.Peers {
+			if p.Host == peer.Host && p.IP == peer.IP {
+				known = true
+				break
+			}
+		}
+		if !known {
+			r.Peers = append(r.Peers, peer)
+		}
+	}
+}
+
 // ValidateRequest validates an incoming HTTP Request, parses out the JSON RPC request it contains in the body, and
-// makes sure it's allowed.
+// makes sure it's allowed. Batches are checked call by call when they are forwarded, so that one forbidden call does
+// not fail the whole batch. Errors are *Error, and the body is returned with them when it could be read so that the
+// caller can echo the request's id. Bodies larger than MaxRequestSize are refused without being read in full.
 func (r *Relay) ValidateRequest(req *http.Request) ([]byte, error) {
-	b, err := io.ReadAll(req.Body)
+	return r.validateRequest(nil, req)
+}
+
+// validateRequest is ValidateRequest. w, if not nil, is told when the body is too large, so that the server closes
+// the connection rather than read the rest of it.
+func (r *Relay) validateRequest(w http.ResponseWriter, req *http.Request) ([]byte, error) {
+	b, err := io.ReadAll(http.MaxBytesReader(w, req.Body, MaxRequestSize))
+	if err != nil && len(b) >= MaxRequestSize {
+		return nil, &Error{Code: CodeInvalidRequest, Message: "invalid request: body too large", Status: http.StatusRequestEntityTooLarge, Err: err}
+	}
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse electrum request: %v", err)
+		return nil, &Error{Code: CodeInvalidRequest, Message: "unable to read request", Status: http.StatusBadRequest, Err: err}
 	}
-	if !r.AllowedMethod(b) {
-		return nil, fmt.Errorf("method is forbidden by the relay")
+	if IsBatch(b) {
+		if !json.Valid(b) {
+			return b, parseError(nil)
+		}
+		return b, nil
+	}
+	if _, err := r.checkCall(b); err != nil {
+		return b, err
 	}
 	return b, nil
 }
 
-// AllowedMethod returns true if the method it is passed is not forbidden by the relay.
+// checkCall parses a single JSON RPC request and applies the relay's method policy to it, returning the request's id.
+func (r *Relay) checkCall(req []byte) (json.RawMessage, error) {
+	if !json.Valid(req) {
+		return nil, parseError(nil)
+	}
+	var call struct {
+		ID     json.RawMessage `json:"id"`
+		Method *string         `json:"method"`
+	}
+	if err := json.Unmarshal(req, &call); err != nil {
+		return nil, invalidRequest("not a JSON RPC request object")
+	}
+	if call.Method == nil {
+		return call.ID, invalidRequest("missing method")
+	}
+	if !r.AllowedMethodName(*call.Method) {
+		return call.ID, methodForbidden()
+	}
+	return call.ID, nil
+}
+
+// AllowedMethod returns true if the method of the JSON RPC request it is passed is allowed by the relay's method
+// policy. Requests that can't be parsed, or that have no method, are not allowed.
 func (r *Relay) AllowedMethod(req []byte) bool {
-	s := string(req)
-	for _, v := range r.ForbiddenMethods {
-		if strings.Contains(v, s) {
-			return false
+	// Only the method is decoded: IDs may be strings and params objects, which electrum.JSONRPCRequest can't hold.
+	var call struct {
+		Method *string `json:"method"`
+	}
+	if err := json.Unmarshal(req, &call); err != nil || call.Method == nil {
+		return false
+	}
+	return r.AllowedMethodName(*call.Method)
+}
+
+// AllowedMethodName returns true if method is allowed by the relay's method policy. In allow-list mode the method must
+// match one of AllowedMethods, and in either mode it must not match any of ForbiddenMethods.
+func (r *Relay) AllowedMethodName(method string) bool {
+	if len(r.AllowedMethods) > 0 && !matchAny(r.AllowedMethods, method) {
+		return false
+	}
+	return !matchAny(r.ForbiddenMethods, method)
+}
+
+// MatchMethod reports whether method matches pattern. Patterns are exact method names, or contain * wildcards matching
+// any run of characters, e.g. "blockchain.scripthash.*" or "*". Malformed patterns match nothing.
+func MatchMethod(pattern, method string) bool {
+	matched, err := path.Match(pattern, method)
+	return err == nil && matched
+}
+
+func matchAny(patterns []string, method string) bool {
+	for _, p := range patterns {
+		if MatchMethod(p, method) {
+			return true
 		}
 	}
-	return true
+	return false
 }
 
-// RandomNode selects and returns a random electrum node from the list of peers.
-// holdTheOnions only returns clearnet nodes until Tor support is implemented.
+// RandomNode selects an electrum node from the list of peers with the relay's balancer, or returns nil if there are
+// none. holdTheOnions only returns clearnet nodes, for clients that can't reach onion nodes.
 func (r *Relay) RandomNode(holdTheOnions bool) *electrum.Node {
+	r.PeerMutex.Lock()
+	var peers []electrum.Node
 	if holdTheOnions {
-		r.PeerMutex.Lock()
-		noOnions := r.NoOnions()
-		random := &noOnions[rand.Intn(len(noOnions))]
-		r.PeerMutex.Unlock()
-		return random
+		peers = r.NoOnions()
+	} else {
+		peers = append(peers, r.Peers...)
 	}
-	r.PeerMutex.Lock()
-	random := &r.Peers[rand.Intn(len(r.Peers))]
 	r.PeerMutex.Unlock()
-	return random
+	return r.pick(peers, "")
+}
+
+// eligiblePeers returns a copy of the peers the relay's electrum client can connect to, leaving out onion peers unless
+// the client has a Tor proxy.
+func (r *Relay) eligiblePeers() []electrum.Node {
+	r.PeerMutex.Lock()
+	defer r.PeerMutex.Unlock()
+	if !r.ElectrumClient.SupportsOnions() {
+		return r.NoOnions()
+	}
+	return append([]electrum.Node(nil), r.Peers...)
+}
+
+// pickPeer chooses a peer to forward a request made with ctx to, or returns nil if there are none.
+func (r *Relay) pickPeer(ctx context.Context) *electrum.Node {
+	return r.pick(r.eligiblePeers(), ClientKey(ctx))
 }
 
-// ForwardRequest forwards the request to a random peer, and returns the response as bytes.
+// ForwardRequest forwards the request to a peer chosen by the relay's balancer, and returns the response as bytes.
+// Batches are handled by ForwardBatchContext.
 func (r *Relay) ForwardRequest(req []byte) ([]byte, error) {
-	n := r.RandomNode(true)
-	resp, err := r.ElectrumClient.SendRequestBytes(req, n, time.Second*10)
+	return r.ForwardRequestContext(context.Background(), req)
+}
+
+// ForwardRequestContext is like ForwardRequest, but gives up when ctx is done. Calls are bounded by DefaultTimeout if
+// ctx has no deadline of its own, and are retried on other peers as RetryConfig allows. Failures to get a response are
+// returned as *Error; error responses from the upstream server are not failures, and are returned unchanged.
+func (r *Relay) ForwardRequestContext(ctx context.Context, req []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultTimeout)
+		defer cancel()
+	}
+	if IsBatch(req) {
+		return r.ForwardBatchContext(ctx, req)
+	}
+	resp, err := r.forward(ctx, req, nil)
 	if err != nil {
-		return nil, fmt.Errorf("error forwarding request %s to node %s %v", string(req), n.Host, err)
+		return nil, upstreamError(ctx, err)
 	}
 	return resp, nil
 }
+
+// Status is a snapshot of the relay's state for reporting.
+type Status struct {
+	Network  string                   `json:"network,omitempty"`
+	Peers    int                      `json:"peers"`
+	Pool     electrum.PoolStats       `json:"pool"`
+	Health   map[string]PeerHealth    `json:"health"`
+	Breakers map[string]BreakerStatus `json:"breakers"`
+	Chain    *ChainStatus             `json:"chain,omitempty"`
+	// Versions are the server software and protocol version negotiated with each peer connected to, by host.
+	Versions map[string]*electrum.ServerVersion `json:"versions,omitempty"`
+}
+
+// Status reports the number of registered peers and the versions negotiated with them, the state of the electrum
+// client's connection pool, and the health and circuit breakers of the peers, and the header chain if the relay keeps
+// one. The negotiated versions are also recorded on the registered peers.
+func (r *Relay) Status() Status {
+	versions := r.registerVersions()
+	r.PeerMutex.Lock()
+	peers := len(r.Peers)
+	r.PeerMutex.Unlock()
+	var network string
+	if r.Network != nil {
+		network = r.Network.Name
+	}
+	return Status{Network: network, Peers: peers, Versions: versions, Pool: r.ElectrumClient.PoolStats(), Health: r.Health().Snapshot(),
+		Breakers: r.BreakerSnapshot(), Chain: r.chainStatus()}
+}
+
+// registerVersions records the version the electrum client negotiated with each registered peer on the peer, under
+// PeerMutex, and returns them by host.
+func (r *Relay) registerVersions() map[string]*electrum.ServerVersion {
+	r.PeerMutex.Lock()
+	defer r.PeerMutex.Unlock()
+	var versions map[string]*electrum.ServerVersion
+	for i := range r.Peers {
+		v, ok := r.ElectrumClient.NegotiatedVersion(&r.Peers[i])
+		if !ok {
+			continue
+		}
+		r.Peers[i].RegisterVersion(v)
+		if versions == nil {
+			versions = make(map[string]*electrum.ServerVersion)
+		}
+		versions[r.Peers[i].Host] = v
+	}
+	return versions
+}
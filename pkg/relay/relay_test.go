@@ -1,6 +1,7 @@
 package relay
 
 import (
+	"context"
 	"reflect"
 	"sync"
 	"testing"
@@ -76,7 +77,6 @@ func TestNewRelay(t *testing.T) {
 func TestRelay_NoOnions(t *testing.T) {
 	type fields struct {
 		Peers            []electrum.Node
-		PeerMutex        sync.Mutex
 		ForbiddenMethods []string
 		ElectrumClient   *electrum.Client
 	}
@@ -108,7 +108,6 @@ func TestRelay_NoOnions(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			r := &Relay{
 				Peers:            tt.fields.Peers,
-				PeerMutex:        tt.fields.PeerMutex,
 				ForbiddenMethods: tt.fields.ForbiddenMethods,
 				ElectrumClient:   tt.fields.ElectrumClient,
 			}
@@ -122,7 +121,6 @@ func TestRelay_NoOnions(t *testing.T) {
 func TestRelay_Bootstrap(t *testing.T) {
 	type fields struct {
 		Peers            []electrum.Node
-		PeerMutex        sync.Mutex
 		ForbiddenMethods []string
 		ElectrumClient   *electrum.Client
 	}
@@ -141,7 +139,6 @@ func TestRelay_Bootstrap(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			r := &Relay{
 				Peers:            tt.fields.Peers,
-				PeerMutex:        tt.fields.PeerMutex,
 				ForbiddenMethods: tt.fields.ForbiddenMethods,
 				ElectrumClient:   tt.fields.ElectrumClient,
 			}
@@ -155,7 +152,6 @@ func TestRelay_Bootstrap(t *testing.T) {
 func TestRelay_RegisterPeer(t *testing.T) {
 	type fields struct {
 		Peers            []electrum.Node
-		PeerMutex        sync.Mutex
 		ForbiddenMethods []string
 		ElectrumClient   *electrum.Client
 	}
@@ -174,7 +170,6 @@ func TestRelay_RegisterPeer(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			r := &Relay{
 				Peers:            tt.fields.Peers,
-				PeerMutex:        tt.fields.PeerMutex,
 				ForbiddenMethods: tt.fields.ForbiddenMethods,
 				ElectrumClient:   tt.fields.ElectrumClient,
 			}
@@ -188,7 +183,6 @@ func TestRelay_RegisterPeer(t *testing.T) {
 func TestRelay_RegisterPeers(t *testing.T) {
 	type fields struct {
 		Peers            []electrum.Node
-		PeerMutex        sync.Mutex
 		ForbiddenMethods []string
 		ElectrumClient   *electrum.Client
 	}
@@ -207,7 +201,6 @@ func TestRelay_RegisterPeers(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			r := &Relay{
 				Peers:            tt.fields.Peers,
-				PeerMutex:        tt.fields.PeerMutex,
 				ForbiddenMethods: tt.fields.ForbiddenMethods,
 				ElectrumClient:   tt.fields.ElectrumClient,
 			}
@@ -221,8 +214,8 @@ func TestRelay_RegisterPeers(t *testing.T) {
 func TestRelay_AllowedMethod(t *testing.T) {
 	type fields struct {
 		Peers            []electrum.Node
-		PeerMutex        sync.Mutex
 		ForbiddenMethods []string
+		AllowedMethods   []string
 		ElectrumClient   *electrum.Client
 	}
 	type args struct {
@@ -240,27 +233,106 @@ func TestRelay_AllowedMethod(t *testing.T) {
 				ForbiddenMethods: []string{"server.version"},
 			},
 			args: args{
-				req: []byte("server.version"),
+				req: []byte(`{"jsonrpc":"2.0","method":"server.version","params":[],"id":1}`),
 			},
 			want: false,
 		},
 		{
-			name: "forbidden method detected in req",
+			name: "method not forbidden",
 			fields: fields{
 				ForbiddenMethods: []string{"server.version"},
 			},
 			args: args{
-				req: []byte("Lorem ipsum dolor sit amet, consectetur adipiscing elit. Quisque feugiat pulvinar urna, sit amet luctus mi mattis at"),
+				req: []byte(`{"jsonrpc":"2.0","method":"server.banner","params":[],"id":1}`),
+			},
+			want: true,
+		},
+		{
+			name: "method name in params is not the method",
+			fields: fields{
+				ForbiddenMethods: []string{"server.version"},
+			},
+			args: args{
+				req: []byte(`{"jsonrpc":"2.0","method":"server.banner","params":["server.version"],"id":"x"}`),
 			},
 			want: true,
 		},
+		{
+			name: "prefix of a forbidden method is allowed",
+			fields: fields{
+				ForbiddenMethods: []string{"blockchain.transaction.broadcast"},
+			},
+			args: args{
+				req: []byte(`{"jsonrpc":"2.0","method":"blockchain.transaction","params":[],"id":1}`),
+			},
+			want: true,
+		},
+		{
+			name: "wildcard deny",
+			fields: fields{
+				ForbiddenMethods: []string{"blockchain.scripthash.*"},
+			},
+			args: args{
+				req: []byte(`{"jsonrpc":"2.0","method":"blockchain.scripthash.get_history","params":["aa"],"id":1}`),
+			},
+			want: false,
+		},
+		{
+			name: "allow list permits matching method",
+			fields: fields{
+				AllowedMethods: []string{"server.ping", "blockchain.scripthash.*"},
+			},
+			args: args{
+				req: []byte(`{"jsonrpc":"2.0","method":"blockchain.scripthash.listunspent","params":["aa"],"id":1}`),
+			},
+			want: true,
+		},
+		{
+			name: "allow list rejects other methods",
+			fields: fields{
+				AllowedMethods: []string{"server.ping", "blockchain.scripthash.*"},
+			},
+			args: args{
+				req: []byte(`{"jsonrpc":"2.0","method":"blockchain.transaction.broadcast","params":["00"],"id":1}`),
+			},
+			want: false,
+		},
+		{
+			name: "deny list applies on top of allow list",
+			fields: fields{
+				AllowedMethods:   []string{"blockchain.scripthash.*"},
+				ForbiddenMethods: []string{"blockchain.scripthash.subscribe"},
+			},
+			args: args{
+				req: []byte(`{"jsonrpc":"2.0","method":"blockchain.scripthash.subscribe","params":["aa"],"id":1}`),
+			},
+			want: false,
+		},
+		{
+			name: "unparseable request",
+			fields: fields{
+				ForbiddenMethods: []string{"server.version"},
+			},
+			args: args{
+				req: []byte("Lorem ipsum dolor sit amet, consectetur adipiscing elit. Quisque feugiat pulvinar urna, sit amet luctus mi mattis at"),
+			},
+			want: false,
+		},
+		{
+			name:   "request without a method",
+			fields: fields{},
+			args: args{
+				req: []byte(`{"jsonrpc":"2.0","params":[],"id":1}`),
+			},
+			want: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			r := &Relay{
 				Peers:            tt.fields.Peers,
-				PeerMutex:        tt.fields.PeerMutex,
 				ForbiddenMethods: tt.fields.ForbiddenMethods,
+				AllowedMethods:   tt.fields.AllowedMethods,
 				ElectrumClient:   tt.fields.ElectrumClient,
 			}
 			if got := r.AllowedMethod(tt.args.req); got != tt.want {
@@ -269,3 +341,48 @@ func TestRelay_AllowedMethod(t *testing.T) {
 		})
 	}
 }
+
+func TestMatchMethod(t *testing.T) {
+	tests := []struct {
+		pattern string
+		method  string
+		want    bool
+	}{
+		{"server.ping", "server.ping", true},
+		{"server.ping", "server.pin", false},
+		{"blockchain.scripthash.*", "blockchain.scripthash.get_balance", true},
+		{"blockchain.scripthash.*", "blockchain.scripthash", false},
+		{"blockchain.*.subscribe", "blockchain.headers.subscribe", true},
+		{"*", "server.banner", true},
+		{"[", "[", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.method, func(t *testing.T) {
+			if got := MatchMethod(tt.pattern, tt.method); got != tt.want {
+				t.Errorf("MatchMethod(%q, %q) = %v, want %v", tt.pattern, tt.method, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelay_StatusVersions(t *testing.T) {
+	upstream := newFakeElectrum(t, func(req *fakeRequest) (interface{}, error) {
+		return nil, nil
+	})
+	r := NewRelay([]electrum.Node{upstream.node()}, nil, newTestClient(t))
+	if v := r.Status().Versions; v != nil {
+		t.Errorf("Status().Versions = %v before connecting", v)
+	}
+	if _, err := r.forward(context.Background(), []byte(`{"jsonrpc":"2.0","id":1,"method":"server.ping","params":[]}`), nil); err != nil {
+		t.Fatal(err)
+	}
+	want := &electrum.ServerVersion{Software: "ElectrumX 1.16.0", Protocol: "1.4"}
+	if got := r.Status().Versions[upstream.node().Host]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Status().Versions[%s] = %+v, want %+v", upstream.node().Host, got, want)
+	}
+	r.PeerMutex.Lock()
+	defer r.PeerMutex.Unlock()
+	if p := r.Peers[0]; p.ServerSoftware != want.Software || p.Version != want.Protocol {
+		t.Errorf("peer reports %q %q, want %q %q", p.ServerSoftware, p.Version, want.Software, want.Protocol)
+	}
+}
@@ -0,0 +1,273 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// RetryConfig controls how requests that fail upstream are retried on other peers. Zero fields take their values from
+// DefaultRetryConfig.
+type RetryConfig struct {
+	// MaxAttempts is how many peers a request is tried on at most, including the first. 1 disables retries.
+	MaxAttempts int
+	// BaseBackoff is how long to wait before the first retry. The wait doubles with every retry, up to MaxBackoff, and
+	// is jittered so that retries of requests that failed together are spread out.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// BudgetRatio is how many retries each request earns, and BudgetMax how many can be banked. Retries are only made
+	// while the budget lasts, so that a peer set that is failing across the board isn't sent several times the load.
+	BudgetRatio float64
+	BudgetMax   float64
+	// Methods are patterns of the methods that may be retried, matched as by MatchMethod. They must be safe to send
+	// more than once.
+	Methods []string
+	// RetryBroadcast allows blockchain.transaction.broadcast to be retried, whether or not Methods matches it.
+	// Broadcasts are never retried without it, whatever Methods contains.
+	RetryBroadcast bool
+}
+
+// DefaultRetryMethods are the read-only Electrum methods, which are retried by default. server.version is not among
+// them, as sessions answer it from the version they negotiated without asking the server.
+var DefaultRetryMethods = []string{
+	"blockchain.block.header",
+	"blockchain.block.headers",
+	"blockchain.estimatefee",
+	"blockchain.headers.subscribe",
+	"blockchain.relayfee",
+	"blockchain.scripthash.get_balance",
+	"blockchain.scripthash.get_history",
+	"blockchain.scripthash.get_mempool",
+	"blockchain.scripthash.listunspent",
+	"blockchain.scripthash.subscribe",
+	"blockchain.transaction.get",
+	"blockchain.transaction.get_merkle",
+	"blockchain.transaction.id_from_pos",
+	"mempool.get_fee_histogram",
+	"server.banner",
+	"server.donation_address",
+	"server.features",
+	"server.peers.subscribe",
+	"server.ping",
+}
+
+// broadcastMethod is never retried unless RetryConfig.RetryBroadcast is set.
+const broadcastMethod = "blockchain.transaction.broadcast"
+
+// DefaultRetryConfig is the retry configuration used for unset fields of Relay.RetryConfig.
+var DefaultRetryConfig = RetryConfig{
+	MaxAttempts: 3,
+	BaseBackoff: 50 * time.Millisecond,
+	MaxBackoff:  time.Second,
+	BudgetRatio: 0.1,
+	BudgetMax:   10,
+	Methods:     DefaultRetryMethods,
+}
+
+// WithRetryConfig sets how failed requests are retried. DefaultRetryConfig is used otherwise.
+func WithRetryConfig(config RetryConfig) Option {
+	return func(r *Relay) {
+		r.RetryConfig = config
+	}
+}
+
+// withDefaults fills unset fields from DefaultRetryConfig.
+func (c RetryConfig) withDefaults() RetryConfig {
+	d := DefaultRetryConfig
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = d.MaxAttempts
+	}
+	if c.BaseBackoff <= 0 {
+		c.BaseBackoff = d.BaseBackoff
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = d.MaxBackoff
+	}
+	if c.BudgetRatio <= 0 {
+		c.BudgetRatio = d.BudgetRatio
+	}
+	if c.BudgetMax <= 0 {
+		c.BudgetMax = d.BudgetMax
+	}
+	if c.Methods == nil {
+		c.Methods = d.Methods
+	}
+	return c
+}
+
+// retryable reports whether method may be retried.
+func (c RetryConfig) retryable(method string) bool {
+	if method == broadcastMethod {
+		return c.RetryBroadcast
+	}
+	return matchAny(c.Methods, method)
+}
+
+// backoff returns how long to wait before the given retry, counting from 1: exponential, capped at MaxBackoff, and
+// jittered over its upper half.
+func (c RetryConfig) backoff(retry int) time.Duration {
+	d := c.MaxBackoff
+	if shift := retry - 1; shift < 30 && c.BaseBackoff<<shift < c.MaxBackoff {
+		d = c.BaseBackoff << shift
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// retryBudget is a token bucket of retries, filled by requests and drained by retries. It starts full.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	filled bool
+}
+
+// deposit credits the budget for a request.
+func (b *retryBudget) deposit(c RetryConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.filled {
+		b.tokens, b.filled = c.BudgetMax, true
+	}
+	b.tokens += c.BudgetRatio
+	if b.tokens > c.BudgetMax {
+		b.tokens = c.BudgetMax
+	}
+}
+
+// withdraw takes a retry from the budget, reporting false if there is none left.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ForwardError is a request that could not be forwarded to any of the peers it was tried on.
+type ForwardError struct {
+	Method string
+	// Peers are the hosts the request was tried on, in order.
+	Peers []string
+	// Err is the failure of the last attempt.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *ForwardError) Error() string {
+	return fmt.Sprintf("error forwarding %s to %s: %v", e.Method, strings.Join(e.Peers, ", "), e.Err)
+}
+
+// Unwrap returns the failure of the last attempt.
+func (e *ForwardError) Unwrap() error {
+	return e.Err
+}
+
+// requestMethod returns the method of a single JSON RPC request, or an empty string if it has none.
+func requestMethod(req []byte) string {
+	var call struct {
+		Method string `json:"method"`
+	}
+	_ = json.Unmarshal(req, &call)
+	return call.Method
+}
+
+// forward sends a single request to n, or to a peer chosen by the balancer if n is nil. Header requests the relay's
+// Chain can answer aren't sent at all. Methods that need a quorum are sent as forwardQuorum does, and others as
+// forwardRetrying does. Transactions returned are then verified if VerifyTransactions is set.
+func (r *Relay) forward(ctx context.Context, req []byte, n *electrum.Node) ([]byte, error) {
+	method := requestMethod(req)
+	if resp, ok := r.fromChain(req, method); ok {
+		return resp, nil
+	}
+	var resp []byte
+	var err error
+	if quorum := r.quorum(method); quorum != nil {
+		resp, err = r.forwardQuorum(ctx, req, method, quorum)
+	} else {
+		resp, err = r.forwardRetrying(ctx, req, method, n)
+	}
+	if err != nil || method != txGetMethod || r.VerifyTransactions == VerifyOff {
+		return resp, err
+	}
+	return r.verifyTransaction(ctx, req, resp)
+}
+
+// forwardRetrying sends a request to n, or to a peer chosen by the balancer if n is nil, hedging it if Hedging is set.
+// If that fails and the method may be retried, it is tried again on other peers, with backoff, as RetryConfig and the
+// retry budget allow. Failures are returned as *ForwardError.
+func (r *Relay) forwardRetrying(ctx context.Context, req []byte, method string, n *electrum.Node) ([]byte, error) {
+	config := r.RetryConfig.withDefaults()
+	r.retryBudget.deposit(config)
+	var tried []string
+	var err error
+	for attempt := 1; ; attempt++ {
+		if n == nil {
+			n = r.pick(untried(r.eligiblePeers(), tried), ClientKey(ctx))
+		}
+		if n == nil {
+			if len(tried) == 0 {
+				return nil, ErrNoPeers
+			}
+			break
+		}
+		var resp []byte
+		var hosts []string
+		resp, hosts, err = r.hedge(ctx, n, req, method, tried)
+		tried = append(tried, hosts...)
+		if err == nil {
+			return resp, nil
+		}
+		if attempt >= config.MaxAttempts || !config.retryable(method) || ctx.Err() != nil {
+			break
+		}
+		if !r.retryBudget.withdraw() {
+			log.Printf("not retrying %s after failure on %s: retry budget exhausted\n", method, strings.Join(hosts, ", "))
+			break
+		}
+		log.Printf("%s failed on %s, retrying on another peer: %v\n", method, strings.Join(hosts, ", "), err)
+		if !sleepContext(ctx, config.backoff(attempt)) {
+			break
+		}
+		n = nil
+	}
+	return nil, &ForwardError{Method: method, Peers: tried, Err: err}
+}
+
+// untried returns the peers whose hosts aren't in tried.
+func untried(peers []electrum.Node, tried []string) []electrum.Node {
+	out := peers[:0]
+	for _, p := range peers {
+		skip := false
+		for _, host := range tried {
+			if p.Host == host {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// sleepContext waits for d, reporting false if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
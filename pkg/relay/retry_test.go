@@ -0,0 +1,131 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+func TestRelay_forward(t *testing.T) {
+	live := newFakeElectrum(t, func(req *fakeRequest) (interface{}, error) {
+		return "ok", nil
+	})
+	dead := deadNode(t)
+	alsoDead := deadNode(t)
+	alsoDead.Host = "127.0.0.5"
+
+	tests := []struct {
+		name      string
+		peers     []electrum.Node
+		method    string
+		config    RetryConfig
+		wantPeers []string
+	}{
+		{
+			name:   "read fails over",
+			peers:  []electrum.Node{dead, live.node()},
+			method: "blockchain.scripthash.get_balance",
+		},
+		{
+			name:      "broadcast is not retried",
+			peers:     []electrum.Node{dead, live.node()},
+			method:    "blockchain.transaction.broadcast",
+			wantPeers: []string{dead.Host},
+		},
+		{
+			name:   "broadcast retried when allowed",
+			peers:  []electrum.Node{dead, live.node()},
+			method: "blockchain.transaction.broadcast",
+			config: RetryConfig{RetryBroadcast: true},
+		},
+		{
+			name:      "methods not listed are not retried",
+			peers:     []electrum.Node{dead, live.node()},
+			method:    "blockchain.scripthash.get_balance",
+			config:    RetryConfig{Methods: []string{"server.*"}},
+			wantPeers: []string{dead.Host},
+		},
+		{
+			name:      "retries disabled",
+			peers:     []electrum.Node{dead, live.node()},
+			method:    "server.ping",
+			config:    RetryConfig{MaxAttempts: 1},
+			wantPeers: []string{dead.Host},
+		},
+		{
+			name:      "every peer fails",
+			peers:     []electrum.Node{dead, alsoDead},
+			method:    "server.ping",
+			wantPeers: []string{dead.Host, alsoDead.Host},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.BaseBackoff = time.Millisecond
+			r := NewRelay(tt.peers, nil, newTestClient(t), WithBalancer(&RoundRobinBalancer{}), WithRetryConfig(tt.config))
+			req := []byte(`{"jsonrpc":"2.0","method":"` + tt.method + `","params":[],"id":1}`)
+			resp, err := r.forward(context.Background(), req, nil)
+			if tt.wantPeers == nil {
+				if err != nil || len(resp) == 0 {
+					t.Fatalf("forward() = %s, %v, want a response", resp, err)
+				}
+				return
+			}
+			var fe *ForwardError
+			if !errors.As(err, &fe) {
+				t.Fatalf("forward() error = %v, want a *ForwardError", err)
+			}
+			if fe.Method != tt.method || !reflect.DeepEqual(fe.Peers, tt.wantPeers) {
+				t.Errorf("forward() error = %+v, want method %s tried on %v", fe, tt.method, tt.wantPeers)
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	c := RetryConfig{BudgetRatio: 0.5, BudgetMax: 2}.withDefaults()
+	var b retryBudget
+	b.deposit(c)
+	for i := 0; i < 2; i++ {
+		if !b.withdraw() {
+			t.Fatalf("withdraw() %d = false, want a full budget to allow it", i)
+		}
+	}
+	if b.withdraw() {
+		t.Fatal("withdraw() of an empty budget = true")
+	}
+	b.deposit(c)
+	if b.withdraw() {
+		t.Fatal("withdraw() after half a retry was earned = true")
+	}
+	b.deposit(c)
+	b.deposit(c)
+	if !b.withdraw() {
+		t.Fatal("withdraw() after a retry was earned = false")
+	}
+}
+
+func TestRetryConfig_backoff(t *testing.T) {
+	c := RetryConfig{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	tests := []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{4, 400 * time.Millisecond, 800 * time.Millisecond},
+		{5, 500 * time.Millisecond, time.Second},
+		{64, 500 * time.Millisecond, time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			if got := c.backoff(tt.retry); got < tt.min || got > tt.max {
+				t.Errorf("backoff(%d) = %v, want between %v and %v", tt.retry, got, tt.min, tt.max)
+			}
+		}
+	}
+}
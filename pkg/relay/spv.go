@@ -0,0 +1,280 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/tylerchambers/electrumrelay/pkg/chain"
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+// VerifyMode is what the relay does to check the transactions it returns from blockchain.transaction.get.
+type VerifyMode int
+
+const (
+	// VerifyOff passes transactions through unchecked.
+	VerifyOff VerifyMode = iota
+	// VerifyFlag checks transactions and reports the outcome in an "spv" member added to the response, alongside the
+	// result.
+	VerifyFlag
+	// VerifyReject checks transactions and replaces those that fail with an error response. Only headers from a
+	// header Chain, or agreed on by a quorum, are trusted, so every transaction fails without one or the other.
+	VerifyReject
+)
+
+var verifyModeNames = []string{"off", "flag", "reject"}
+
+// String returns the name of the mode, as accepted by ParseVerifyMode.
+func (m VerifyMode) String() string {
+	if m < 0 || int(m) >= len(verifyModeNames) {
+		return fmt.Sprintf("VerifyMode(%d)", int(m))
+	}
+	return verifyModeNames[m]
+}
+
+// ParseVerifyMode parses the name of a verification mode.
+func ParseVerifyMode(s string) (VerifyMode, error) {
+	for i, name := range verifyModeNames {
+		if name == s {
+			return VerifyMode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown verification mode %q", s)
+}
+
+// WithTransactionVerification sets how transactions returned by blockchain.transaction.get are verified.
+func WithTransactionVerification(mode VerifyMode) Option {
+	return func(r *Relay) {
+		r.VerifyTransactions = mode
+	}
+}
+
+// ErrUnverified is returned, wrapped in an *SPVError, for transactions that fail verification.
+var ErrUnverified = errors.New("transaction failed verification")
+
+// SPVError is a transaction that could not be verified.
+type SPVError struct {
+	TxID string
+	Err  error
+}
+
+// Error implements the error interface.
+func (e *SPVError) Error() string {
+	return fmt.Sprintf("transaction %s failed verification: %v", e.TxID, e.Err)
+}
+
+// Is makes SPVError match ErrUnverified.
+func (e *SPVError) Is(target error) bool {
+	return target == ErrUnverified
+}
+
+// Unwrap returns why verification failed.
+func (e *SPVError) Unwrap() error {
+	return e.Err
+}
+
+// SPVResult is what the relay adds to a blockchain.transaction.get response as its "spv" member in VerifyFlag mode.
+type SPVResult struct {
+	Verified    bool   `json:"verified"`
+	BlockHeight int    `json:"block_height,omitempty"`
+	BlockHash   string `json:"block_hash,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// txGetMethod is the method whose responses are verified.
+const txGetMethod = "blockchain.transaction.get"
+
+// verifyTransaction checks the transaction in resp, the response to the blockchain.transaction.get request req, and
+// flags or rejects it according to VerifyTransactions. Error responses are passed through.
+func (r *Relay) verifyTransaction(ctx context.Context, req, resp []byte) ([]byte, error) {
+	var call struct {
+		Params []json.RawMessage `json:"params"`
+	}
+	var env struct {
+		Result json.RawMessage    `json:"result"`
+		Error  *electrum.RPCError `json:"error"`
+	}
+	if err := json.Unmarshal(resp, &env); err != nil || env.Error != nil {
+		return resp, nil
+	}
+	var txid string
+	if err := json.Unmarshal(req, &call); err != nil || len(call.Params) == 0 || json.Unmarshal(call.Params[0], &txid) != nil {
+		// The server answered a request it shouldn't have; there is nothing to check the answer against.
+		return resp, nil
+	}
+
+	header, height, err := r.checkTransaction(ctx, txid, env.Result)
+	if err != nil {
+		if ctx.Err() != nil {
+			// The request timed out or was abandoned; that says nothing about the transaction.
+			return nil, err
+		}
+		err = &SPVError{TxID: txid, Err: err}
+		log.Println(err)
+		if r.VerifyTransactions == VerifyReject {
+			return nil, err
+		}
+		return withMember(resp, "spv", SPVResult{Error: err.Error()})
+	}
+	if r.VerifyTransactions == VerifyReject {
+		return resp, nil
+	}
+	return withMember(resp, "spv", SPVResult{Verified: true, BlockHeight: height, BlockHash: header.Hash})
+}
+
+// checkTransaction verifies that result, a blockchain.transaction.get result, is the transaction txid and is in a
+// block: that the transaction hashes to txid, and that the merkle branch the peers give for it leads to the merkle root
+// of the block header at its height, as blockHeader finds it. It returns the header and its height. Unconfirmed
+// transactions can't be verified.
+func (r *Relay) checkTransaction(ctx context.Context, txid string, result json.RawMessage) (*electrum.BlockHeader, int, error) {
+	var raw string
+	if err := json.Unmarshal(result, &raw); err != nil {
+		var verbose electrum.VerboseTransaction
+		if err := json.Unmarshal(result, &verbose); err != nil {
+			return nil, 0, fmt.Errorf("unexpected result: %v", err)
+		}
+		raw = verbose.Hex
+	}
+	tx, err := electrum.ParseTransaction(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !strings.EqualFold(tx.TxID, txid) {
+		return nil, 0, fmt.Errorf("returned transaction is %s", tx.TxID)
+	}
+
+	height, err := r.transactionHeight(ctx, tx)
+	if err != nil {
+		return nil, 0, err
+	}
+	var proof electrum.MerkleProof
+	if err := r.call(ctx, "blockchain.transaction.get_merkle", []interface{}{tx.TxID, height}, &proof); err != nil {
+		return nil, 0, fmt.Errorf("fetching merkle proof: %w", err)
+	}
+	if proof.BlockHeight != height {
+		return nil, 0, fmt.Errorf("merkle proof is for height %d, want %d", proof.BlockHeight, height)
+	}
+	header, err := r.blockHeader(ctx, height)
+	if err != nil {
+		return nil, 0, err
+	}
+	root, err := electrum.MerkleRoot(tx.TxID, proof.Merkle, proof.Pos)
+	if err != nil {
+		return nil, 0, err
+	}
+	if root != header.MerkleRoot {
+		return nil, 0, fmt.Errorf("merkle branch leads to %s, not the merkle root %s of block %d", root, header.MerkleRoot, height)
+	}
+	return header, height, nil
+}
+
+// blockHeader returns the header of the block at height, to check a transaction against. If the relay keeps a header
+// Chain the header comes from it, so the block is known to be on the best chain. Otherwise it is fetched from the
+// peers and must have valid proof of work for the relay's network; in VerifyReject mode it must also be agreed on by a
+// quorum, as a header from a single peer vouches for nothing that peer couldn't forge along with the transaction.
+func (r *Relay) blockHeader(ctx context.Context, height int) (*electrum.BlockHeader, error) {
+	if r.Chain != nil {
+		header, ok := r.Chain.Header(height)
+		if !ok {
+			return nil, fmt.Errorf("block %d is above the tip of the header chain", height)
+		}
+		return header, nil
+	}
+	const method = "blockchain.block.header"
+	if r.VerifyTransactions == VerifyReject && r.quorum(method) == nil {
+		return nil, fmt.Errorf("no trusted header for block %d: rejecting needs a header chain or a quorum for %s", height, method)
+	}
+	var headerHex string
+	if err := r.call(ctx, method, []interface{}{height}, &headerHex); err != nil {
+		return nil, fmt.Errorf("fetching block header %d: %w", height, err)
+	}
+	header, err := electrum.ParseBlockHeader(headerHex)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.chainParams().CheckProofOfWork(header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// chainParams returns the consensus rules of the relay's network: those of Chain if it keeps one, and otherwise those
+// of Network, or of mainnet if it has none.
+func (r *Relay) chainParams() *chain.Params {
+	if r.Chain != nil {
+		return r.Chain.Params()
+	}
+	if r.Network != nil {
+		if params, err := chain.NetworkParams(r.Network.Name); err == nil {
+			return params
+		}
+	}
+	return &chain.MainNetParams
+}
+
+// transactionHeight finds the height of the block a transaction is in. blockchain.transaction.get_merkle needs it, and
+// blockchain.transaction.get doesn't give it, so it is looked up in the history of the transaction's outputs.
+func (r *Relay) transactionHeight(ctx context.Context, tx *electrum.Transaction) (int, error) {
+	for _, out := range tx.Outputs {
+		var history []electrum.HistoryEntry
+		if err := r.call(ctx, "blockchain.scripthash.get_history", []interface{}{electrum.ScriptHash(out.Script)}, &history); err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			// Some outputs, such as OP_RETURN ones, aren't indexed; another output may be.
+			continue
+		}
+		for _, h := range history {
+			if !strings.EqualFold(h.TxHash, tx.TxID) {
+				continue
+			}
+			if h.Height <= 0 {
+				return 0, errors.New("transaction is unconfirmed")
+			}
+			return h.Height, nil
+		}
+	}
+	return 0, errors.New("could not find the block the transaction is in")
+}
+
+// call makes a request of the relay's own to its peers, as a client request would be forwarded, and decodes its result
+// into result.
+func (r *Relay) call(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	req, err := json.Marshal(electrum.NewJSONRPCRequest("2.0", 1, method, params))
+	if err != nil {
+		return err
+	}
+	resp, err := r.forward(ctx, req, nil)
+	if err != nil {
+		return err
+	}
+	var env electrum.JSONRPCResponse
+	if err := json.Unmarshal(resp, &env); err != nil {
+		return fmt.Errorf("invalid response to %s: %v", method, err)
+	}
+	if env.Error != nil {
+		return env.Error
+	}
+	if err := json.Unmarshal(env.Result, result); err != nil {
+		return fmt.Errorf("invalid result for %s: %v", method, err)
+	}
+	return nil
+}
+
+// withMember adds a member to a JSON RPC response object.
+func withMember(resp []byte, name string, value interface{}) ([]byte, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(resp, &obj); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	obj[name] = b
+	return json.Marshal(obj)
+}
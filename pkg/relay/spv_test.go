@@ -0,0 +1,242 @@
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/tylerchambers/electrumrelay/pkg/chain"
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+)
+
+const (
+	// testTxHex is the coinbase transaction of the genesis block.
+	testTxHex = "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d04ffff001d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000"
+	testTxID  = "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b"
+	// testOtherRoot is a merkle root of a block the transaction isn't in.
+	testOtherRoot = "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f"
+	// regtestBits is the easiest target, met by about every other hash.
+	regtestBits = 0x207fffff
+)
+
+// mineHeader returns a hex encoded header for a block with the given merkle root, following prev, with a nonce that
+// meets bits if mine is set and fails to otherwise.
+func mineHeader(t *testing.T, prev, merkleRoot string, bits uint32, mine bool) string {
+	t.Helper()
+	b := make([]byte, electrum.HeaderSize)
+	binary.LittleEndian.PutUint32(b[0:4], 1)
+	if prev != "" {
+		p, err := electrum.HashFromString(prev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(b[4:36], p)
+	}
+	root, err := electrum.HashFromString(merkleRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(b[36:68], root)
+	// Ten minutes after the regtest genesis block, so that the header can follow it.
+	binary.LittleEndian.PutUint32(b[68:72], 1296688602+600)
+	binary.LittleEndian.PutUint32(b[72:76], bits)
+	for nonce := uint32(0); ; nonce++ {
+		binary.LittleEndian.PutUint32(b[76:80], nonce)
+		h, err := electrum.ParseBlockHeaderBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (h.CheckProofOfWork() == nil) == mine {
+			return hex.EncodeToString(b)
+		}
+	}
+}
+
+// spvElectrum is what a fake server tells the relay about a transaction.
+type spvElectrum struct {
+	tx     interface{}
+	height int
+	header string
+}
+
+func (s spvElectrum) handle(req *fakeRequest) (interface{}, error) {
+	switch req.Method {
+	case "blockchain.transaction.get":
+		if s.tx == nil {
+			return nil, &electrum.RPCError{Code: 2, Message: "no such transaction"}
+		}
+		return s.tx, nil
+	case "blockchain.scripthash.get_history":
+		return []electrum.HistoryEntry{{Height: s.height, TxHash: testTxID}}, nil
+	case "blockchain.transaction.get_merkle":
+		return electrum.MerkleProof{BlockHeight: s.height, Merkle: []string{}, Pos: 0}, nil
+	case "blockchain.block.header":
+		return s.header, nil
+	}
+	return nil, errors.New("unknown method")
+}
+
+// spvChain returns a regtest header chain whose block 1 holds only the test transaction, or just the genesis block if
+// empty is set.
+func spvChain(t *testing.T, empty bool) *chain.Chain {
+	t.Helper()
+	c, err := chain.New(&chain.RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty {
+		return c
+	}
+	b, _ := hex.DecodeString(mineHeader(t, chain.RegTestParams.GenesisHash, testTxID, regtestBits, true))
+	if err := c.Connect(1, b); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRelay_verifyTransaction(t *testing.T) {
+	good := mineHeader(t, "", testTxID, regtestBits, true)
+	headerQuorum := WithQuorum(QuorumConfig{Methods: []string{"blockchain.block.header"}, Peers: 1, Agree: 1})
+	tests := []struct {
+		name         string
+		mode         VerifyMode
+		opts         []Option
+		server       spvElectrum
+		wantErr      error
+		wantVerified *bool
+		wantRPCError bool
+	}{
+		{
+			name:         "verified and flagged",
+			mode:         VerifyFlag,
+			server:       spvElectrum{tx: testTxHex, height: 1, header: good},
+			wantVerified: boolPtr(true),
+		},
+		{
+			name:   "verified by quorum and passed through",
+			mode:   VerifyReject,
+			opts:   []Option{headerQuorum},
+			server: spvElectrum{tx: testTxHex, height: 1, header: good},
+		},
+		{
+			name:   "verified by the header chain",
+			mode:   VerifyReject,
+			opts:   []Option{WithHeaderChain(spvChain(t, false))},
+			server: spvElectrum{tx: testTxHex, height: 1, header: mineHeader(t, "", testOtherRoot, regtestBits, true)},
+		},
+		{
+			name:    "block above the header chain",
+			mode:    VerifyReject,
+			opts:    []Option{WithHeaderChain(spvChain(t, true))},
+			server:  spvElectrum{tx: testTxHex, height: 1, header: good},
+			wantErr: ErrUnverified,
+		},
+		{
+			name:    "rejecting without a chain or quorum",
+			mode:    VerifyReject,
+			server:  spvElectrum{tx: testTxHex, height: 1, header: good},
+			wantErr: ErrUnverified,
+		},
+		{
+			name:         "target easier than the network allows",
+			mode:         VerifyFlag,
+			opts:         []Option{WithNetwork(electrum.MainNet)},
+			server:       spvElectrum{tx: testTxHex, height: 1, header: good},
+			wantVerified: boolPtr(false),
+		},
+		{
+			name:         "verbose result",
+			mode:         VerifyFlag,
+			server:       spvElectrum{tx: map[string]interface{}{"hex": testTxHex, "txid": testTxID}, height: 1, header: good},
+			wantVerified: boolPtr(true),
+		},
+		{
+			name:         "unconfirmed is flagged",
+			mode:         VerifyFlag,
+			server:       spvElectrum{tx: testTxHex, height: 0, header: good},
+			wantVerified: boolPtr(false),
+		},
+		{
+			name:    "wrong transaction",
+			mode:    VerifyReject,
+			server:  spvElectrum{tx: "02" + testTxHex[2:], height: 1, header: good},
+			wantErr: ErrUnverified,
+		},
+		{
+			name:    "merkle root mismatch",
+			mode:    VerifyReject,
+			opts:    []Option{headerQuorum},
+			server:  spvElectrum{tx: testTxHex, height: 1, header: mineHeader(t, "", testOtherRoot, regtestBits, true)},
+			wantErr: ErrUnverified,
+		},
+		{
+			name:    "header without proof of work",
+			mode:    VerifyReject,
+			opts:    []Option{headerQuorum},
+			server:  spvElectrum{tx: testTxHex, height: 1, header: mineHeader(t, "", testTxID, 0x1d00ffff, false)},
+			wantErr: ErrUnverified,
+		},
+		{
+			name:         "error responses pass through",
+			mode:         VerifyReject,
+			server:       spvElectrum{},
+			wantRPCError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeElectrum(t, tt.server.handle)
+			opts := append([]Option{WithNetwork(electrum.RegTest), WithTransactionVerification(tt.mode)}, tt.opts...)
+			r := NewRelay([]electrum.Node{f.node()}, nil, newTestClient(t), opts...)
+			req := []byte(`{"jsonrpc":"2.0","method":"blockchain.transaction.get","params":["` + testTxID + `"],"id":3}`)
+			resp, err := r.forward(context.Background(), req, nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("forward() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if code := upstreamError(context.Background(), err).Code; code != CodeUnverified {
+					t.Errorf("upstreamError() code = %d, want %d", code, CodeUnverified)
+				}
+				return
+			}
+			var got struct {
+				Result json.RawMessage    `json:"result"`
+				Error  *electrum.RPCError `json:"error"`
+				SPV    *SPVResult         `json:"spv"`
+			}
+			if err := json.Unmarshal(resp, &got); err != nil {
+				t.Fatalf("forward() = %s, not a JSON RPC response: %v", resp, err)
+			}
+			if (got.Error != nil) != tt.wantRPCError {
+				t.Errorf("forward() = %s, want an error response %v", resp, tt.wantRPCError)
+			}
+			switch {
+			case tt.wantVerified == nil && got.SPV != nil:
+				t.Errorf("forward() = %s, want no spv member", resp)
+			case tt.wantVerified != nil && (got.SPV == nil || got.SPV.Verified != *tt.wantVerified):
+				t.Errorf("forward() = %s, want verified %v", resp, *tt.wantVerified)
+			case tt.wantVerified != nil && *tt.wantVerified && got.SPV.BlockHeight != 1:
+				t.Errorf("spv = %+v, want block height 1", got.SPV)
+			}
+		})
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestParseVerifyMode(t *testing.T) {
+	for _, m := range []VerifyMode{VerifyOff, VerifyFlag, VerifyReject} {
+		got, err := ParseVerifyMode(m.String())
+		if err != nil || got != m {
+			t.Errorf("ParseVerifyMode(%q) = %v, %v, want %v", m.String(), got, err, m)
+		}
+	}
+	if _, err := ParseVerifyMode("strict"); err == nil {
+		t.Error("ParseVerifyMode() of an unknown mode succeeded")
+	}
+}
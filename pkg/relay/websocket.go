@@ -0,0 +1,149 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+	"github.com/tylerchambers/electrumrelay/pkg/websocket"
+)
+
+// webSocketBuffer is how many outgoing messages a WebSocket session queues before its client is considered too slow
+// and disconnected.
+const webSocketBuffer = 256
+
+// WithAllowedOrigins lets web pages from origins, besides the relay's own, open WebSocket sessions. "*" allows any.
+func WithAllowedOrigins(origins ...string) Option {
+	return func(r *Relay) {
+		r.AllowedOrigins = origins
+	}
+}
+
+// checkOrigin reports whether a WebSocket handshake may proceed: whether it comes from something other than a browser,
+// which sends no Origin, from a page the relay served, or from one of AllowedOrigins.
+func (r *Relay) checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, req.Host) {
+		return true
+	}
+	for _, allowed := range r.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeWebSocket handles a WebSocket session carrying JSON RPC requests and subscription notifications.
+// Each session is pinned to a single upstream node for its lifetime so that subscriptions made over it keep delivering
+// notifications. If the upstream connection drops the WebSocket is closed, and the client is expected to reconnect and
+// subscribe again. Handshakes from origins not allowed by AllowedOrigins are refused.
+func (r *Relay) ServeWebSocket(w http.ResponseWriter, req *http.Request) {
+	upgrader := r.Upgrader
+	if upgrader.CheckOrigin == nil {
+		upgrader.CheckOrigin = r.checkOrigin
+	}
+	conn, err := upgrader.Upgrade(w, req)
+	if err != nil {
+		log.Printf("websocket upgrade from %s failed: %v\n", req.RemoteAddr, err)
+		return
+	}
+	ctx, cancel := context.WithCancel(WithClientKey(context.Background(), remoteHost(req)))
+	defer cancel()
+
+	n := r.pickPeer(ctx)
+	if n == nil {
+		log.Printf("websocket session from %s has no upstream: %v\n", conn.RemoteAddr(), ErrNoPeers)
+		_ = conn.Close(websocket.CloseInternalError, "no upstream server available")
+		return
+	}
+	dialCtx, dialCancel := context.WithTimeout(ctx, DefaultTimeout)
+	upstream, err := r.ElectrumClient.OpenSession(dialCtx, n)
+	dialCancel()
+	if err != nil {
+		log.Printf("websocket session from %s could not connect to %s: %v\n", conn.RemoteAddr(), n.Host, err)
+		_ = conn.Close(websocket.CloseInternalError, "no upstream server available")
+		return
+	}
+	defer upstream.Close()
+
+	out := make(chan []byte, webSocketBuffer)
+	upstream.SetNotificationHandler(func(notification *electrum.Notification) {
+		b, err := json.Marshal(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"method":  notification.Method,
+			"params":  notification.Params,
+		})
+		if err != nil {
+			return
+		}
+		select {
+		case out <- b:
+		default:
+			_ = conn.Close(websocket.ClosePolicyViolation, "client too slow")
+		}
+	})
+	go func() {
+		for {
+			select {
+			case msg := <-out:
+				if err := conn.WriteMessage(websocket.OpText, msg); err != nil {
+					cancel()
+					return
+				}
+			case <-upstream.Done():
+				_ = conn.Close(websocket.CloseGoingAway, "upstream connection lost")
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		go func() {
+			resp := r.handleWebSocketRequest(ctx, upstream, msg)
+			if resp == nil {
+				// A batch made up only of notifications has no response.
+				return
+			}
+			select {
+			case out <- resp:
+			case <-ctx.Done():
+			}
+		}()
+	}
+}
+
+// handleWebSocketRequest forwards a request or batch from a WebSocket session over its pinned upstream session.
+func (r *Relay) handleWebSocketRequest(ctx context.Context, upstream *electrum.Session, msg []byte) []byte {
+	if IsBatch(msg) {
+		ctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+		defer cancel()
+		resp, _ := r.forwardBatch(ctx, msg, sessionSender(upstream))
+		return resp
+	}
+	id, err := r.checkCall(msg)
+	if err != nil {
+		return AsError(err).Response(id)
+	}
+	ctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+	defer cancel()
+	resp, err := upstream.Send(ctx, msg)
+	if err != nil {
+		log.Printf("error forwarding websocket request to %s: %v\n", upstream.Node.Host, err)
+		return upstreamError(ctx, err).Response(id)
+	}
+	return resp
+}
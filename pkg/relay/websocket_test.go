@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tylerchambers/electrumrelay/pkg/electrum"
+	"github.com/tylerchambers/electrumrelay/pkg/websocket"
+)
+
+func TestRelay_ServeWebSocket(t *testing.T) {
+	upstream := newFakeElectrum(t, func(req *fakeRequest) (interface{}, error) {
+		switch req.Method {
+		case "blockchain.scripthash.subscribe":
+			return "status-1", nil
+		case "server.ping":
+			return nil, nil
+		}
+		return nil, errors.New("unknown method")
+	})
+	r := &Relay{
+		Peers:            []electrum.Node{upstream.node()},
+		ForbiddenMethods: []string{"server.banner"},
+		ElectrumClient:   newTestClient(t),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(r.ServeWebSocket))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close(websocket.CloseNormal, "")
+
+	read := func() map[string]interface{} {
+		t.Helper()
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage() error = %v", err)
+		}
+		out := make(map[string]interface{})
+		if err := json.Unmarshal(msg, &out); err != nil {
+			t.Fatalf("invalid message %s: %v", msg, err)
+		}
+		return out
+	}
+
+	_ = conn.WriteMessage(websocket.OpText, []byte(`{"jsonrpc":"2.0","method":"blockchain.scripthash.subscribe","params":["aa"],"id":7}`))
+	if got := read(); got["id"] != float64(7) || got["result"] != "status-1" {
+		t.Errorf("subscribe response = %v, want id 7 result status-1", got)
+	}
+
+	upstream.notify("blockchain.scripthash.subscribe", "aa", "status-2")
+	got := read()
+	if got["method"] != "blockchain.scripthash.subscribe" {
+		t.Fatalf("notification = %v, want blockchain.scripthash.subscribe", got)
+	}
+	if params := got["params"].([]interface{}); params[1] != "status-2" {
+		t.Errorf("notification params = %v, want status-2", params)
+	}
+
+	_ = conn.WriteMessage(websocket.OpText, []byte(`{"jsonrpc":"2.0","method":"server.banner","params":[],"id":8}`))
+	if got := read(); got["id"] != float64(8) || got["error"] == nil {
+		t.Errorf("forbidden method response = %v, want error for id 8", got)
+	}
+}
+
+func TestRelay_WebSocketOrigin(t *testing.T) {
+	upstream := newFakeElectrum(t, func(req *fakeRequest) (interface{}, error) {
+		return nil, nil
+	})
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{"no origin", nil, "", true},
+		{"relay's own origin", nil, "http://%s", true},
+		{"other origin by default", nil, "https://evil.example", false},
+		{"listed origin", []string{"https://wallet.example/"}, "https://wallet.example", true},
+		{"unlisted origin", []string{"https://wallet.example"}, "https://evil.example", false},
+		{"any origin", []string{"*"}, "https://evil.example", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRelay([]electrum.Node{upstream.node()}, nil, newTestClient(t), WithAllowedOrigins(tt.allowed...))
+			srv := httptest.NewServer(http.HandlerFunc(r.ServeWebSocket))
+			defer srv.Close()
+			header := http.Header{}
+			if tt.origin != "" {
+				header.Set("Origin", strings.Replace(tt.origin, "%s", strings.TrimPrefix(srv.URL, "http://"), 1))
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			conn, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), header)
+			if (err == nil) != tt.want {
+				t.Fatalf("Dial() error = %v, want allowed %v", err, tt.want)
+			}
+			if err != nil {
+				if resp == nil || resp.StatusCode != http.StatusForbidden {
+					t.Errorf("Dial() response = %v, want 403", resp)
+				}
+				return
+			}
+			_ = conn.Close(websocket.CloseNormal, "")
+		})
+	}
+}
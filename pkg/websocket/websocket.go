@@ -0,0 +1,323 @@
+// Package websocket implements the WebSocket protocol (RFC 6455), enough to carry JSON RPC messages between browsers
+// and the relay.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Opcodes of WebSocket frames.
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xa
+)
+
+// Close codes sent in close frames.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// DefaultMaxMessageSize bounds incoming messages when the Upgrader does not set a limit.
+const DefaultMaxMessageSize = 1 << 20
+
+// acceptGUID is appended to the client's key to compute Sec-WebSocket-Accept.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrMessageTooBig is returned by ReadMessage when a message exceeds the connection's size limit.
+var ErrMessageTooBig = errors.New("websocket message too big")
+
+// CloseError is returned by ReadMessage once the peer has closed the connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed with code %d: %s", e.Code, e.Reason)
+}
+
+// Upgrader upgrades HTTP requests to WebSocket connections.
+type Upgrader struct {
+	// CheckOrigin returns true if a request's Origin is allowed to connect. All origins are allowed if nil.
+	CheckOrigin func(r *http.Request) bool
+	// MaxMessageSize bounds incoming messages. DefaultMaxMessageSize is used if zero.
+	MaxMessageSize int64
+}
+
+// Upgrade completes the WebSocket handshake on an HTTP request and takes over its connection.
+// On failure an HTTP error has already been written to w.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "websocket handshake requires GET", http.StatusMethodNotAllowed)
+		return nil, errors.New("websocket: handshake method is not GET")
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "not a websocket handshake", http.StatusBadRequest)
+		return nil, errors.New("websocket: missing upgrade headers")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("websocket: missing key")
+	}
+	if u.CheckOrigin != nil && !u.CheckOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, errors.New("websocket: origin not allowed")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response writer cannot be hijacked")
+	}
+	netConn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n\r\n"
+	if _, err := rw.WriteString(resp); err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+	_ = netConn.SetDeadline(time.Time{})
+	max := u.MaxMessageSize
+	if max <= 0 {
+		max = DefaultMaxMessageSize
+	}
+	return &Conn{conn: netConn, r: rw.Reader, maxMessageSize: max}, nil
+}
+
+// AcceptKey computes the Sec-WebSocket-Accept value for a client's Sec-WebSocket-Key.
+func AcceptKey(key string) string {
+	h := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerContains returns true if a comma separated header contains token, ignoring case.
+func headerContains(h http.Header, name string, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Conn is a WebSocket connection. One goroutine may read while others write.
+type Conn struct {
+	conn           net.Conn
+	r              *bufio.Reader
+	maxMessageSize int64
+	// client is true for connections made with Dial, which mask the frames they send.
+	client bool
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+// RemoteAddr returns the address of the peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ReadMessage returns the next text or binary message, reassembling fragments. Pings are answered and pongs ignored.
+// Once the peer closes the connection a *CloseError is returned.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	var opcode int
+	var msg []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case OpPing:
+			if err := c.WriteMessage(OpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			ce := &CloseError{Code: CloseNormal}
+			if len(payload) >= 2 {
+				ce.Code = int(binary.BigEndian.Uint16(payload))
+				ce.Reason = string(payload[2:])
+			}
+			_ = c.Close(ce.Code, "")
+			return 0, nil, ce
+		case OpText, OpBinary:
+			if msg != nil {
+				_ = c.Close(CloseProtocolError, "expected continuation frame")
+				return 0, nil, errors.New("websocket: new message before previous finished")
+			}
+			opcode = op
+			msg = payload
+		case OpContinuation:
+			if msg == nil {
+				_ = c.Close(CloseProtocolError, "unexpected continuation frame")
+				return 0, nil, errors.New("websocket: continuation frame without message")
+			}
+			msg = append(msg, payload...)
+		default:
+			_ = c.Close(CloseProtocolError, "unknown opcode")
+			return 0, nil, fmt.Errorf("websocket: unknown opcode %d", op)
+		}
+		if int64(len(msg)) > c.maxMessageSize {
+			_ = c.Close(CloseMessageTooBig, "")
+			return 0, nil, ErrMessageTooBig
+		}
+		if fin {
+			return opcode, msg, nil
+		}
+	}
+}
+
+// readFrame reads a single frame, unmasking it if it came from a client.
+func (c *Conn) readFrame() (bool, int, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := head[0]&0x80 != 0
+	op := int(head[0] & 0x0f)
+	masked := head[1]&0x80 != 0
+	length := int64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if masked == c.client {
+		_ = c.Close(CloseProtocolError, "only client frames are masked")
+		return false, 0, nil, errors.New("websocket: frame masking does not match its sender")
+	}
+	if length < 0 || length > c.maxMessageSize {
+		_ = c.Close(CloseMessageTooBig, "")
+		return false, 0, nil, ErrMessageTooBig
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		maskBytes(mask, payload)
+	}
+	return fin, op, payload, nil
+}
+
+// WriteMessage writes a single unfragmented message.
+func (c *Conn) WriteMessage(opcode int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return errors.New("websocket: connection closed")
+	}
+	return c.writeFrame(opcode, data)
+}
+
+// writeFrame writes a frame, masked if this is the client end. Callers must hold c.writeMu.
+func (c *Conn) writeFrame(opcode int, data []byte) error {
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | byte(opcode)
+	switch {
+	case len(data) < 126:
+		header[1] = byte(len(data))
+	case len(data) <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(data)))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(data)))
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		header[1] |= 0x80
+		header = append(header, mask[:]...)
+		data = append([]byte(nil), data...)
+		maskBytes(mask, data)
+	}
+	if _, err := c.conn.Write(append(header, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close sends a close frame with code and reason, then closes the underlying connection.
+func (c *Conn) Close(code int, reason string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	_ = c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = c.writeFrame(OpClose, payload)
+	return c.conn.Close()
+}
+
+// maskBytes applies a frame's masking key to its payload in place.
+func maskBytes(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
@@ -0,0 +1,162 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// Example from RFC 6455 section 1.3.
+	if got := AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("AcceptKey() = %s, want s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", got)
+	}
+}
+
+// newEchoServer starts a server that echoes every message back until the client closes.
+func newEchoServer(t *testing.T, u *Upgrader) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := u.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		for {
+			op, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(op, msg); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dial(t *testing.T, url string) *Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, _, err := Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	return conn
+}
+
+func TestConn_Echo(t *testing.T) {
+	conn := dial(t, newEchoServer(t, &Upgrader{}))
+	tests := []struct {
+		name string
+		msg  string
+	}{
+		{name: "short message", msg: `{"jsonrpc":"2.0","method":"server.ping","params":[],"id":1}`},
+		{name: "16 bit length", msg: strings.Repeat("a", 300)},
+		{name: "64 bit length", msg: strings.Repeat("b", 70000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := conn.WriteMessage(OpText, []byte(tt.msg)); err != nil {
+				t.Fatalf("WriteMessage() error = %v", err)
+			}
+			op, got, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("ReadMessage() error = %v", err)
+			}
+			if op != OpText || string(got) != tt.msg {
+				t.Errorf("ReadMessage() = %d %d bytes, want text %d bytes", op, len(got), len(tt.msg))
+			}
+		})
+	}
+}
+
+func TestConn_FragmentsAndPings(t *testing.T) {
+	conn := dial(t, newEchoServer(t, &Upgrader{}))
+	// A ping in the middle of a fragmented message is answered without disturbing the message.
+	frames := []struct {
+		fin     bool
+		op      int
+		payload string
+	}{
+		{fin: false, op: OpText, payload: "hello "},
+		{fin: true, op: OpPing, payload: "p"},
+		{fin: true, op: OpContinuation, payload: "world"},
+	}
+	for _, f := range frames {
+		if err := writeRawFrame(conn, f.fin, f.op, []byte(f.payload)); err != nil {
+			t.Fatalf("writing frame: %v", err)
+		}
+	}
+	_, got, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if string(got) != "hello world" {
+		t.Errorf("ReadMessage() = %q, want %q", got, "hello world")
+	}
+}
+
+func TestConn_Close(t *testing.T) {
+	conn := dial(t, newEchoServer(t, &Upgrader{}))
+	if err := conn.Close(CloseNormal, "bye"); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := conn.WriteMessage(OpText, []byte("x")); err == nil {
+		t.Errorf("WriteMessage() after Close() succeeded")
+	}
+}
+
+func TestConn_MessageTooBig(t *testing.T) {
+	conn := dial(t, newEchoServer(t, &Upgrader{MaxMessageSize: 10}))
+	if err := conn.WriteMessage(OpText, []byte(strings.Repeat("x", 11))); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	_, _, err := conn.ReadMessage()
+	var ce *CloseError
+	if !errors.As(err, &ce) || ce.Code != CloseMessageTooBig {
+		t.Errorf("ReadMessage() error = %v, want close code %d", err, CloseMessageTooBig)
+	}
+}
+
+func TestUpgrader_CheckOrigin(t *testing.T) {
+	url := newEchoServer(t, &Upgrader{CheckOrigin: func(r *http.Request) bool {
+		return r.Header.Get("Origin") == "https://wallet.example"
+	}})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, resp, err := Dial(ctx, url, http.Header{"Origin": {"https://evil.example"}})
+	if err == nil {
+		t.Fatalf("Dial() from disallowed origin succeeded")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Dial() from disallowed origin response = %v, want 403", resp)
+	}
+	conn, _, err := Dial(ctx, url, http.Header{"Origin": {"https://wallet.example"}})
+	if err != nil {
+		t.Fatalf("Dial() from allowed origin error = %v", err)
+	}
+	_ = conn.Close(CloseNormal, "")
+}
+
+// writeRawFrame writes a single client frame with control over the FIN bit.
+func writeRawFrame(c *Conn, fin bool, op int, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	head := byte(op)
+	if fin {
+		head |= 0x80
+	}
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{head, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	masked := append([]byte(nil), payload...)
+	maskBytes(mask, masked)
+	_, err := c.conn.Write(append(frame, masked...))
+	return err
+}